@@ -0,0 +1,43 @@
+// Package accesslog collects the attributes describing a request as it is
+// handled, so the access log can record what a handler resolved (an
+// artifact, a cache hit) and not just the URL.
+package accesslog
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+type ctxKey struct{}
+
+// Entry accumulates the attributes of one request.
+type Entry struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// NewContext returns a context carrying a new, empty Entry.
+func NewContext(ctx context.Context) (context.Context, *Entry) {
+	e := &Entry{}
+	return context.WithValue(ctx, ctxKey{}, e), e
+}
+
+// Annotate adds attrs to the Entry carried by ctx. It does nothing when
+// the request is not being logged.
+func Annotate(ctx context.Context, attrs ...slog.Attr) {
+	e, ok := ctx.Value(ctxKey{}).(*Entry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attrs = append(e.attrs, attrs...)
+}
+
+// Attrs returns the attributes added so far.
+func (e *Entry) Attrs() []slog.Attr {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]slog.Attr(nil), e.attrs...)
+}
@@ -0,0 +1,96 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultMaxSize is used when File.MaxSize is zero.
+const DefaultMaxSize = 100 << 20
+
+// File is an io.Writer appending to Path. When a write would grow the
+// file beyond MaxSize bytes it is renamed to Path.1 (Path.1 to Path.2 and
+// so on, keeping MaxBackups old files) and a new file is started.
+type File struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (l *File) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	maxSize := l.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if l.size > 0 && l.size+int64(len(p)) > maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (l *File) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	backup := func(n int) string { return fmt.Sprintf("%s.%d", l.Path, n) }
+	if l.MaxBackups > 0 {
+		os.Remove(backup(l.MaxBackups))
+		for n := l.MaxBackups - 1; n > 0; n-- {
+			os.Rename(backup(n), backup(n+1))
+		}
+		if err := os.Rename(l.Path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.Path); err != nil {
+		return err
+	}
+	return l.open()
+}
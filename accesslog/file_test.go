@@ -0,0 +1,40 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	f := &File{
+		Path:       path,
+		MaxSize:    10,
+		MaxBackups: 2,
+	}
+	defer f.Close()
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() got err %s", err)
+		}
+	}
+	want := map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	}
+	for p, w := range want {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Errorf("ReadFile(%s) got err %s", p, err)
+			continue
+		}
+		if string(got) != w {
+			t.Errorf("%s got %q wanted %q", filepath.Base(p), got, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("%s.3 exists, wanted at most 2 backups", path)
+	}
+}
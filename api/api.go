@@ -0,0 +1,758 @@
+// Package api serves the corepxe management API under Prefix: the
+// inventory, machine state, host power through their BMCs, CoreOS
+// streams, the image mirror, render previews, validation and diffs.
+// Requests and responses are JSON; the OpenAPI description is generated
+// from the Go types by OpenAPI.
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreos/stream-metadata-go/stream"
+	"github.com/nveeser/corepxe/coreos"
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/mirror"
+	"github.com/nveeser/corepxe/redfish"
+	"github.com/nveeser/corepxe/secrets"
+	"github.com/nveeser/corepxe/store"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+)
+
+// Prefix is the path the API is served under.
+const Prefix = "/api/v1"
+
+// Error is the body of every error response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// PinRequest pins a machine to a CoreOS release, which must be the current
+// release of a cached stream or be in the mirror. An empty release unpins
+// it.
+type PinRequest struct {
+	Release string `json:"release"`
+}
+
+// ConfigPinRequest pins a machine to a config revision, e.g. a commit or
+// "HEAD~1". An empty revision unpins it.
+type ConfigPinRequest struct {
+	Revision string `json:"revision"`
+}
+
+// PowerRequest changes the power of a host through its BMC.
+type PowerRequest struct {
+	// Action is "on", "off", "restart", or "pxe" to restart the host
+	// into a one-time network boot.
+	Action string `json:"action"`
+}
+
+// HostReinstall is the result of reinstalling a host.
+type HostReinstall struct {
+	// Machines are the machines of the host moved to reinstall-requested.
+	Machines []*lifecycle.Machine `json:"machines"`
+	// PXEBooted is set when the host was restarted into a network boot
+	// through its BMC.
+	PXEBooted bool `json:"pxeBooted"`
+}
+
+// Validation is the result of validating the Ignition config of every
+// host.
+type Validation struct {
+	// OK is false when any finding is an error.
+	OK       bool               `json:"ok"`
+	Findings []ignition.Finding `json:"findings"`
+}
+
+// Stream is the state of a CoreOS stream in the stream cache.
+type Stream struct {
+	Name string `json:"name"`
+	// Loaded is false when the stream was never fetched.
+	Loaded       bool   `json:"loaded"`
+	LastModified string `json:"lastModified,omitempty"`
+	// Releases holds the metal release of each architecture.
+	Releases map[string]string `json:"releases,omitempty"`
+}
+
+// MirrorEntry is a file in the image mirror.
+type MirrorEntry struct {
+	mirror.Entry
+	// Current is set for files referenced by the cached streams.
+	Current bool `json:"current"`
+}
+
+// Server holds what the API manages. Tracker and State may be nil, in
+// which case the routes that need them fail.
+type Server struct {
+	Inventory *inventory.File
+	Tracker   *lifecycle.Tracker
+	Streams   *coreos.StreamCache
+	Mirror    *mirror.ImageMirror
+	Ignition  *ignition.Handler
+	// State is the state store, exported for backups. It may be nil.
+	State store.Repository
+	// Secrets resolves the password secrets of BMCs. It may be nil.
+	Secrets secrets.Backend
+	// RenderIPXE writes the script the iPXE template name produces for a
+	// client with the given MAC address.
+	RenderIPXE func(w io.Writer, r *http.Request, name, mac string) error
+	// DiffIgnition returns how the Ignition config of each host differs
+	// between two git revisions of the config directory, an empty one
+	// being the directory as it is. It may be nil.
+	DiffIgnition func(ctx context.Context, from, to string) ([]ignition.HostDiff, error)
+	// ResolveConfigRevision returns the commit a git revision of the
+	// config directory names. It may be nil, in which case machines cannot
+	// be pinned to config revisions.
+	ResolveConfigRevision func(ctx context.Context, rev string) (string, error)
+}
+
+// route is one API operation. in and out are zero values of the request
+// and response body types, used to decode requests and to describe the
+// operation in the OpenAPI document.
+type route struct {
+	method  string
+	path    string
+	summary string
+	in      any
+	out     any
+	// contentType is set for operations that respond with something
+	// other than JSON.
+	contentType string
+	serve       func(s *Server, r *http.Request, in any) (any, error)
+}
+
+// raw is returned by operations with a contentType.
+type raw []byte
+
+var routes = []route{
+	{"GET", "/hosts", "List hosts", nil, []*inventory.Host{}, "", (*Server).hosts},
+	{"GET", "/hosts/{name}", "Get a host", nil, &inventory.Host{}, "", (*Server).host},
+	{"PUT", "/hosts/{name}", "Create or replace a host", &inventory.Host{}, &inventory.Host{}, "", (*Server).putHost},
+	{"DELETE", "/hosts/{name}", "Delete a host", nil, nil, "", (*Server).deleteHost},
+	{"POST", "/hosts/{name}/reinstall", "Reinstall a host and PXE boot it through its BMC", nil, &HostReinstall{}, "", (*Server).reinstallHost},
+	{"POST", "/hosts/{name}/rollback", "Pin the machines of a host to the config revision they were installed with", nil, []*lifecycle.Machine{}, "", (*Server).rollbackHost},
+	{"GET", "/hosts/{name}/power", "Get the power state of a host from its BMC", nil, &redfish.System{}, "", (*Server).power},
+	{"POST", "/hosts/{name}/power", "Power a host on or off, restart it or PXE boot it once", &PowerRequest{}, &redfish.System{}, "", (*Server).setPower},
+	{"GET", "/groups", "List groups", nil, []*inventory.Group{}, "", (*Server).groups},
+	{"GET", "/groups/{name}", "Get a group", nil, &inventory.Group{}, "", (*Server).group},
+	{"PUT", "/groups/{name}", "Create or replace a group", &inventory.Group{}, &inventory.Group{}, "", (*Server).putGroup},
+	{"DELETE", "/groups/{name}", "Delete a group", nil, nil, "", (*Server).deleteGroup},
+	{"POST", "/groups/{name}/reinstall", "Reinstall every installed machine of a group", nil, []*lifecycle.Machine{}, "", (*Server).reinstallGroup},
+	{"GET", "/machines", "List machines", nil, []*lifecycle.Machine{}, "", (*Server).machines},
+	{"GET", "/machines/{id}", "Get a machine", nil, &lifecycle.Machine{}, "", (*Server).machine},
+	{"POST", "/machines/{id}/reinstall", "Reinstall a machine", nil, []*lifecycle.Machine{}, "", (*Server).reinstall},
+	{"PUT", "/machines/{id}/release", "Pin the CoreOS release of a machine", &PinRequest{}, &lifecycle.Machine{}, "", (*Server).pin},
+	{"PUT", "/machines/{id}/config-revision", "Pin the config revision of a machine", &ConfigPinRequest{}, &lifecycle.Machine{}, "", (*Server).pinConfig},
+	{"GET", "/streams", "List CoreOS streams", nil, []*Stream{}, "", (*Server).streams},
+	{"POST", "/streams/{name}/refresh", "Fetch a CoreOS stream", nil, &Stream{}, "", (*Server).refreshStream},
+	{"GET", "/mirror", "List mirrored files", nil, []*MirrorEntry{}, "", (*Server).mirrorEntries},
+	{"DELETE", "/mirror/{path...}", "Evict a mirrored file", nil, nil, "", (*Server).evict},
+	{"GET", "/render/ipxe/{name}", "Render an iPXE script", nil, raw{}, "text/plain", (*Server).renderIPXE},
+	{"GET", "/render/ignition/{osname}/{host}", "Render an Ignition config", nil, raw{}, "application/json", (*Server).renderIgnition},
+	{"GET", "/diff", "Diff the Ignition config of every host between two revisions of the config directory", nil, []ignition.HostDiff{}, "", (*Server).diff},
+	{"GET", "/validate", "Validate the Ignition config of every host", nil, &Validation{}, "", (*Server).validate},
+	{"GET", "/state", "Export the state store for backup", nil, &store.Dump{}, "", (*Server).exportState},
+}
+
+// Handler returns the handler for every API route. Routes include Prefix.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		mux.Handle(rt.method+" "+Prefix+rt.path, s.wrap(rt))
+	}
+	mux.HandleFunc("GET "+Prefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, OpenAPI())
+	})
+	mux.HandleFunc(Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, statusErrorf(http.StatusNotFound, "no such operation: %s %s", r.Method, r.URL.Path))
+	})
+	return mux
+}
+
+func (s *Server) wrap(rt route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in any
+		if rt.in != nil {
+			in = reflect.New(reflect.TypeOf(rt.in).Elem()).Interface()
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(in); err != nil {
+				writeError(w, statusErrorf(http.StatusBadRequest, "invalid request body: %s", err))
+				return
+			}
+		}
+		out, err := rt.serve(s, r, in)
+		switch {
+		case err != nil:
+			writeError(w, err)
+		case out == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case rt.contentType != "":
+			w.Header().Set("Content-Type", rt.contentType)
+			w.Write(out.(raw))
+		default:
+			writeJSON(w, http.StatusOK, out)
+		}
+	})
+}
+
+// hosts lists the hosts. Like every host the API returns, they are
+// redacted of their BMC password.
+func (s *Server) hosts(r *http.Request, _ any) (any, error) {
+	hosts := s.Inventory.Hosts()
+	for i, h := range hosts {
+		hosts[i] = h.Redacted()
+	}
+	return hosts, nil
+}
+
+func (s *Server) host(r *http.Request, _ any) (any, error) {
+	return redactedHost(s.Inventory.Host(r.PathValue("name")))
+}
+
+// putHost creates or replaces a host. As hosts are read without their BMC
+// password, a host put without one keeps its current password, unless
+// it sets a password secret instead.
+func (s *Server) putHost(r *http.Request, in any) (any, error) {
+	h := in.(*inventory.Host)
+	h.Name = r.PathValue("name")
+	if bmc := h.BMC; bmc != nil && bmc.Password == "" && bmc.PasswordSecret == "" {
+		if old, err := s.Inventory.Host(h.Name); err == nil && old.BMC != nil {
+			bmc.Password = old.BMC.Password
+		}
+	}
+	if err := s.Inventory.PutHost(h); err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
+	}
+	return redactedHost(s.Inventory.Host(h.Name))
+}
+
+func redactedHost(h *inventory.Host, err error) (*inventory.Host, error) {
+	if err != nil {
+		return nil, err
+	}
+	return h.Redacted(), nil
+}
+
+func (s *Server) deleteHost(r *http.Request, _ any) (any, error) {
+	return nil, s.Inventory.DeleteHost(r.PathValue("name"))
+}
+
+// reinstallHost requests a reinstall of the machines of a host, those
+// with its MAC addresses and those that fetched its Ignition config, and
+// then PXE boots the host if it has a BMC.
+func (s *Server) reinstallHost(r *http.Request, _ any) (any, error) {
+	h, err := s.Inventory.Host(r.PathValue("name"))
+	if err != nil {
+		return nil, err
+	}
+	if s.Tracker == nil && h.BMC == nil {
+		return nil, errNoTracker
+	}
+	out := &HostReinstall{Machines: []*lifecycle.Machine{}}
+	if s.Tracker != nil {
+		ids, err := s.hostMachines(h)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.Tracker.RequestReinstall(ids...)
+		if err != nil {
+			return nil, err
+		}
+		out.Machines = append(out.Machines, changed...)
+	}
+	if h.BMC != nil {
+		bmc, err := h.BMC.Redfish(r.Context(), s.Secrets)
+		if err == nil {
+			err = bmc.PXEBoot(r.Context())
+		}
+		if err != nil {
+			return nil, &statusError{http.StatusBadGateway, fmt.Errorf("reinstall requested, but PXE boot failed: %w", err)}
+		}
+		slog.Info("Host PXE booted for reinstall", "host", h.Name)
+		out.PXEBooted = true
+	}
+	return out, nil
+}
+
+// rollbackHost pins the machines of a host to the config revision each
+// was last installed with, so that a reinstall brings the host back to
+// it. Machines with no recorded revision are left alone.
+func (s *Server) rollbackHost(r *http.Request, _ any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	h, err := s.Inventory.Host(r.PathValue("name"))
+	if err != nil {
+		return nil, err
+	}
+	ids, err := s.hostMachines(h)
+	if err != nil {
+		return nil, err
+	}
+	pinned := []*lifecycle.Machine{}
+	for _, id := range ids {
+		m, err := s.Tracker.Machine(id)
+		if err != nil {
+			return nil, err
+		}
+		if m.ConfigRevision == "" {
+			continue
+		}
+		if m, err = s.Tracker.PinConfig(id, m.ConfigRevision); err != nil {
+			return nil, err
+		}
+		slog.Info("Machine pinned to config revision", "machine", m.ID, "host", h.Name, "revision", m.ConfigPin)
+		pinned = append(pinned, m)
+	}
+	if len(pinned) == 0 {
+		return nil, statusErrorf(http.StatusConflict, "no machine of host %s has a recorded config revision", h.Name)
+	}
+	return pinned, nil
+}
+
+// hostMachines returns the IDs of the machines of a host: those that
+// fetched its Ignition config and those with its MAC addresses.
+func (s *Server) hostMachines(h *inventory.Host) ([]string, error) {
+	ids, err := s.Tracker.HostMachines(h.OSName() + "/" + h.ConfigName())
+	if err != nil {
+		return nil, err
+	}
+	for _, mac := range h.MACs {
+		if m, err := s.Tracker.Machine(mac); err == nil && !slices.Contains(ids, m.ID) {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *Server) power(r *http.Request, _ any) (any, error) {
+	bmc, err := s.bmc(r.Context(), r.PathValue("name"))
+	if err != nil {
+		return nil, err
+	}
+	return bmcResult(bmc.Status(r.Context()))
+}
+
+func (s *Server) setPower(r *http.Request, in any) (any, error) {
+	name := r.PathValue("name")
+	bmc, err := s.bmc(r.Context(), name)
+	if err != nil {
+		return nil, err
+	}
+	action := in.(*PowerRequest).Action
+	switch action {
+	case "on":
+		err = bmc.Reset(r.Context(), redfish.ResetOn)
+	case "off":
+		err = bmc.Reset(r.Context(), redfish.ResetForceOff)
+	case "restart":
+		err = bmc.Reset(r.Context(), redfish.ResetForceRestart)
+	case "pxe":
+		err = bmc.PXEBoot(r.Context())
+	default:
+		return nil, statusErrorf(http.StatusBadRequest, "invalid power action %q", action)
+	}
+	if err != nil {
+		return bmcResult(nil, err)
+	}
+	slog.Info("Host power changed", "host", name, "action", action)
+	return bmcResult(bmc.Status(r.Context()))
+}
+
+// bmc returns a Redfish client for the BMC of the named host.
+func (s *Server) bmc(ctx context.Context, name string) (*redfish.Client, error) {
+	h, err := s.Inventory.Host(name)
+	if err != nil {
+		return nil, err
+	}
+	if h.BMC == nil {
+		return nil, statusErrorf(http.StatusConflict, "host %s has no BMC", name)
+	}
+	return h.BMC.Redfish(ctx, s.Secrets)
+}
+
+// bmcResult reports errors talking to a BMC as 502 Bad Gateway.
+func bmcResult(sys *redfish.System, err error) (any, error) {
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	return sys, nil
+}
+
+func (s *Server) groups(r *http.Request, _ any) (any, error) {
+	return s.Inventory.Groups(), nil
+}
+
+func (s *Server) group(r *http.Request, _ any) (any, error) {
+	return s.Inventory.Group(r.PathValue("name"))
+}
+
+func (s *Server) putGroup(r *http.Request, in any) (any, error) {
+	g := in.(*inventory.Group)
+	g.Name = r.PathValue("name")
+	if err := s.Inventory.PutGroup(g); err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
+	}
+	return s.Inventory.Group(g.Name)
+}
+
+func (s *Server) deleteGroup(r *http.Request, _ any) (any, error) {
+	name := r.PathValue("name")
+	if _, err := s.Inventory.Group(name); err != nil {
+		return nil, err
+	}
+	for _, h := range s.Inventory.Hosts() {
+		for _, g := range h.Groups {
+			if g == name {
+				return nil, statusErrorf(http.StatusConflict, "group %s is used by host %s", name, h.Name)
+			}
+		}
+	}
+	return nil, s.Inventory.DeleteGroup(name)
+}
+
+// reinstallGroup requests a reinstall of the machines with the MAC
+// addresses of the hosts in a group. Hosts that never booted are skipped.
+func (s *Server) reinstallGroup(r *http.Request, _ any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	name := r.PathValue("name")
+	if _, err := s.Inventory.Group(name); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, h := range s.Inventory.Hosts() {
+		for _, g := range h.Groups {
+			if g != name {
+				continue
+			}
+			for _, mac := range h.MACs {
+				if _, err := s.Tracker.Machine(mac); err == nil {
+					ids = append(ids, mac)
+				}
+			}
+		}
+	}
+	return nonNil(s.Tracker.RequestReinstall(ids...))
+}
+
+func (s *Server) machines(r *http.Request, _ any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	return nonNil(s.Tracker.Machines())
+}
+
+func (s *Server) machine(r *http.Request, _ any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	return s.Tracker.Machine(r.PathValue("id"))
+}
+
+func (s *Server) reinstall(r *http.Request, _ any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	return nonNil(s.Tracker.RequestReinstall(r.PathValue("id")))
+}
+
+func (s *Server) pin(r *http.Request, in any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	release := in.(*PinRequest).Release
+	if release != "" && !s.servable(release) {
+		return nil, statusErrorf(http.StatusBadRequest, "release %s is not in a cached stream or the mirror", release)
+	}
+	return s.Tracker.Pin(r.PathValue("id"), release)
+}
+
+// servable reports whether the images of release can be served to a
+// machine pinned to it: it is the current release of a cached stream, or
+// its PXE artifacts are in the mirror.
+func (s *Server) servable(release string) bool {
+	for _, name := range coreos.StreamNames {
+		cached, err := s.Streams.Cached(name)
+		if err != nil || cached == nil {
+			continue
+		}
+		for arch := range cached.Architectures {
+			if current, err := s.Streams.Release(name, arch); err == nil && current == release {
+				return true
+			}
+			artifacts, err := s.Streams.ReleaseArtifacts(name, arch, release)
+			if err == nil && s.mirrored(artifacts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mirrored reports whether every artifact is in the mirror.
+func (s *Server) mirrored(artifacts map[string]*stream.Artifact) bool {
+	for filetype, a := range artifacts {
+		asset, err := coreos.NewAsset(filetype, a)
+		if err != nil {
+			return false
+		}
+		if ok, err := s.Mirror.Has(asset); err != nil || !ok {
+			return false
+		}
+	}
+	return len(artifacts) > 0
+}
+
+// pinConfig pins a machine to the commit the requested revision names.
+func (s *Server) pinConfig(r *http.Request, in any) (any, error) {
+	if s.Tracker == nil {
+		return nil, errNoTracker
+	}
+	commit := in.(*ConfigPinRequest).Revision
+	if commit != "" {
+		if s.ResolveConfigRevision == nil {
+			return nil, statusErrorf(http.StatusNotImplemented, "config revisions are not supported")
+		}
+		var err error
+		if commit, err = s.ResolveConfigRevision(r.Context(), commit); err != nil {
+			return nil, &statusError{http.StatusBadRequest, err}
+		}
+	}
+	return s.Tracker.PinConfig(r.PathValue("id"), commit)
+}
+
+func (s *Server) streams(r *http.Request, _ any) (any, error) {
+	streams := []*Stream{}
+	for _, name := range coreos.StreamNames {
+		st, err := s.stream(name)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, st)
+	}
+	return streams, nil
+}
+
+func (s *Server) refreshStream(r *http.Request, _ any) (any, error) {
+	name := r.PathValue("name")
+	if !validStream(name) {
+		return nil, statusErrorf(http.StatusNotFound, "unknown stream: %s", name)
+	}
+	if _, err := s.Streams.Refresh(name); err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	return s.stream(name)
+}
+
+func (s *Server) stream(name string) (*Stream, error) {
+	cached, err := s.Streams.Cached(name)
+	if err != nil || cached == nil {
+		return &Stream{Name: name}, err
+	}
+	st := &Stream{
+		Name:         name,
+		Loaded:       true,
+		LastModified: cached.Metadata.LastModified,
+		Releases:     make(map[string]string),
+	}
+	for arch := range cached.Architectures {
+		if release, err := s.Streams.Release(name, arch); err == nil {
+			st.Releases[arch] = release
+		}
+	}
+	return st, nil
+}
+
+func (s *Server) mirrorEntries(r *http.Request, _ any) (any, error) {
+	entries, err := s.Mirror.List()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := s.Streams.Referenced()
+	if err != nil {
+		return nil, err
+	}
+	out := []*MirrorEntry{}
+	for _, e := range entries {
+		out = append(out, &MirrorEntry{Entry: e, Current: refs[e.Path]})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+// evict removes a file from the mirror. Files referenced by the cached
+// streams are only removed with "force=true".
+func (s *Server) evict(r *http.Request, _ any) (any, error) {
+	path := r.PathValue("path")
+	refs, err := s.Streams.Referenced()
+	if err != nil {
+		return nil, err
+	}
+	if refs[path] && r.URL.Query().Get("force") != "true" {
+		return nil, statusErrorf(http.StatusConflict, "%s is referenced by a current stream", path)
+	}
+	if err := s.Mirror.Remove(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, statusErrorf(http.StatusNotFound, "%s not found", path)
+	} else if err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
+	}
+	return nil, nil
+}
+
+func (s *Server) renderIPXE(r *http.Request, _ any) (any, error) {
+	var buf bytes.Buffer
+	if err := s.RenderIPXE(&buf, r, r.PathValue("name"), r.URL.Query().Get("mac")); err != nil {
+		return nil, &statusError{http.StatusUnprocessableEntity, err}
+	}
+	return raw(buf.Bytes()), nil
+}
+
+// renderIgnition renders the Ignition config of a host, or with
+// "butane=true" the merged Butane config it is translated from.
+func (s *Server) renderIgnition(r *http.Request, _ any) (any, error) {
+	osname, host := r.PathValue("osname"), r.PathValue("host")
+	render := s.Ignition.Render
+	if r.URL.Query().Get("butane") == "true" {
+		render = s.Ignition.Butane
+	}
+	data, err := render(osname, host)
+	if errors.Is(err, ignition.ErrNotFound) {
+		return nil, &statusError{http.StatusNotFound, err}
+	}
+	if err != nil {
+		return nil, &statusError{http.StatusUnprocessableEntity, err}
+	}
+	return raw(data), nil
+}
+
+// diff diffs the Ignition config of every host between the revisions
+// "from", which is required, and "to".
+func (s *Server) diff(r *http.Request, _ any) (any, error) {
+	if s.DiffIgnition == nil {
+		return nil, statusErrorf(http.StatusNotImplemented, "diffs are not supported")
+	}
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		return nil, statusErrorf(http.StatusBadRequest, "from is required")
+	}
+	diffs, err := s.DiffIgnition(r.Context(), from, to)
+	if err != nil {
+		return nil, &statusError{http.StatusUnprocessableEntity, err}
+	}
+	if diffs == nil {
+		diffs = []ignition.HostDiff{}
+	}
+	return diffs, nil
+}
+
+// validate renders the Ignition config of every host and reports its
+// errors and warnings.
+func (s *Server) validate(r *http.Request, _ any) (any, error) {
+	findings, err := s.Ignition.ValidateAll(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	v := &Validation{OK: true, Findings: []ignition.Finding{}}
+	for _, f := range findings {
+		if f.Level == ignition.LevelError {
+			v.OK = false
+		}
+		v.Findings = append(v.Findings, f)
+	}
+	return v, nil
+}
+
+// exportState returns every record of the state store, with the BMC
+// passwords of inventory hosts redacted like everywhere else in the API.
+// The dump can be restored with "corepxe state import".
+func (s *Server) exportState(r *http.Request, _ any) (any, error) {
+	if s.State == nil {
+		return nil, statusErrorf(http.StatusNotImplemented, "there is no state store")
+	}
+	var buf bytes.Buffer
+	if err := store.Export(&buf, s.State); err != nil {
+		return nil, err
+	}
+	dump := &store.Dump{}
+	if err := json.Unmarshal(buf.Bytes(), dump); err != nil {
+		return nil, err
+	}
+	for key, value := range dump.Buckets[inventory.HostBucket] {
+		h := &inventory.Host{}
+		if err := json.Unmarshal(value, h); err != nil {
+			return nil, fmt.Errorf("error reading host %s: %w", key, err)
+		}
+		data, err := json.Marshal(h.Redacted())
+		if err != nil {
+			return nil, err
+		}
+		dump.Buckets[inventory.HostBucket][key] = data
+	}
+	return dump, nil
+}
+
+func validStream(name string) bool {
+	for _, n := range coreos.StreamNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nonNil replaces a nil list of machines with an empty one, so it is
+// encoded as [] rather than null.
+func nonNil(ms []*lifecycle.Machine, err error) (any, error) {
+	if ms == nil {
+		ms = []*lifecycle.Machine{}
+	}
+	return ms, err
+}
+
+// statusError is an error with the HTTP status it is reported with.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func statusErrorf(code int, format string, args ...any) error {
+	return &statusError{code, fmt.Errorf(format, args...)}
+}
+
+var errNoTracker = statusErrorf(http.StatusNotImplemented, "machine tracking is disabled")
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var se *statusError
+	switch {
+	case errors.As(err, &se):
+		code = se.code
+	case errors.Is(err, inventory.ErrNotFound), errors.Is(err, lifecycle.ErrNotFound):
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, &Error{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
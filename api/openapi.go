@@ -0,0 +1,189 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// OpenAPI returns the OpenAPI 3 description of the API, generated from
+// the routes and the Go types of their request and response bodies.
+func OpenAPI() map[string]any {
+	g := &schemaGen{components: make(map[string]any)}
+	errorResponse := map[string]any{
+		"description": "error",
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(Error{}))},
+		},
+	}
+	paths := make(map[string]any)
+	for _, rt := range routes {
+		path := pathParam.ReplaceAllString(rt.path, "{$1}")
+		item, _ := paths[Prefix+path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[Prefix+path] = item
+		}
+		op := map[string]any{
+			"summary":     rt.summary,
+			"operationId": operationID(rt),
+			"responses": map[string]any{
+				"default": errorResponse,
+			},
+		}
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.in != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.in))},
+				},
+			}
+		}
+		responses := op["responses"].(map[string]any)
+		switch {
+		case rt.out == nil:
+			responses["204"] = map[string]any{"description": "done"}
+		case rt.contentType != "":
+			responses["200"] = map[string]any{
+				"description": "ok",
+				"content": map[string]any{
+					rt.contentType: map[string]any{"schema": map[string]any{"type": "string"}},
+				},
+			}
+		default:
+			responses["200"] = map[string]any{
+				"description": "ok",
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.out))},
+				},
+			}
+		}
+		item[strings.ToLower(rt.method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "corepxe",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"bearer": []any{}}},
+	}
+}
+
+// pathParam matches the wildcards of a ServeMux pattern.
+var pathParam = regexp.MustCompile(`\{(\w+)(?:\.\.\.)?\}`)
+
+// operationID names an operation after the Server method serving it,
+// e.g. "putHost".
+func operationID(rt route) string {
+	name := runtimeName(rt.serve)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaGen builds JSON schemas for Go types, collecting named structs
+// as components.
+type schemaGen struct {
+	components map[string]any
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(raw{}):
+		return map[string]any{"type": "string"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = nil // break cycles
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema of a struct, following the encoding/json
+// rules for field names and embedded structs.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	obj := map[string]any{"type": "object", "properties": props}
+	if required != nil {
+		obj["required"] = required
+	}
+	return obj
+}
+
+func runtimeName(fn any) string {
+	return runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+}
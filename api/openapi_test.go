@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	data, err := json.Marshal(OpenAPI())
+	if err != nil {
+		t.Fatalf("Marshal() got err %s", err)
+	}
+	var spec struct {
+		Paths      map[string]map[string]struct{ OperationID string }
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if got := spec.Paths["/api/v1/hosts/{name}"]["put"].OperationID; got != "putHost" {
+		t.Errorf("PUT /hosts/{name} got operationId %q wanted putHost", got)
+	}
+	if _, ok := spec.Paths["/api/v1/mirror/{path}"]["delete"]; !ok {
+		t.Errorf("paths missing DELETE /api/v1/mirror/{path}")
+	}
+	host := spec.Components.Schemas["Host"]
+	if _, ok := host.Properties["macs"]; !ok {
+		t.Errorf("Host schema got properties %v, missing macs", host.Properties)
+	}
+	// Embedded mirror.Entry fields are flattened into MirrorEntry.
+	if _, ok := spec.Components.Schemas["MirrorEntry"].Properties["modTime"]; !ok {
+		t.Errorf("MirrorEntry schema missing modTime")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nveeser/corepxe/redfish"
+)
+
+var bmcCmd = &command{
+	name: "bmc",
+	help: "control hosts through the Redfish BMC configured in the inventory",
+	subs: []*command{
+		bmcStatusCmd,
+		bmcPowerCmd,
+		bmcReinstallCmd,
+	},
+}
+
+var bmcStatusCmd = &command{
+	name: "status",
+	args: "<host>",
+	help: "print the power state and boot override of a host",
+	run: func(args []string) error {
+		if len(args) != 1 {
+			return usageError("bmc status <host>")
+		}
+		bmc, err := hostBMC(args[0])
+		if err != nil {
+			return err
+		}
+		s, err := bmc.Status(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\tpower %s\tboot override %s %s\n", args[0], s.PowerState, s.Boot.BootSourceOverrideEnabled, s.Boot.BootSourceOverrideTarget)
+		return nil
+	},
+}
+
+var bmcPowerCmd = &command{
+	name: "power",
+	args: "<host> on|off|restart|pxe",
+	help: "power a host on or off, restart it, or restart it into a one-time PXE boot",
+	run: func(args []string) error {
+		if len(args) != 2 {
+			return usageError("bmc power <host> on|off|restart|pxe")
+		}
+		bmc, err := hostBMC(args[0])
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		switch args[1] {
+		case "on":
+			err = bmc.Reset(ctx, redfish.ResetOn)
+		case "off":
+			err = bmc.Reset(ctx, redfish.ResetForceOff)
+		case "restart":
+			err = bmc.Reset(ctx, redfish.ResetForceRestart)
+		case "pxe":
+			err = bmc.PXEBoot(ctx)
+		default:
+			return usageError("bmc power <host> on|off|restart|pxe")
+		}
+		return err
+	},
+}
+
+var bmcReinstallCmd = &command{
+	name: "reinstall",
+	args: "<host>",
+	help: "ask the running server to reinstall a host and PXE boot it; needs -api-token-file",
+	run: func(args []string) error {
+		if len(args) != 1 {
+			return usageError("bmc reinstall <host>")
+		}
+		c, err := srv.APIClient()
+		if err != nil {
+			return err
+		}
+		res, err := c.ReinstallHost(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		for _, m := range res.Machines {
+			fmt.Printf("%s\t%s\n", m.ID, m.State)
+		}
+		if res.PXEBooted {
+			fmt.Printf("%s\tPXE booted\n", args[0])
+		}
+		return nil
+	},
+}
+
+// hostBMC returns a Redfish client for the BMC of an inventory host.
+func hostBMC(name string) (*redfish.Client, error) {
+	inv, err := srv.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	defer srv.Close()
+	h, err := inv.Host(name)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", name, err)
+	}
+	if h.BMC == nil {
+		return nil, fmt.Errorf("host %s has no BMC", name)
+	}
+	backend, err := srv.Secrets()
+	if err != nil {
+		return nil, err
+	}
+	return h.BMC.Redfish(context.Background(), backend)
+}
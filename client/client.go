@@ -0,0 +1,285 @@
+// Package client is a typed Go client for the corepxe management API
+// (package api).
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nveeser/corepxe/api"
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/redfish"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the API of the corepxe server at BaseURL, e.g.
+// "https://pxe.example.com/", authenticating with Token.
+type Client struct {
+	BaseURL string
+	Token   string
+	// HTTPClient is used to make requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a Client for the server at baseURL.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+// Error is returned for API error responses.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("corepxe: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is an API error with status 404.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) Hosts(ctx context.Context) ([]*inventory.Host, error) {
+	var out []*inventory.Host
+	return out, c.do(ctx, "GET", "/hosts", nil, &out)
+}
+
+func (c *Client) Host(ctx context.Context, name string) (*inventory.Host, error) {
+	out := &inventory.Host{}
+	return out, c.do(ctx, "GET", "/hosts/"+url.PathEscape(name), nil, out)
+}
+
+// PutHost creates or replaces the host named h.Name.
+func (c *Client) PutHost(ctx context.Context, h *inventory.Host) (*inventory.Host, error) {
+	out := &inventory.Host{}
+	return out, c.do(ctx, "PUT", "/hosts/"+url.PathEscape(h.Name), h, out)
+}
+
+func (c *Client) DeleteHost(ctx context.Context, name string) error {
+	return c.do(ctx, "DELETE", "/hosts/"+url.PathEscape(name), nil, nil)
+}
+
+// ReinstallHost requests a reinstall of the machines of a host and PXE
+// boots it if it has a BMC.
+func (c *Client) ReinstallHost(ctx context.Context, name string) (*api.HostReinstall, error) {
+	out := &api.HostReinstall{}
+	return out, c.do(ctx, "POST", "/hosts/"+url.PathEscape(name)+"/reinstall", nil, out)
+}
+
+// RollbackHost pins the machines of a host to the config revision they
+// were installed with, and returns them.
+func (c *Client) RollbackHost(ctx context.Context, name string) ([]*lifecycle.Machine, error) {
+	var out []*lifecycle.Machine
+	return out, c.do(ctx, "POST", "/hosts/"+url.PathEscape(name)+"/rollback", nil, &out)
+}
+
+// HostPower returns the state of a host as reported by its BMC.
+func (c *Client) HostPower(ctx context.Context, name string) (*redfish.System, error) {
+	out := &redfish.System{}
+	return out, c.do(ctx, "GET", "/hosts/"+url.PathEscape(name)+"/power", nil, out)
+}
+
+// SetHostPower performs a power action ("on", "off", "restart" or
+// "pxe") on a host through its BMC.
+func (c *Client) SetHostPower(ctx context.Context, name, action string) (*redfish.System, error) {
+	out := &redfish.System{}
+	return out, c.do(ctx, "POST", "/hosts/"+url.PathEscape(name)+"/power", &api.PowerRequest{Action: action}, out)
+}
+
+func (c *Client) Groups(ctx context.Context) ([]*inventory.Group, error) {
+	var out []*inventory.Group
+	return out, c.do(ctx, "GET", "/groups", nil, &out)
+}
+
+func (c *Client) Group(ctx context.Context, name string) (*inventory.Group, error) {
+	out := &inventory.Group{}
+	return out, c.do(ctx, "GET", "/groups/"+url.PathEscape(name), nil, out)
+}
+
+// PutGroup creates or replaces the group named g.Name.
+func (c *Client) PutGroup(ctx context.Context, g *inventory.Group) (*inventory.Group, error) {
+	out := &inventory.Group{}
+	return out, c.do(ctx, "PUT", "/groups/"+url.PathEscape(g.Name), g, out)
+}
+
+func (c *Client) DeleteGroup(ctx context.Context, name string) error {
+	return c.do(ctx, "DELETE", "/groups/"+url.PathEscape(name), nil, nil)
+}
+
+// ReinstallGroup requests a reinstall of the installed machines of the
+// hosts in a group, and returns the machines that changed state.
+func (c *Client) ReinstallGroup(ctx context.Context, name string) ([]*lifecycle.Machine, error) {
+	var out []*lifecycle.Machine
+	return out, c.do(ctx, "POST", "/groups/"+url.PathEscape(name)+"/reinstall", nil, &out)
+}
+
+func (c *Client) Machines(ctx context.Context) ([]*lifecycle.Machine, error) {
+	var out []*lifecycle.Machine
+	return out, c.do(ctx, "GET", "/machines", nil, &out)
+}
+
+// Machine returns the machine with the given ID, MAC or UUID.
+func (c *Client) Machine(ctx context.Context, id string) (*lifecycle.Machine, error) {
+	out := &lifecycle.Machine{}
+	return out, c.do(ctx, "GET", "/machines/"+url.PathEscape(id), nil, out)
+}
+
+// Reinstall requests a reinstall of an installed machine, and returns it
+// if it changed state.
+func (c *Client) Reinstall(ctx context.Context, id string) ([]*lifecycle.Machine, error) {
+	var out []*lifecycle.Machine
+	return out, c.do(ctx, "POST", "/machines/"+url.PathEscape(id)+"/reinstall", nil, &out)
+}
+
+// PinRelease pins the CoreOS release a machine boots. An empty release
+// unpins it.
+func (c *Client) PinRelease(ctx context.Context, id, release string) (*lifecycle.Machine, error) {
+	out := &lifecycle.Machine{}
+	return out, c.do(ctx, "PUT", "/machines/"+url.PathEscape(id)+"/release", &api.PinRequest{Release: release}, out)
+}
+
+// PinConfig pins the config revision the Ignition config of a machine is
+// rendered from. An empty revision unpins it.
+func (c *Client) PinConfig(ctx context.Context, id, revision string) (*lifecycle.Machine, error) {
+	out := &lifecycle.Machine{}
+	return out, c.do(ctx, "PUT", "/machines/"+url.PathEscape(id)+"/config-revision", &api.ConfigPinRequest{Revision: revision}, out)
+}
+
+func (c *Client) Streams(ctx context.Context) ([]*api.Stream, error) {
+	var out []*api.Stream
+	return out, c.do(ctx, "GET", "/streams", nil, &out)
+}
+
+// RefreshStream makes the server fetch the named stream.
+func (c *Client) RefreshStream(ctx context.Context, name string) (*api.Stream, error) {
+	out := &api.Stream{}
+	return out, c.do(ctx, "POST", "/streams/"+url.PathEscape(name)+"/refresh", nil, out)
+}
+
+func (c *Client) Mirror(ctx context.Context) ([]*api.MirrorEntry, error) {
+	var out []*api.MirrorEntry
+	return out, c.do(ctx, "GET", "/mirror", nil, &out)
+}
+
+// Evict removes a file from the mirror. Files referenced by a current
+// stream are only removed with force.
+func (c *Client) Evict(ctx context.Context, path string, force bool) error {
+	p := "/mirror/" + path
+	if force {
+		p += "?force=true"
+	}
+	return c.do(ctx, "DELETE", p, nil, nil)
+}
+
+// RenderIPXE returns the script the iPXE template name produces for a
+// client with the given MAC address.
+func (c *Client) RenderIPXE(ctx context.Context, name, mac string) ([]byte, error) {
+	p := "/render/ipxe/" + url.PathEscape(name)
+	if mac != "" {
+		p += "?" + url.Values{"mac": {mac}}.Encode()
+	}
+	var out []byte
+	return out, c.do(ctx, "GET", p, nil, &out)
+}
+
+// RenderIgnition returns the Ignition config of a host or, with butane,
+// the merged Butane config it is translated from.
+func (c *Client) RenderIgnition(ctx context.Context, osname, host string, butane bool) ([]byte, error) {
+	p := "/render/ignition/" + url.PathEscape(osname) + "/" + url.PathEscape(host)
+	if butane {
+		p += "?butane=true"
+	}
+	var out []byte
+	return out, c.do(ctx, "GET", p, nil, &out)
+}
+
+// Validate renders the Ignition config of every host on the server and
+// returns its errors and warnings.
+func (c *Client) Validate(ctx context.Context) (*api.Validation, error) {
+	out := &api.Validation{}
+	return out, c.do(ctx, "GET", "/validate", nil, out)
+}
+
+// DiffIgnition returns how the Ignition config of each host differs
+// between the git revisions from and to of the server's config
+// directory; an empty to is the directory as it is.
+func (c *Client) DiffIgnition(ctx context.Context, from, to string) ([]ignition.HostDiff, error) {
+	q := url.Values{"from": {from}}
+	if to != "" {
+		q.Set("to", to)
+	}
+	var out []ignition.HostDiff
+	return out, c.do(ctx, "GET", "/diff?"+q.Encode(), nil, &out)
+}
+
+// ExportState writes a backup of the server's state store to w, in the
+// form read by store.Import.
+func (c *Client) ExportState(ctx context.Context, w io.Writer) error {
+	var out []byte
+	if err := c.do(ctx, "GET", "/state", nil, &out); err != nil {
+		return err
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// do sends a request to the API path p with in encoded as JSON, and
+// decodes the response into out. A *[]byte out receives the raw body.
+func (c *Client) do(ctx context.Context, method, p string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+api.Prefix+p, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &api.Error{}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = strings.TrimSpace(string(data))
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: apiErr.Error}
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = data
+		return nil
+	default:
+		return json.Unmarshal(data, out)
+	}
+}
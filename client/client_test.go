@@ -0,0 +1,324 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/nveeser/corepxe/api"
+	"github.com/nveeser/corepxe/coreos"
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/mirror"
+	"github.com/nveeser/corepxe/redfish"
+	"github.com/nveeser/corepxe/redfish/redfishtest"
+	"github.com/nveeser/corepxe/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	inv, err := inventory.Load(filepath.Join(t.TempDir(), "inventory.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(imageDir, "coreos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "coreos/old-kernel"), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracker := &lifecycle.Tracker{InstalledStage: lifecycle.StageIgnition}
+	as := &api.Server{
+		Inventory: inv,
+		Tracker:   tracker,
+		Streams:   &coreos.StreamCache{LocalDir: filepath.Join(imageDir, "coreos")},
+		Mirror:    &mirror.ImageMirror{RootDir: imageDir},
+		Ignition:  &ignition.Handler{ConfigRoot: "../ignition/testdir"},
+		RenderIPXE: func(w io.Writer, r *http.Request, name, mac string) error {
+			_, err := io.WriteString(w, name+" "+mac)
+			return err
+		},
+	}
+	ts := httptest.NewServer(as.Handler())
+	defer ts.Close()
+	c := New(ts.URL, "")
+	ctx := context.Background()
+
+	if _, err := c.PutGroup(ctx, &inventory.Group{Name: "workers", Vars: map[string]any{"role": "worker"}}); err != nil {
+		t.Fatalf("PutGroup() got err %s", err)
+	}
+	h, err := c.PutHost(ctx, &inventory.Host{Name: "node1", MACs: []string{"aa:bb:cc:dd:ee:ff"}, Groups: []string{"workers"}})
+	if err != nil {
+		t.Fatalf("PutHost() got err %s", err)
+	}
+	if h.Name != "node1" || len(h.Groups) != 1 {
+		t.Errorf("PutHost() got %+v", h)
+	}
+	if _, err := c.PutHost(ctx, &inventory.Host{Name: "node2", Groups: []string{"nope"}}); err == nil {
+		t.Errorf("PutHost(unknown group) got nil err")
+	}
+	if hosts, err := c.Hosts(ctx); err != nil || len(hosts) != 1 {
+		t.Errorf("Hosts() got %v, %v", hosts, err)
+	}
+	if err := c.DeleteGroup(ctx, "workers"); err == nil {
+		t.Errorf("DeleteGroup(in use) got nil err")
+	}
+	if _, err := c.Host(ctx, "node2"); !IsNotFound(err) {
+		t.Errorf("Host(node2) got err %v wanted not found", err)
+	}
+
+	for _, stage := range []lifecycle.Stage{lifecycle.StageIPXE, lifecycle.StageIgnition} {
+		if err := tracker.Record(lifecycle.Identity{MAC: "aa:bb:cc:dd:ee:ff"}, lifecycle.Event{Stage: stage, Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changed, err := c.ReinstallGroup(ctx, "workers")
+	if err != nil || len(changed) != 1 || changed[0].State != lifecycle.StateReinstall {
+		t.Errorf("ReinstallGroup() got %v, %v", changed, err)
+	}
+	// No stream is cached and nothing is mirrored (see TestPinRelease).
+	if _, err := c.PinRelease(ctx, "aa:bb:cc:dd:ee:ff", "40.20240728.3.0"); err == nil || err.(*Error).StatusCode != http.StatusBadRequest {
+		t.Errorf("PinRelease(uncached) got err %v wanted 400", err)
+	}
+	if _, err := c.Machine(ctx, "00:00:00:00:00:01"); !IsNotFound(err) {
+		t.Errorf("Machine(unknown) got err %v wanted not found", err)
+	}
+
+	streams, err := c.Streams(ctx)
+	if err != nil || len(streams) != len(coreos.StreamNames) || streams[0].Loaded {
+		t.Errorf("Streams() got %v, %v", streams, err)
+	}
+	entries, err := c.Mirror(ctx)
+	if err != nil || len(entries) != 1 || entries[0].Path != "coreos/old-kernel" || entries[0].Current {
+		t.Fatalf("Mirror() got %v, %v", entries, err)
+	}
+	if err := c.Evict(ctx, "coreos/old-kernel", false); err != nil {
+		t.Errorf("Evict() got err %s", err)
+	}
+	if err := c.Evict(ctx, "coreos/old-kernel", false); !IsNotFound(err) {
+		t.Errorf("second Evict() got err %v wanted not found", err)
+	}
+
+	script, err := c.RenderIPXE(ctx, "boot", "aa:bb:cc:dd:ee:ff")
+	if err != nil || string(script) != "boot aa:bb:cc:dd:ee:ff" {
+		t.Errorf("RenderIPXE() got %q, %v", script, err)
+	}
+	butane, err := c.RenderIgnition(ctx, "coreos", "standard", true)
+	if err != nil || !strings.Contains(string(butane), "variant: fcos") {
+		t.Errorf("RenderIgnition(butane) got %q, %v", butane, err)
+	}
+	if _, err := c.RenderIgnition(ctx, "coreos", "missing", false); !IsNotFound(err) {
+		t.Errorf("RenderIgnition(missing) got err %v wanted not found", err)
+	}
+	if v, err := c.Validate(ctx); err != nil || !v.OK {
+		t.Errorf("Validate() got %+v, %v", v, err)
+	}
+}
+
+func TestReinstallHost(t *testing.T) {
+	bmc := redfishtest.NewServer("admin", "secret")
+	defer bmc.Close()
+	inv, err := inventory.Load(filepath.Join(t.TempDir(), "inventory.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &lifecycle.Tracker{InstalledStage: lifecycle.StageIgnition}
+	ts := httptest.NewServer((&api.Server{Inventory: inv, Tracker: tracker}).Handler())
+	defer ts.Close()
+	c := New(ts.URL, "")
+	ctx := context.Background()
+
+	if _, err := c.PutHost(ctx, &inventory.Host{Name: "node1", MACs: []string{"aa:bb:cc:dd:ee:ff"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.HostPower(ctx, "node1"); err == nil || err.(*Error).StatusCode != http.StatusConflict {
+		t.Errorf("HostPower(no BMC) got err %v wanted 409", err)
+	}
+	bmcConfig := &inventory.BMC{Endpoint: bmc.URL, Username: "admin", Password: "secret"}
+	if _, err := c.PutHost(ctx, &inventory.Host{Name: "node1", MACs: []string{"aa:bb:cc:dd:ee:ff"}, BMC: bmcConfig}); err != nil {
+		t.Fatal(err)
+	}
+	// The BMC password is never returned, and putting a host back as read
+	// keeps it.
+	h, err := c.Host(ctx, "node1")
+	if err != nil || h.BMC == nil || h.BMC.Password != "" {
+		t.Fatalf("Host() got %+v, %v wanted BMC without password", h, err)
+	}
+	if _, err := c.PutHost(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range []lifecycle.Stage{lifecycle.StageIPXE, lifecycle.StageIgnition} {
+		if err := tracker.Record(lifecycle.Identity{MAC: "aa:bb:cc:dd:ee:ff"}, lifecycle.Event{Stage: stage, Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := c.ReinstallHost(ctx, "node1")
+	if err != nil {
+		t.Fatalf("ReinstallHost() got err %s", err)
+	}
+	if !res.PXEBooted || len(res.Machines) != 1 || res.Machines[0].State != lifecycle.StateReinstall {
+		t.Errorf("ReinstallHost() got %+v", res)
+	}
+	if boots := bmc.Boots(); len(boots) != 1 || boots[0] != redfish.BootPXE {
+		t.Errorf("host booted %v wanted [%s]", boots, redfish.BootPXE)
+	}
+
+	sys, err := c.SetHostPower(ctx, "node1", "off")
+	if err != nil || sys.PowerState != redfish.PowerOff {
+		t.Errorf("SetHostPower(off) got %+v, %v", sys, err)
+	}
+	if _, err := c.SetHostPower(ctx, "node1", "reboot"); err == nil || err.(*Error).StatusCode != http.StatusBadRequest {
+		t.Errorf("SetHostPower(reboot) got err %v wanted 400", err)
+	}
+	if sys, err := c.HostPower(ctx, "node1"); err != nil || sys.PowerState != redfish.PowerOff {
+		t.Errorf("HostPower() got %+v, %v", sys, err)
+	}
+
+	// A failing BMC is reported, after the reinstall was requested.
+	bmcConfig.Password = "wrong"
+	if _, err := c.PutHost(ctx, &inventory.Host{Name: "node1", MACs: []string{"aa:bb:cc:dd:ee:ff"}, BMC: bmcConfig}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReinstallHost(ctx, "node1"); err == nil || err.(*Error).StatusCode != http.StatusBadGateway {
+		t.Errorf("ReinstallHost(wrong password) got err %v wanted 502", err)
+	}
+}
+
+func TestRollbackHost(t *testing.T) {
+	inv, err := inventory.Load(filepath.Join(t.TempDir(), "inventory.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &lifecycle.Tracker{InstalledStage: lifecycle.StageIgnition}
+	ts := httptest.NewServer((&api.Server{
+		Inventory: inv,
+		Tracker:   tracker,
+		ResolveConfigRevision: func(ctx context.Context, rev string) (string, error) {
+			if rev != "HEAD~1" {
+				return "", fmt.Errorf("unknown revision %s", rev)
+			}
+			return "1111111", nil
+		},
+	}).Handler())
+	defer ts.Close()
+	c := New(ts.URL, "")
+	ctx := context.Background()
+
+	if _, err := c.PutHost(ctx, &inventory.Host{Name: "node1", MACs: []string{"aa:bb:cc:dd:ee:ff"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Record(lifecycle.Identity{MAC: "aa:bb:cc:dd:ee:ff"}, lifecycle.Event{Stage: lifecycle.StageIPXE, Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RollbackHost(ctx, "node1"); err == nil || err.(*Error).StatusCode != http.StatusConflict {
+		t.Errorf("RollbackHost(no revision) got err %v wanted 409", err)
+	}
+	if err := tracker.Record(lifecycle.Identity{MAC: "aa:bb:cc:dd:ee:ff"}, lifecycle.Event{Stage: lifecycle.StageIgnition, Status: 200, Detail: "coreos/node1", Revision: "2222222"}); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := c.RollbackHost(ctx, "node1")
+	if err != nil || len(ms) != 1 || ms[0].ConfigPin != "2222222" {
+		t.Errorf("RollbackHost() got %v, %v", ms, err)
+	}
+
+	m, err := c.PinConfig(ctx, "aa:bb:cc:dd:ee:ff", "HEAD~1")
+	if err != nil || m.ConfigPin != "1111111" {
+		t.Errorf("PinConfig(HEAD~1) got %+v, %v", m, err)
+	}
+	if _, err := c.PinConfig(ctx, "aa:bb:cc:dd:ee:ff", "nope"); err == nil || err.(*Error).StatusCode != http.StatusBadRequest {
+		t.Errorf("PinConfig(nope) got err %v wanted 400", err)
+	}
+	if m, err := c.PinConfig(ctx, "aa:bb:cc:dd:ee:ff", ""); err != nil || m.ConfigPin != "" {
+		t.Errorf("PinConfig(\"\") got %+v, %v", m, err)
+	}
+}
+
+func TestExportStateRedacted(t *testing.T) {
+	state := store.NewMemory()
+	inv, err := inventory.Open(state, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer((&api.Server{Inventory: inv, State: state}).Handler())
+	defer ts.Close()
+	c := New(ts.URL, "")
+	ctx := context.Background()
+
+	bmc := &inventory.BMC{Endpoint: "https://bmc", Username: "admin", Password: "s3cret-password"}
+	if _, err := c.PutHost(ctx, &inventory.Host{Name: "node1", MACs: []string{"aa:bb:cc:dd:ee:ff"}, BMC: bmc}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := c.ExportState(ctx, &buf); err != nil {
+		t.Fatalf("ExportState() got err %s", err)
+	}
+	if strings.Contains(buf.String(), "s3cret-password") {
+		t.Errorf("ExportState() got the BMC password:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "https://bmc") {
+		t.Errorf("ExportState() got no BMC endpoint:\n%s", buf.String())
+	}
+}
+
+func TestPinRelease(t *testing.T) {
+	imageDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(imageDir, "coreos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stable, err := os.ReadFile("../coreos/testdata/stable.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "coreos", "stable.json"), stable, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only the images of an older release are mirrored.
+	for _, name := range []string{
+		"fedora-coreos-39.20240701.3.0-live-kernel-x86_64",
+		"fedora-coreos-39.20240701.3.0-live-initramfs.x86_64.img",
+		"fedora-coreos-39.20240701.3.0-live-rootfs.x86_64.img",
+	} {
+		if err := os.WriteFile(filepath.Join(imageDir, "coreos", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker := &lifecycle.Tracker{}
+	if err := tracker.Record(lifecycle.Identity{MAC: "aa:bb:cc:dd:ee:ff"}, lifecycle.Event{Stage: lifecycle.StageIPXE, Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	as := &api.Server{
+		Tracker: tracker,
+		Streams: &coreos.StreamCache{LocalDir: filepath.Join(imageDir, "coreos")},
+		Mirror:  &mirror.ImageMirror{RootDir: imageDir},
+	}
+	ts := httptest.NewServer(as.Handler())
+	defer ts.Close()
+	c := New(ts.URL, "")
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		release string
+		want    int
+	}{
+		{"40.20240728.3.0", http.StatusOK},
+		{"39.20240701.3.0", http.StatusOK},
+		{"38.20230101.3.0", http.StatusBadRequest},
+		{"", http.StatusOK},
+	} {
+		m, err := c.PinRelease(ctx, "aa:bb:cc:dd:ee:ff", tc.release)
+		switch {
+		case tc.want == http.StatusOK && (err != nil || m.Release != tc.release):
+			t.Errorf("PinRelease(%q) got %+v, %v", tc.release, m, err)
+		case tc.want != http.StatusOK && (err == nil || err.(*Error).StatusCode != tc.want):
+			t.Errorf("PinRelease(%q) got err %v wanted %d", tc.release, err, tc.want)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package coreos
 
 import (
 	"fmt"
-	"github.com/coreos/stream-metadata-go/fedoracoreos"
 	"github.com/coreos/stream-metadata-go/stream"
+	"github.com/nveeser/corepxe/accesslog"
 	"github.com/nveeser/corepxe/mirror"
-	"log"
+	"log/slog"
 	"net/http"
+	"path"
+	"path/filepath"
 )
 
 type ImageHandler struct {
@@ -17,30 +19,29 @@ type ImageHandler struct {
 }
 
 func (h *ImageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for k, v := range r.Header {
-		log.Printf("iPXE Header: %s => %q", k, v)
+	if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+		for k, v := range r.Header {
+			slog.Debug("iPXE header", "key", k, "value", v)
+		}
 	}
-	artifact, err := resolveCoreos(r)
+	artifact, err := h.resolve(r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Invalid Request: %s\n", err), http.StatusBadRequest)
 		return
 	}
 
-	name, err := artifact.Name()
+	a, err := NewAsset(r.PathValue("filetype"), artifact)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Invalid Finding artifact name: %s\n", err), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("[Image] %s -> %s", r.URL.String(), name)
-	a := &coreosAsset{
-		path:     name,
-		artifact: artifact,
-	}
+	slog.Debug("Image resolved", "url", r.URL.String(), "artifact", a.RelativePath())
+	accesslog.Annotate(r.Context(), slog.String("artifact", a.RelativePath()))
 	h.ImageMirror.ServeAsset(w, r, a)
 	return
 }
 
-func resolveCoreos(r *http.Request) (artifact *stream.Artifact, err error) {
+func (h *ImageHandler) resolve(r *http.Request) (artifact *stream.Artifact, err error) {
 	q := r.URL.Query()
 	param := func(k string) (string, error) {
 		v, ok := q.Get(k), q.Has(k)
@@ -58,49 +59,58 @@ func resolveCoreos(r *http.Request) (artifact *stream.Artifact, err error) {
 	if err != nil {
 		return nil, err
 	}
-	streamInfo, err := fedoracoreos.FetchStream(streamName)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching coreos info: %w", err)
-	}
-
-	a, err := param("arch")
+	arch, err := param("arch")
 	if err != nil {
 		return nil, err
 	}
-	arch, ok := streamInfo.Architectures[a]
-	if !ok {
-		return nil, fmt.Errorf("invalid architecture: %s", a)
+	release, _ := h.Streams.Release(streamName, arch)
+	artifacts, err := h.Streams.PXEArtifacts(streamName, arch)
+	if pinned := r.PathValue("release"); pinned != "" {
+		release = pinned
+		artifacts, err = h.Streams.ReleaseArtifacts(streamName, arch, pinned)
 	}
-	art, ok := arch.Artifacts["metal"]
-	if !ok {
-		return nil, fmt.Errorf("invalid artifact: metal")
+	if err != nil {
+		return nil, err
 	}
-	format, ok := art.Formats["pxe"]
+	accesslog.Annotate(r.Context(),
+		slog.String("stream", streamName),
+		slog.String("arch", arch),
+		slog.String("release", release))
+	artifact, ok := artifacts[r.PathValue("filetype")]
 	if !ok {
-		return nil, fmt.Errorf("invalid format: pxe")
-	}
-
-	switch r.PathValue("filetype") {
-	case "kernel":
-		artifact = format.Kernel
-	case "rootfs":
-		artifact = format.Rootfs
-	case "initrd":
-		artifact = format.Initramfs
-	default:
 		return nil, fmt.Errorf("invalid path type: %s", r.PathValue("filetype"))
 	}
 	return artifact, nil
 }
 
+// NewAsset returns the mirror.ImageAsset for a CoreOS artifact of the
+// given filetype (see FileTypes). Assets are stored under "coreos/"
+// relative to the root of the mirror.
+func NewAsset(filetype string, artifact *stream.Artifact) (mirror.ImageAsset, error) {
+	name, err := artifact.Name()
+	if err != nil {
+		return nil, err
+	}
+	return &coreosAsset{
+		path:     path.Join("coreos", name),
+		filetype: filetype,
+		artifact: artifact,
+	}, nil
+}
+
 type coreosAsset struct {
 	path     string
+	filetype string
 	artifact *stream.Artifact
 }
 
 func (a *coreosAsset) RelativePath() string { return a.path }
+func (a *coreosAsset) Kind() string         { return a.filetype }
 func (a *coreosAsset) Download(dir string) error {
-	_, err := a.artifact.Download(dir)
+	if a.artifact.Sha256 == "" {
+		return fmt.Errorf("%s is not mirrored and has no known checksum", a.path)
+	}
+	_, err := a.artifact.Download(filepath.Join(dir, filepath.Dir(a.path)))
 	return err
 }
 
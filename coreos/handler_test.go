@@ -11,9 +11,9 @@ import (
 // TODO test query params / defaults
 
 func TestImageHandler(t *testing.T) {
-	var gotPath string
+	var gotPath, gotKind string
 	mf := mirrorFunc(func(w http.ResponseWriter, r *http.Request, asset mirror.ImageAsset) {
-		gotPath = asset.RelativePath()
+		gotPath, gotKind = asset.RelativePath(), asset.Kind()
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -60,6 +60,9 @@ func TestImageHandler(t *testing.T) {
 			if gotPath != tc.want {
 				t.Errorf("Path \n\t   got %s \n\twanted %s", gotPath, tc.want)
 			}
+			if gotKind != tc.name {
+				t.Errorf("Kind() got %s wanted %s", gotKind, tc.name)
+			}
 		})
 	}
 }
@@ -6,30 +6,63 @@ import (
 	"fmt"
 	"github.com/coreos/stream-metadata-go/fedoracoreos"
 	"github.com/coreos/stream-metadata-go/stream"
-	"log"
+	"github.com/nveeser/corepxe/metrics"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // StreamCache maintains a local copy of the Stream JSON info
 // fetched from Fedora.
 type StreamCache struct {
 	LocalDir string
-	m        map[string]*stream.Stream
-	mu       sync.Mutex
+	// MaxAge, when set, is how long Get serves a copy of a stream before
+	// fetching it again. The old copy is still served when the fetch
+	// fails. Zero means a copy is kept until Refresh.
+	MaxAge time.Duration
+
+	m map[string]*stream.Stream
+	// fetched holds when each stream in m was fetched, or last tried.
+	fetched map[string]time.Time
+	mu      sync.Mutex
+	// fetch fetches a stream from Fedora; nil means fetchStream.
+	fetch func(name string) (*stream.Stream, error)
 }
 
+// DefaultMaxAge is the StreamCache.MaxAge the server uses by default.
+const DefaultMaxAge = time.Hour
+
 func (c *StreamCache) init() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.m == nil {
 		c.m = make(map[string]*stream.Stream)
+		c.fetched = make(map[string]time.Time)
 	}
 }
 
+// validStream returns an error unless name is one of StreamNames.
+func validStream(name string) error {
+	for _, n := range StreamNames {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid stream: %s", name)
+}
+
+// StreamNames lists the Fedora CoreOS streams known to the cache.
+var StreamNames = []string{fedoracoreos.StreamStable, fedoracoreos.StreamTesting, fedoracoreos.StreamNext}
+
+// FileTypes lists the PXE artifacts served for each stream, by the
+// filetype used in the image URL.
+var FileTypes = []string{"kernel", "initrd", "rootfs"}
+
 func (c *StreamCache) LoadAll() error {
-	for _, name := range []string{fedoracoreos.StreamStable, fedoracoreos.StreamTesting, fedoracoreos.StreamNext} {
+	for _, name := range StreamNames {
 		if _, err := c.Get(name); err != nil {
 			return err
 		}
@@ -41,42 +74,287 @@ func (c *StreamCache) Put(s *stream.Stream) {
 	c.init()
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.m[s.Stream] = s
+	c.store(s)
+	c.fetched[s.Stream] = time.Now()
 }
 
+// Get returns the named stream from memory, then disk, then Fedora. A
+// copy older than MaxAge is fetched again.
 func (c *StreamCache) Get(name string) (*stream.Stream, error) {
+	if err := validStream(name); err != nil {
+		return nil, err
+	}
 	c.init()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if s, ok := c.m[name]; ok {
-		log.Printf("CoreOS Stream[%s] Read from memory", name)
+	s, ok := c.m[name]
+	if ok {
+		slog.Debug("CoreOS stream read from memory", "stream", name)
+	} else {
+		var err error
+		s, err = c.readFile(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			slog.Info("CoreOS stream read from file", "stream", name)
+			c.store(s)
+			if info, err := os.Stat(c.path(name)); err == nil {
+				c.fetched[name] = info.ModTime()
+			}
+		}
+	}
+	if s != nil && (c.MaxAge == 0 || time.Since(c.fetched[name]) < c.MaxAge) {
 		return s, nil
 	}
-	s, err := c.readFile(name)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	fresh, err := c.fetchLocked(name)
+	if err != nil {
+		if s == nil {
+			return nil, err
+		}
+		slog.Warn("Serving stale CoreOS stream", "stream", name, "err", err)
+		c.fetched[name] = time.Now()
+		return s, nil
+	}
+	return fresh, nil
+}
+
+// Refresh fetches the named stream from Fedora, replacing any copy held
+// in memory or on disk.
+func (c *StreamCache) Refresh(name string) (*stream.Stream, error) {
+	if err := validStream(name); err != nil {
 		return nil, err
 	}
-	if err == nil {
-		log.Printf("CoreOS Stream[%s] Read from File", name)
-		c.m[name] = s
-		return s, nil
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetchLocked(name)
+}
+
+// fetchLocked fetches the named stream and keeps it in memory and on
+// disk. c.mu must be held.
+func (c *StreamCache) fetchLocked(name string) (*stream.Stream, error) {
+	fetch := c.fetch
+	if fetch == nil {
+		fetch = fetchStream
 	}
-	log.Printf("CoreOS Stream[%s] Fetch from URL", name)
-	s, err = fedoracoreos.FetchStream(name)
+	s, err := fetch(name)
 	if err != nil {
-		return nil, fmt.Errorf("rrror fetching stream %s: %w", name, err)
+		return nil, err
 	}
 	if err := c.writeFile(s); err != nil {
-		log.Printf("Error writing stream: %s", err)
+		slog.Warn("Error writing stream", "stream", name, "err", err)
+	}
+	c.store(s)
+	c.fetched[name] = time.Now()
+	return s, nil
+}
+
+// PXEArtifacts returns the metal PXE artifacts of the named stream for
+// arch, keyed by filetype (see FileTypes).
+func (c *StreamCache) PXEArtifacts(name, arch string) (map[string]*stream.Artifact, error) {
+	s, err := c.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := s.Architectures[arch]
+	if !ok {
+		return nil, fmt.Errorf("invalid architecture: %s", arch)
+	}
+	art, ok := a.Artifacts["metal"]
+	if !ok {
+		return nil, fmt.Errorf("invalid artifact: metal")
+	}
+	format, ok := art.Formats["pxe"]
+	if !ok {
+		return nil, fmt.Errorf("invalid format: pxe")
+	}
+	artifacts := map[string]*stream.Artifact{
+		"kernel": format.Kernel,
+		"initrd": format.Initramfs,
+		"rootfs": format.Rootfs,
+	}
+	for k, v := range artifacts {
+		if v == nil {
+			delete(artifacts, k)
+		}
+	}
+	return artifacts, nil
+}
+
+// ReleaseArtifacts returns the metal PXE artifacts of an older (or
+// newer) release of the named stream. Stream metadata only describes the
+// current release, so they are derived from the current artifacts by
+// substituting the release in their location. Their checksums are not
+// known, so they can be served from the mirror but not downloaded.
+func (c *StreamCache) ReleaseArtifacts(name, arch, release string) (map[string]*stream.Artifact, error) {
+	artifacts, err := c.PXEArtifacts(name, arch)
+	if err != nil {
+		return nil, err
+	}
+	current, err := c.Release(name, arch)
+	if err != nil {
+		return nil, err
+	}
+	if release == current {
+		return artifacts, nil
+	}
+	if current == "" || strings.ContainsAny(release, "/\\") {
+		return nil, fmt.Errorf("invalid release: %s", release)
+	}
+	for k, a := range artifacts {
+		artifacts[k] = &stream.Artifact{
+			Location: strings.ReplaceAll(a.Location, current, release),
+		}
+	}
+	return artifacts, nil
+}
+
+// Release returns the metal release of the named stream for arch.
+func (c *StreamCache) Release(name, arch string) (string, error) {
+	s, err := c.Get(name)
+	if err != nil {
+		return "", err
+	}
+	a, ok := s.Architectures[arch]
+	if !ok {
+		return "", fmt.Errorf("invalid architecture: %s", arch)
+	}
+	art, ok := a.Artifacts["metal"]
+	if !ok {
+		return "", fmt.Errorf("invalid artifact: metal")
+	}
+	return art.Release, nil
+}
+
+// Referenced returns the relative paths of every PXE asset named by the
+// streams in the cache, for all architectures. Streams that are not in
+// memory or on disk are skipped rather than fetched.
+func (c *StreamCache) Referenced() (map[string]bool, error) {
+	sums, err := c.Checksums()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]bool)
+	for p := range sums {
+		refs[p] = true
+	}
+	return refs, nil
+}
+
+// Checksums returns the SHA-256 of every PXE asset named by the streams in
+// the cache, keyed by relative path as in Referenced.
+func (c *StreamCache) Checksums() (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, name := range StreamNames {
+		s, err := c.Cached(name)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			continue
+		}
+		for arch := range s.Architectures {
+			artifacts, err := c.PXEArtifacts(name, arch)
+			if err != nil {
+				continue
+			}
+			for ft, artifact := range artifacts {
+				a, err := NewAsset(ft, artifact)
+				if err != nil {
+					return nil, err
+				}
+				sums[a.RelativePath()] = artifact.Sha256
+			}
+		}
+	}
+	return sums, nil
+}
+
+// Refreshed returns when the named stream was last written to disk, or
+// the zero time if it never was.
+func (c *StreamCache) Refreshed(name string) (time.Time, error) {
+	if err := validStream(name); err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(c.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
 	}
-	c.m[name] = s
+	return info.ModTime(), nil
+}
+
+// Loaded returns the names of the streams available without going to the
+// network, loading them from disk if needed.
+func (c *StreamCache) Loaded() ([]string, error) {
+	var names []string
+	for _, name := range StreamNames {
+		s, err := c.Cached(name)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Cached returns the named stream from memory or disk, or nil if there is
+// no local copy.
+func (c *StreamCache) Cached(name string) (*stream.Stream, error) {
+	if err := validStream(name); err != nil {
+		return nil, err
+	}
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.m[name]; ok {
+		return s, nil
+	}
+	s, err := c.readFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.store(s)
 	return s, nil
 }
 
+// store adds s to the cache. c.mu must be held.
+func (c *StreamCache) store(s *stream.Stream) {
+	c.m[s.Stream] = s
+	metrics.StreamLoaded.WithLabelValues(s.Stream).SetToCurrentTime()
+	if t, err := time.Parse(time.RFC3339, s.Metadata.LastModified); err == nil {
+		metrics.StreamLastModified.WithLabelValues(s.Stream).Set(float64(t.Unix()))
+	}
+}
+
+func fetchStream(name string) (*stream.Stream, error) {
+	slog.Info("CoreOS stream fetch from URL", "stream", name)
+	start := time.Now()
+	s, err := fedoracoreos.FetchStream(name)
+	metrics.UpstreamDuration.WithLabelValues("stream").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues("stream").Inc()
+		return nil, fmt.Errorf("error fetching stream %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// path returns the file holding the local copy of the named stream.
+func (c *StreamCache) path(name string) string {
+	return filepath.Join(c.LocalDir, name+".json")
+}
+
 func (c *StreamCache) readFile(name string) (*stream.Stream, error) {
-	localFile := filepath.Join(c.LocalDir, name+".json")
-	body, err := os.ReadFile(localFile)
+	body, err := os.ReadFile(c.path(name))
 	if err != nil {
 		return nil, err
 	}
@@ -94,6 +372,8 @@ func (c *StreamCache) writeFile(s *stream.Stream) error {
 	if err != nil {
 		return err
 	}
-	localFile := filepath.Join(c.LocalDir, s.Stream+".json")
-	return os.WriteFile(localFile, body, 0664)
+	if err := os.MkdirAll(c.LocalDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(s.Stream), body, 0664)
 }
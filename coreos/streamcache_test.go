@@ -1,6 +1,13 @@
 package coreos
 
-import "testing"
+import (
+	"errors"
+	"github.com/coreos/stream-metadata-go/stream"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestStreamCache(t *testing.T) {
 	scache := &StreamCache{
@@ -10,4 +17,58 @@ func TestStreamCache(t *testing.T) {
 	if err != nil {
 		t.Errorf("Get got err %q wanted nil", err)
 	}
+	for _, name := range []string{"../stable", "nope"} {
+		if _, err := scache.Get(name); err == nil {
+			t.Errorf("Get(%q) got nil err", name)
+		}
+	}
+}
+
+func TestStreamCacheMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile("testdata/stable.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "stable.json")
+	if err := os.WriteFile(local, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(local, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int
+	var fetchErr error
+	c := &StreamCache{
+		LocalDir: dir,
+		MaxAge:   time.Hour,
+		fetch: func(name string) (*stream.Stream, error) {
+			fetches++
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+			return &stream.Stream{Stream: name, Metadata: stream.Metadata{LastModified: "fresh"}}, nil
+		},
+	}
+	s, err := c.Get("stable")
+	if err != nil || s.Metadata.LastModified != "fresh" || fetches != 1 {
+		t.Fatalf("Get() of a stale copy got %v, %v after %d fetches wanted a fresh one", s, err, fetches)
+	}
+	if _, err := c.Get("stable"); err != nil || fetches != 1 {
+		t.Errorf("Get() within MaxAge got err %v after %d fetches wanted 1", err, fetches)
+	}
+
+	c.fetched["stable"] = old
+	fetchErr = errors.New("offline")
+	if s, err := c.Get("stable"); err != nil || s.Metadata.LastModified != "fresh" || fetches != 2 {
+		t.Errorf("Get() with a failing fetch got %v, %v after %d fetches wanted the stale copy", s, err, fetches)
+	}
+	if _, err := c.Get("stable"); err != nil || fetches != 2 {
+		t.Errorf("Get() after a failed fetch got err %v after %d fetches wanted no retry within MaxAge", err, fetches)
+	}
+	if _, err := c.Get("testing"); err == nil {
+		t.Errorf("Get() without a copy and a failing fetch got nil err")
+	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/nveeser/corepxe/ignition"
+	"os"
+)
+
+var diffJSON bool
+
+var diffCmd = &command{
+	name: "diff",
+	args: "<from> [<to>]",
+	help: "show how the Ignition config of each host differs between two config directories or git revisions of the config directory; <to> defaults to the config directory as it is",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&diffJSON, "json", false, "print the differences as JSON")
+	},
+	run: func(args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return usageError("diff <from> [<to>]")
+		}
+		args = append(args, "")
+		diffs, err := srv.DiffIgnition(context.Background(), args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if diffJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if diffs == nil {
+				diffs = []ignition.HostDiff{}
+			}
+			return enc.Encode(diffs)
+		}
+		if len(diffs) == 0 {
+			fmt.Println("no changes")
+		}
+		for _, d := range diffs {
+			if d.Error != "" {
+				fmt.Printf("%s %s/%s: %s\n", d.Status, d.OS, d.Host, d.Error)
+				continue
+			}
+			fmt.Printf("%s %s/%s\n", d.Status, d.OS, d.Host)
+			for _, c := range d.Changes {
+				fmt.Printf("  %s\n", c)
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,206 @@
+// Package discovery records machines that PXE boot without being in the
+// inventory. They boot a live image that reports their hardware, and wait
+// as pending machines until an operator approves them into the inventory.
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/store"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("discovered machine not found")
+
+// ErrInvalidMAC is returned for a malformed MAC address.
+var ErrInvalidMAC = errors.New("invalid MAC address")
+
+// DefaultMaxMachines is used when Store.MaxMachines is zero.
+const DefaultMaxMachines = 1000
+
+// Disk is a block device reported by a discovered machine.
+type Disk struct {
+	Path string `json:"path"` // /dev/disk/by-path name
+	Size int64  `json:"size"` // bytes
+}
+
+// Facts is the hardware reported by a discovered machine.
+type Facts struct {
+	CPUModel string   `json:"cpuModel,omitempty"`
+	CPUCount int      `json:"cpuCount,omitempty"`
+	MemoryKB int64    `json:"memoryKB,omitempty"`
+	Disks    []Disk   `json:"disks,omitempty"`
+	MACs     []string `json:"macs,omitempty"`
+	Serial   string   `json:"serial,omitempty"`
+	Vendor   string   `json:"vendor,omitempty"`
+	Product  string   `json:"product,omitempty"`
+}
+
+// Machine is a pending machine, keyed by the MAC address it PXE booted
+// with.
+type Machine struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// Reported is when the machine last reported Facts.
+	Reported time.Time `json:"reported,omitempty"`
+	Facts    *Facts    `json:"facts,omitempty"`
+}
+
+// Bucket is the store bucket holding pending machines, keyed by MAC.
+const Bucket = "discovery"
+
+// Store keeps pending machines in a store.Repository. It is safe for
+// concurrent use.
+type Store struct {
+	// Repo holds the machines; nil means they are kept in memory.
+	Repo store.Repository
+	// MaxMachines bounds the pending machines kept. A new machine past
+	// it replaces the least recently seen one.
+	MaxMachines int
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+// Seen records that the machine with mac asked for a boot script.
+func (s *Store) Seen(mac, ip string) (*Machine, error) {
+	return s.update(mac, true, func(m *Machine, now time.Time) {
+		m.IP = ip
+	})
+}
+
+// Report records the hardware facts of the machine with mac, which must
+// have been Seen.
+func (s *Store) Report(mac, ip string, f *Facts) (*Machine, error) {
+	return s.update(mac, false, func(m *Machine, now time.Time) {
+		m.IP = ip
+		m.Reported = now
+		m.Facts = f
+	})
+}
+
+// Machine returns the pending machine with mac.
+func (s *Store) Machine(mac string) (*Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(inventory.NormalizeMAC(mac))
+}
+
+// Machines returns every pending machine, most recently seen first.
+func (s *Store) Machines() ([]*Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var machines []*Machine
+	err := s.repo().ForEach(Bucket, func(key string, value []byte) error {
+		m := &Machine{}
+		if err := json.Unmarshal(value, m); err != nil {
+			return fmt.Errorf("error reading discovered machine %s: %w", key, err)
+		}
+		machines = append(machines, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].LastSeen.After(machines[j].LastSeen)
+	})
+	return machines, nil
+}
+
+// Remove forgets the pending machine with mac.
+func (s *Store) Remove(mac string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.repo().Delete(Bucket, inventory.NormalizeMAC(mac))
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("%s: %w", mac, ErrNotFound)
+	}
+	return err
+}
+
+// update calls fn on the machine with mac and saves it, creating the
+// machine first when create is set.
+func (s *Store) update(mac string, create bool, fn func(m *Machine, now time.Time)) (*Machine, error) {
+	if !inventory.ValidMAC(mac) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMAC, mac)
+	}
+	mac = inventory.NormalizeMAC(mac)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	m, err := s.load(mac)
+	if errors.Is(err, ErrNotFound) && create {
+		if err := s.makeRoom(); err != nil {
+			return nil, err
+		}
+		m, err = &Machine{MAC: mac, FirstSeen: now}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.LastSeen = now
+	fn(m, now)
+	return m, store.PutJSON(s.repo(), Bucket, m.MAC, m)
+}
+
+// makeRoom forgets the least recently seen machine when s holds
+// MaxMachines. s.mu must be held.
+func (s *Store) makeRoom() error {
+	max := s.MaxMachines
+	if max == 0 {
+		max = DefaultMaxMachines
+	}
+	var n int
+	var oldest Machine
+	err := s.repo().ForEach(Bucket, func(key string, value []byte) error {
+		var m Machine
+		if err := json.Unmarshal(value, &m); err != nil {
+			return fmt.Errorf("error reading discovered machine %s: %w", key, err)
+		}
+		if n == 0 || m.LastSeen.Before(oldest.LastSeen) {
+			oldest = m
+		}
+		n++
+		return nil
+	})
+	if err != nil || n < max {
+		return err
+	}
+	if err := s.repo().Delete(Bucket, oldest.MAC); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	slog.Info("Forgot discovered machine to make room", "mac", oldest.MAC, "lastSeen", oldest.LastSeen)
+	return nil
+}
+
+func (s *Store) load(mac string) (*Machine, error) {
+	m := &Machine{}
+	err := store.GetJSON(s.repo(), Bucket, mac, m)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("%s: %w", mac, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// repo returns Repo, creating an in-memory one if needed. s.mu must be
+// held.
+func (s *Store) repo() store.Repository {
+	if s.Repo == nil {
+		s.Repo = store.NewMemory()
+	}
+	return s.Repo
+}
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/nveeser/corepxe/inventory"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	store := &Store{}
+	inv, err := inventory.Load(filepath.Join(t.TempDir(), "inventory.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh := &Handler{Store: store, Inventory: inv}
+	mux := http.NewServeMux()
+	mux.Handle("POST /discovery/report/{mac}", &ReportHandler{Store: store})
+	mux.Handle("GET /admin/discovered", dh)
+	mux.HandleFunc("POST /admin/discovered/{mac}/approve", dh.Approve)
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "10.0.0.9:1234"
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("POST", "/discovery/report/aa:bb:cc:dd:ee:ff", url.Values{"serial": {"ABC123"}}); w.Code != http.StatusNotFound {
+		t.Errorf("report before Seen got status %d wanted %d", w.Code, http.StatusNotFound)
+	}
+	if w := do("POST", "/discovery/report/not-a-mac", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("report with a malformed MAC got status %d wanted %d", w.Code, http.StatusBadRequest)
+	}
+	if _, err := store.Seen("../../x", "10.0.0.9"); !errors.Is(err, ErrInvalidMAC) {
+		t.Errorf("Seen() with a malformed MAC got err %v wanted %s", err, ErrInvalidMAC)
+	}
+	if _, err := store.Seen("AA:BB:CC:DD:EE:FF", "10.0.0.9"); err != nil {
+		t.Fatalf("Seen() got err %s", err)
+	}
+	w := do("POST", "/discovery/report/aa:bb:cc:dd:ee:ff", url.Values{
+		"cpu_model":    {"Intel(R) Xeon(R)\n"},
+		"cpu_count":    {"16"},
+		"mem_total_kb": {"65536000"},
+		"serial":       {"ABC123"},
+		"mac":          {"aa:bb:cc:dd:ee:ff", "AA:BB:CC:DD:EE:00"},
+		"disk":         {"pci-0000:00:17.0-ata-1=480103981056"},
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("report got status %d: %s", w.Code, w.Body.String())
+	}
+
+	var pending []*Machine
+	if err := json.Unmarshal(do("GET", "/admin/discovered", nil).Body.Bytes(), &pending); err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("pending got %d machines wanted 1", len(pending))
+	}
+	f := pending[0].Facts
+	if f == nil || f.CPUModel != "Intel(R) Xeon(R)" || f.CPUCount != 16 || f.MemoryKB != 65536000 || f.Serial != "ABC123" ||
+		len(f.Disks) != 1 || f.Disks[0].Path != "pci-0000:00:17.0-ata-1" || f.Disks[0].Size != 480103981056 {
+		t.Errorf("facts got %+v", f)
+	}
+
+	if w := do("POST", "/admin/discovered/aa:bb:cc:dd:ee:ff/approve", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("approve without name got status %d wanted %d", w.Code, http.StatusBadRequest)
+	}
+	w = do("POST", "/admin/discovered/aa:bb:cc:dd:ee:ff/approve", url.Values{"name": {"node1"}, "profile": {"install"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("approve got status %d: %s", w.Code, w.Body.String())
+	}
+	h := inv.ByMAC("aa:bb:cc:dd:ee:00")
+	if h == nil || h.Name != "node1" || h.Profile != "install" || len(h.MACs) != 2 {
+		t.Errorf("approved host got %+v", h)
+	}
+	if _, err := store.Machine("aa:bb:cc:dd:ee:ff"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Machine() after approve got err %v wanted %s", err, ErrNotFound)
+	}
+}
+
+func TestStoreMaxMachines(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := &Store{
+		MaxMachines: 2,
+		now:         func() time.Time { return now },
+	}
+	for _, mac := range []string{"aa:aa:aa:aa:aa:01", "aa:aa:aa:aa:aa:02", "aa:aa:aa:aa:aa:01", "aa:aa:aa:aa:aa:03"} {
+		now = now.Add(time.Minute)
+		if _, err := s.Seen(mac, ""); err != nil {
+			t.Fatalf("Seen(%s) got err %s", mac, err)
+		}
+	}
+	machines, err := s.Machines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var macs []string
+	for _, m := range machines {
+		macs = append(macs, m.MAC)
+	}
+	if want := []string{"aa:aa:aa:aa:aa:03", "aa:aa:aa:aa:aa:01"}; !reflect.DeepEqual(macs, want) {
+		t.Errorf("Machines() got %v wanted %v", macs, want)
+	}
+}
+
+func TestIgnition(t *testing.T) {
+	data, err := Ignition("http://pxe/discovery/report/aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatalf("Ignition() got err %s", err)
+	}
+	var config struct {
+		Systemd struct {
+			Units []struct{ Name string }
+		}
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Systemd.Units) != 1 || config.Systemd.Units[0].Name != ReportUnit {
+		t.Errorf("Ignition() got units %+v", config.Systemd.Units)
+	}
+}
@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/nveeser/corepxe/inventory"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IgnitionHandler serves the discovery Ignition config for the machine
+// named by the "mac" path value.
+type IgnitionHandler struct {
+	// ReportURL returns the URL the machine posts its facts to.
+	ReportURL func(r *http.Request, mac string) string
+}
+
+func (h *IgnitionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mac := inventory.NormalizeMAC(r.PathValue("mac"))
+	data, err := Ignition(h.ReportURL(r, mac))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ReportHandler accepts the hardware report posted by the discovery
+// Ignition config for the machine named by the "mac" path value.
+type ReportHandler struct {
+	Store *Store
+	// ClientIP returns the address of the client; by default the remote
+	// address of the request.
+	ClientIP func(r *http.Request) string
+}
+
+// maxReportSize bounds the body of a hardware report.
+const maxReportSize = 64 << 10
+
+func (h *ReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReportSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := r.RemoteAddr
+	if h.ClientIP != nil {
+		ip = h.ClientIP(r)
+	} else if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	m, err := h.Store.Report(r.PathValue("mac"), ip, parseFacts(r.PostForm))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	slog.Info("Machine discovered", "mac", m.MAC, "ip", m.IP, "serial", m.Facts.Serial, "product", m.Facts.Product)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseFacts(form map[string][]string) *Facts {
+	get := func(k string) string {
+		if v := form[k]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	f := &Facts{
+		CPUModel: get("cpu_model"),
+		Serial:   get("serial"),
+		Vendor:   get("vendor"),
+		Product:  get("product"),
+	}
+	f.CPUCount, _ = strconv.Atoi(get("cpu_count"))
+	f.MemoryKB, _ = strconv.ParseInt(get("mem_total_kb"), 10, 64)
+	for _, mac := range form["mac"] {
+		if inventory.ValidMAC(mac) {
+			f.MACs = append(f.MACs, inventory.NormalizeMAC(mac))
+		}
+	}
+	for _, d := range form["disk"] {
+		path, size, _ := strings.Cut(d, "=")
+		n, _ := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		f.Disks = append(f.Disks, Disk{Path: path, Size: n})
+	}
+	return f
+}
+
+// Handler serves the pending machines as JSON. With a "mac" path value it
+// returns that machine, otherwise all pending machines.
+type Handler struct {
+	Store     *Store
+	Inventory *inventory.File
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v any
+	var err error
+	if mac := r.PathValue("mac"); mac != "" {
+		v, err = h.Store.Machine(mac)
+	} else {
+		v, err = h.Store.Machines()
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// Approve adds the pending machine named by the "mac" path value to the
+// inventory and forgets it. The form holds the host "name" and optionally
+// its "profile", "os", "config" and one "group" per group. The host gets
+// every MAC address the machine reported. It responds with the new host.
+func (h *Handler) Approve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := h.Store.Machine(r.PathValue("mac"))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	host := &inventory.Host{
+		Name:    r.Form.Get("name"),
+		Profile: r.Form.Get("profile"),
+		OS:      r.Form.Get("os"),
+		Config:  r.Form.Get("config"),
+		Groups:  r.Form["group"],
+		MACs:    []string{m.MAC},
+	}
+	if host.Name == "" {
+		http.Error(w, "missing host name", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.Inventory.Host(host.Name); err == nil {
+		http.Error(w, "host "+host.Name+" already exists", http.StatusConflict)
+		return
+	}
+	if m.Facts != nil {
+		for _, mac := range m.Facts.MACs {
+			if mac != m.MAC {
+				host.MACs = append(host.MACs, mac)
+			}
+		}
+	}
+	if err := h.Inventory.PutHost(host); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.Store.Remove(m.MAC); err != nil {
+		httpError(w, err)
+		return
+	}
+	slog.Info("Machine approved", "mac", m.MAC, "host", host.Name, "profile", host.Profile)
+	writeJSON(w, host)
+}
+
+// Reject forgets the pending machine named by the "mac" path value. It is
+// discovered again the next time it boots.
+func (h *Handler) Reject(w http.ResponseWriter, r *http.Request) {
+	if err := h.Store.Remove(r.PathValue("mac")); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrInvalidMAC):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/coreos/butane/config"
+	"github.com/coreos/butane/config/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the script and systemd unit in the discovery Ignition config.
+const (
+	ReportScript = "/usr/local/bin/corepxe-discover"
+	ReportUnit   = "corepxe-discover.service"
+)
+
+// The script reports the CPU, memory, DMI identity, whole disks under
+// /dev/disk/by-path and every MAC address of the machine as a form, with
+// one "disk" value of "<by-path name>=<bytes>" per disk.
+const reportScript = `#!/bin/sh
+set -eu
+args=""
+for a in /sys/class/net/*/address; do
+  mac=$(cat "$a")
+  [ "$mac" = "00:00:00:00:00:00" ] || args="$args --data-urlencode mac=$mac"
+done
+for d in /dev/disk/by-path/*; do
+  case "$d" in *-part*) continue ;; esac
+  [ -e "$d" ] || continue
+  args="$args --data-urlencode disk=$(basename "$d")=$(blockdev --getsize64 "$d")"
+done
+dmi() { cat "/sys/class/dmi/id/$1" 2>/dev/null || true; }
+exec curl -fsS --retry 10 --retry-delay 10 --retry-all-errors \
+  --data-urlencode "cpu_model=$(sed -n 's/^model name[[:space:]]*: //p' /proc/cpuinfo | head -n 1)" \
+  --data-urlencode "cpu_count=$(nproc)" \
+  --data-urlencode "mem_total_kb=$(awk '/^MemTotal:/ { print $2 }' /proc/meminfo)" \
+  --data-urlencode "serial=$(dmi product_serial)" \
+  --data-urlencode "vendor=$(dmi sys_vendor)" \
+  --data-urlencode "product=$(dmi product_name)" \
+  $args "%s"
+`
+
+const reportUnit = `[Unit]
+Description=Report hardware to corepxe
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=` + ReportScript + `
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// Ignition returns the Ignition config booted by discovered machines. It
+// runs the report script once the network is up, posting to reportURL.
+func Ignition(reportURL string) ([]byte, error) {
+	butane := map[string]any{
+		"variant": "fcos",
+		"version": "1.5.0",
+		"storage": map[string]any{
+			"files": []any{
+				map[string]any{
+					"path": ReportScript,
+					"mode": 0755,
+					"contents": map[string]any{
+						"inline": fmt.Sprintf(reportScript, reportURL),
+					},
+				},
+			},
+		},
+		"systemd": map[string]any{
+			"units": []any{
+				map[string]any{
+					"name":     ReportUnit,
+					"enabled":  true,
+					"contents": reportUnit,
+				},
+			},
+		},
+	}
+	data, err := yaml.Marshal(butane)
+	if err != nil {
+		return nil, err
+	}
+	ign, report, err := config.TranslateBytes(data, common.TranslateBytesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error during translate: %w\n%s", err, report)
+	}
+	return ign, nil
+}
@@ -0,0 +1,132 @@
+// Package gitconfig reads revisions of a config directory kept in a git
+// repository, by running git.
+package gitconfig
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Resolve returns the commit that rev, e.g. "HEAD~1" or a tag, names in
+// the repository holding dir.
+func Resolve(ctx context.Context, dir, rev string) (string, error) {
+	out, err := git(ctx, dir, "rev-parse", "--verify", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Export writes dir as of rev to dst, which must exist, and returns the
+// commit rev names. dir may be a bare repository, whose whole tree is
+// written, or a directory of a work tree.
+func Export(ctx context.Context, dir, rev, dst string) (string, error) {
+	commit, err := Resolve(ctx, dir, rev)
+	if err != nil {
+		return "", err
+	}
+	top, prefix := dir, ""
+	bare, err := git(ctx, dir, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(bare)) != "true" {
+		out, err := git(ctx, dir, "rev-parse", "--show-toplevel", "--show-prefix")
+		if err != nil {
+			return "", err
+		}
+		top, prefix, _ = strings.Cut(strings.TrimSuffix(string(out), "\n"), "\n")
+	}
+	// git archive limits the archive to the working directory.
+	cmd := exec.CommandContext(ctx, "git", "-C", top, "archive", "--format=tar", commit+":"+prefix)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	archive, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	extractErr := extract(archive, dst)
+	io.Copy(io.Discard, archive)
+	if err := cmd.Wait(); err != nil {
+		return "", gitError(err, stderr.Bytes())
+	}
+	if extractErr != nil {
+		return "", extractErr
+	}
+	return commit, nil
+}
+
+// extract writes the files of the tar archive r to dst.
+func extract(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid path %q in archive", hdr.Name)
+		}
+		path := filepath.Join(dst, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, gitError(err, stderr.Bytes())
+	}
+	return out, nil
+}
+
+func gitError(err error, stderr []byte) error {
+	if msg := strings.TrimSpace(string(stderr)); msg != "" {
+		return fmt.Errorf("git: %s", msg)
+	}
+	return fmt.Errorf("git: %w", err)
+}
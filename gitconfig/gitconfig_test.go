@@ -0,0 +1,78 @@
+package gitconfig
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	ctx := context.Background()
+	repo := t.TempDir()
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	run := func(args ...string) {
+		t.Helper()
+		if _, err := git(ctx, repo, args...); err != nil {
+			t.Fatalf("git %v got err %s", args, err)
+		}
+	}
+	write := func(name, data string) {
+		t.Helper()
+		path := filepath.Join(repo, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("init", "-q")
+	write("README", "not config")
+	write("configs/coreos/base/base.yaml", "v1")
+	run("add", "-A")
+	run("commit", "-q", "-m", "one")
+	write("configs/coreos/base/base.yaml", "v2")
+	run("commit", "-q", "-a", "-m", "two")
+
+	dir := filepath.Join(repo, "configs")
+	head, err := Resolve(ctx, dir, "HEAD")
+	if err != nil || len(head) != 40 {
+		t.Fatalf("Resolve(HEAD) got %q, %v", head, err)
+	}
+	dst := t.TempDir()
+	commit, err := Export(ctx, dir, "HEAD~1", dst)
+	if err != nil {
+		t.Fatalf("Export() got err %s", err)
+	}
+	if commit == head || len(commit) != 40 {
+		t.Errorf("Export() got commit %q wanted the parent of %s", commit, head)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "coreos/base/base.yaml")); err != nil || string(got) != "v1" {
+		t.Errorf("exported base.yaml got %q, %v wanted v1", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "README")); err == nil {
+		t.Errorf("Export() wrote files outside of the directory")
+	}
+	bare := t.TempDir()
+	if _, err := git(ctx, repo, "clone", "-q", "--bare", repo, bare); err != nil {
+		t.Fatal(err)
+	}
+	dst = t.TempDir()
+	if commit, err := Export(ctx, bare, head, dst); err != nil || commit != head {
+		t.Errorf("Export(bare) got %q, %v", commit, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "configs/coreos/base/base.yaml")); err != nil || string(got) != "v2" {
+		t.Errorf("exported bare base.yaml got %q, %v wanted v2", got, err)
+	}
+	if _, err := Export(ctx, dir, "nope", t.TempDir()); err == nil {
+		t.Errorf("Export(nope) got no err")
+	}
+}
@@ -0,0 +1,240 @@
+package ignition
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/secrets"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the number of renders kept; the least recently
+// used is dropped first.
+const maxCacheEntries = 4096
+
+// secretsTTL is how long the secrets of a cached render are trusted
+// before they are read again to tell whether it is still current.
+const secretsTTL = time.Minute
+
+// renderCache keeps the last good render of each config and the template
+// data it references, with the hashes of the files and secrets it was
+// rendered from. A render is reused for as long as they are unchanged.
+type renderCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	files   map[string]fileSum
+	// refs holds the fields of the template data the last render of
+	// each source referenced, by source key.
+	refs map[string][]string
+}
+
+type cacheEntry struct {
+	data []byte
+	// sums holds the hash of each input file, by absolute path.
+	sums map[string]string
+	// secrets is the hash of the secrets referenced, by reference.
+	secrets map[string]string
+	// checked is when secrets were last read.
+	checked  time.Time
+	lastUsed time.Time
+}
+
+// fileSum is the hash of a file along with what it was computed from.
+type fileSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// fields returns the fields of the template data the last render of the
+// source with key base referenced.
+func (c *renderCache) fields(base string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fields, ok := c.refs[base]
+	return fields, ok
+}
+
+// lookup returns the render stored under key if its inputs are unchanged.
+// Its secrets are read from b again only once secretsTTL has passed.
+func (c *renderCache) lookup(ctx context.Context, key string, b secrets.Backend) ([]byte, bool) {
+	c.mu.Lock()
+	e := c.entries[key]
+	c.mu.Unlock()
+	if e == nil {
+		return nil, false
+	}
+	for path, sum := range e.sums {
+		if s := c.sum(path); s == "" || s != sum {
+			return nil, false
+		}
+	}
+	c.mu.Lock()
+	check := len(e.secrets) > 0 && time.Since(e.checked) >= secretsTTL
+	c.mu.Unlock()
+	if check {
+		for ref, sum := range e.secrets {
+			if b == nil {
+				return nil, false
+			}
+			v, err := b.Get(ctx, ref)
+			if err != nil || hashBytes(v) != sum {
+				return nil, false
+			}
+		}
+	}
+	c.mu.Lock()
+	now := time.Now()
+	if check {
+		e.checked = now
+	}
+	e.lastUsed = now
+	c.mu.Unlock()
+	return e.data, true
+}
+
+// last returns the render stored under key, whatever its inputs.
+func (c *renderCache) last(key string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[key]; e != nil {
+		return e.data
+	}
+	return nil
+}
+
+// store keeps out, rendered from the source with key base, under key.
+func (c *renderCache) store(base, key string, out *rendered) {
+	now := time.Now()
+	e := &cacheEntry{
+		data:     out.data,
+		sums:     make(map[string]string),
+		secrets:  out.secrets,
+		checked:  now,
+		lastUsed: now,
+	}
+	for _, path := range out.inputs {
+		if e.sums[path] = c.sum(path); e.sums[path] == "" {
+			return
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+		c.refs = make(map[string][]string)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		oldest := ""
+		for k, other := range c.entries {
+			if oldest == "" || other.lastUsed.Before(c.entries[oldest].lastUsed) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	if _, ok := c.refs[base]; !ok && len(c.refs) >= maxCacheEntries {
+		for k := range c.refs {
+			delete(c.refs, k)
+			break
+		}
+	}
+	c.entries[key] = e
+	c.refs[base] = out.fields
+}
+
+// hashingBackend records the hash of each secret read from Backend in
+// sums, by reference.
+type hashingBackend struct {
+	secrets.Backend
+	sums map[string]string
+}
+
+func (b *hashingBackend) Get(ctx context.Context, ref string) ([]byte, error) {
+	v, err := b.Backend.Get(ctx, ref)
+	if err == nil {
+		b.sums[ref] = hashBytes(v)
+	}
+	return v, err
+}
+
+// sum returns the hash of the file or directory tree at path, a marker
+// for a missing one, or "" when it cannot be read. Files are only hashed
+// again when their size or modification time changed.
+func (c *renderCache) sum(path string) string {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing"
+	}
+	if err != nil {
+		return ""
+	}
+	if !fi.IsDir() {
+		return c.fileSum(path, fi)
+	}
+	var lines []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum := c.fileSum(p, info)
+		if sum == "" {
+			return fmt.Errorf("cannot read %s", p)
+		}
+		rel, _ := filepath.Rel(path, p)
+		lines = append(lines, rel+" "+info.Mode().String()+" "+sum)
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		fmt.Fprintln(h, l)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *renderCache) fileSum(path string, fi fs.FileInfo) string {
+	c.mu.Lock()
+	cached, ok := c.files[path]
+	c.mu.Unlock()
+	if ok && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) {
+		return cached.sum
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	c.mu.Lock()
+	if c.files == nil {
+		c.files = make(map[string]fileSum)
+	}
+	c.files[path] = fileSum{size: fi.Size(), modTime: fi.ModTime(), sum: sum}
+	c.mu.Unlock()
+	return sum
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
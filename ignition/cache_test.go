@@ -0,0 +1,159 @@
+package ignition
+
+import (
+	"context"
+	"github.com/nveeser/corepxe/secrets"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"coreos/base/base.yaml": "variant: fcos\nversion: 1.5.0\n",
+		"coreos/node1/host.yaml": `
+storage:
+  files:
+    - path: /etc/motd
+      contents: {local: motd}
+    - path: /etc/token
+      contents: {secret: token}
+`,
+		"coreos/node1/motd": "one",
+	})
+	t.Setenv("TEST_SECRET_TOKEN", "first")
+	backend := &countingBackend{Backend: &secrets.Env{Prefix: "TEST_SECRET_"}}
+	h := &Handler{
+		ConfigRoot: dir,
+		Secrets:    backend,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /configs/{osname}/{name}", h)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	render := func() string {
+		t.Helper()
+		w := get("/configs/coreos/node1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	first := render()
+	if backend.gets != 1 {
+		t.Errorf("first render read %d secrets wanted 1", backend.gets)
+	}
+	var cached []string
+	for k := range h.cache.entries {
+		cached = append(cached, k)
+	}
+	if len(cached) != 1 || !strings.HasPrefix(cached[0], "coreos/node1@") {
+		t.Fatalf("cache got keys %v wanted one for node1", cached)
+	}
+	if data, ok := h.cache.lookup(context.Background(), cached[0], h.Secrets); !ok || string(data) != first {
+		t.Errorf("lookup() got %v wanted the render", ok)
+	}
+
+	writeFiles(t, dir, map[string]string{"coreos/node1/motd": "changed"})
+	if got := render(); got == first || !strings.Contains(got, "changed") {
+		t.Errorf("render after a local file changed got\n%s", got)
+	}
+	t.Setenv("TEST_SECRET_TOKEN", "second")
+	gets := backend.gets
+	if got := render(); !strings.Contains(got, "first") || backend.gets != gets {
+		t.Errorf("render within secretsTTL read %d secrets and got\n%s\nwanted the cached render", backend.gets-gets, got)
+	}
+	for _, e := range h.cache.entries {
+		e.checked = time.Time{}
+	}
+	if got := render(); !strings.Contains(got, "second") {
+		t.Errorf("render after a secret changed got\n%s", got)
+	}
+	good := render()
+
+	writeFiles(t, dir, map[string]string{"coreos/node1/host.yaml": "storage: [broken\n"})
+	w := get("/configs/coreos/node1")
+	if w.Code != http.StatusOK || w.Body.String() != good {
+		t.Errorf("broken host.yaml got status %d and\n%s\nwanted the last good render", w.Code, w.Body)
+	}
+	if warning := w.Header().Get("Warning"); !strings.HasPrefix(warning, "199 ") {
+		t.Errorf("broken host.yaml got Warning %q", warning)
+	}
+	if _, err := h.Butane("coreos", "node1"); err == nil {
+		t.Errorf("Butane() got no err wanted the failure")
+	}
+
+	writeFiles(t, dir, map[string]string{"coreos/node2/host.yaml": "storage: [broken\n"})
+	if w := get("/configs/coreos/node2"); w.Code != http.StatusInternalServerError {
+		t.Errorf("broken host.yaml without a good render got status %d", w.Code)
+	}
+	if w := get("/configs/coreos/node3"); w.Code != http.StatusNotFound {
+		t.Errorf("missing host got status %d", w.Code)
+	}
+}
+
+func TestRenderCacheTemplateData(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"coreos/base/base.yaml": "variant: fcos\nversion: 1.5.0\n",
+		"coreos/node1/host.yaml": `
+storage:
+  files:
+    - path: /etc/hostname
+      contents: {inline: "{{ .Hostname }}"}
+`,
+		"coreos/node2/host.yaml": `
+storage:
+  files:
+    - path: /etc/client
+      contents: {inline: "{{ .Request.RemoteIP }}"}
+`,
+	})
+	h := &Handler{ConfigRoot: dir}
+	mux := http.NewServeMux()
+	mux.Handle("GET /configs/{osname}/{name}", h)
+	entries := func(host string) int {
+		n := 0
+		for k := range h.cache.entries {
+			if strings.HasPrefix(k, "coreos/"+host+"@") {
+				n++
+			}
+		}
+		return n
+	}
+	for _, remote := range []string{"192.0.2.1:1234", "192.0.2.2:1234"} {
+		for _, host := range []string{"node1", "node2"} {
+			r := httptest.NewRequest("GET", "/configs/coreos/"+host+"?mac=aa:aa:aa:aa:aa:01", nil)
+			r.RemoteAddr = remote
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s from %s got status %d: %s", host, remote, w.Code, w.Body)
+			}
+		}
+	}
+	if n := entries("node1"); n != 1 {
+		t.Errorf("node1, which only references Hostname, got %d cache entries wanted 1", n)
+	}
+	if n := entries("node2"); n != 2 {
+		t.Errorf("node2, which references Request.RemoteIP, got %d cache entries wanted 2", n)
+	}
+}
+
+// countingBackend counts the secrets read from Backend.
+type countingBackend struct {
+	secrets.Backend
+	gets int
+}
+
+func (b *countingBackend) Get(ctx context.Context, ref string) ([]byte, error) {
+	b.gets++
+	return b.Backend.Get(ctx, ref)
+}
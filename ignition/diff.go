@@ -0,0 +1,236 @@
+package ignition
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// HostDiff is how the Ignition config of a host differs between two
+// config trees.
+type HostDiff struct {
+	OS   string `json:"os"`
+	Host string `json:"host"`
+	// Status is "added", "removed", "changed", or "error" when the config
+	// fails to render in either tree.
+	Status  string   `json:"status"`
+	Changes []Change `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Statuses of a HostDiff.
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+	DiffError   = "error"
+)
+
+// Change is a value of an Ignition config that differs. Old is nil for
+// an added value and New for a removed one.
+type Change struct {
+	// Path is the path of the value, e.g. "$.storage.files[/etc/motd].mode",
+	// where the entries of keyed lists are named by their key.
+	Path string `json:"path"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("+ %s: %s", c.Path, compactJSON(c.New))
+	case c.New == nil:
+		return fmt.Sprintf("- %s: %s", c.Path, compactJSON(c.Old))
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.Path, compactJSON(c.Old), compactJSON(c.New))
+}
+
+func compactJSON(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Diff renders the Ignition config of every host of from and to, and
+// returns how those that differ do, by osname and host. Secret
+// references are rendered as placeholders, so only changes to the
+// references show.
+func Diff(ctx context.Context, from, to *Handler) ([]HostDiff, error) {
+	fromHosts, err := from.allHosts()
+	if err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	toHosts, err := to.allHosts()
+	if err != nil {
+		return nil, fmt.Errorf("to: %w", err)
+	}
+	all := make(map[string]bool)
+	for _, hosts := range []map[string]bool{fromHosts, toHosts} {
+		for h := range hosts {
+			all[h] = true
+		}
+	}
+	names := make([]string, 0, len(all))
+	for h := range all {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+
+	var diffs []HostDiff
+	for _, name := range names {
+		osname, host, _ := strings.Cut(name, "/")
+		d := HostDiff{OS: osname, Host: host}
+		var before, after any
+		var errs []string
+		if fromHosts[name] {
+			if before, err = from.renderValue(ctx, osname, host); err != nil {
+				errs = append(errs, "from: "+err.Error())
+			}
+		}
+		if toHosts[name] {
+			if after, err = to.renderValue(ctx, osname, host); err != nil {
+				errs = append(errs, "to: "+err.Error())
+			}
+		}
+		switch {
+		case len(errs) > 0:
+			d.Status, d.Error = DiffError, strings.Join(errs, "; ")
+		case !fromHosts[name]:
+			d.Status = DiffAdded
+		case !toHosts[name]:
+			d.Status = DiffRemoved
+		default:
+			d.Changes = diffValues("$", before, after)
+			if len(d.Changes) == 0 {
+				continue
+			}
+			d.Status = DiffChanged
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// allHosts returns "<osname>/<host>" for every host of every osname.
+func (h *Handler) allHosts() (map[string]bool, error) {
+	osnames, err := h.OSNames()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]bool)
+	for _, osname := range osnames {
+		hosts, err := h.Hosts(osname)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			all[osname+"/"+host] = true
+		}
+	}
+	return all, nil
+}
+
+// renderValue renders the Ignition config of host, never from the cache
+// and with placeholders for secrets, and returns it decoded.
+func (h *Handler) renderValue(ctx context.Context, osname, host string) (any, error) {
+	src, err := h.source(nil, osname, host)
+	if err != nil {
+		return nil, err
+	}
+	out, err := h.translate(ctx, src, placeholderSecrets{})
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(out.data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// diffValues returns the changes from before to after, found at path.
+// Objects are compared by key and the entries of keyed lists (see
+// listKeys) by their key; other values are compared whole.
+func diffValues(path string, before, after any) []Change {
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	switch b := before.(type) {
+	case map[string]any:
+		a, ok := after.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range b {
+			keys[k] = true
+		}
+		for k := range a {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		var changes []Change
+		for _, k := range sorted {
+			changes = append(changes, diffValues(path+"."+k, b[k], a[k])...)
+		}
+		return changes
+	case []any:
+		a, ok := after.([]any)
+		if !ok {
+			break
+		}
+		field := listKey(path)
+		if field == "" {
+			break
+		}
+		oldKeys, oldEntries, ok := keyedEntries(b, field)
+		if !ok {
+			break
+		}
+		newKeys, newEntries, ok := keyedEntries(a, field)
+		if !ok {
+			break
+		}
+		var changes []Change
+		for _, k := range oldKeys {
+			changes = append(changes, diffValues(path+"["+k+"]", oldEntries[k], newEntries[k])...)
+		}
+		for _, k := range newKeys {
+			if _, ok := oldEntries[k]; !ok {
+				changes = append(changes, Change{Path: path + "[" + k + "]", New: newEntries[k]})
+			}
+		}
+		return changes
+	}
+	return []Change{{Path: path, Old: before, New: after}}
+}
+
+// keyedEntries returns the keys of the entries of list, in order, and the
+// entries by key. It returns false when an entry has no key or shares it.
+func keyedEntries(list []any, field string) ([]string, map[string]any, bool) {
+	keys := make([]string, 0, len(list))
+	entries := make(map[string]any, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]any)
+		if !ok {
+			return nil, nil, false
+		}
+		k, ok := entry[field].(string)
+		if _, dup := entries[k]; !ok || dup {
+			return nil, nil, false
+		}
+		keys = append(keys, k)
+		entries[k] = entry
+	}
+	return keys, entries, true
+}
@@ -0,0 +1,75 @@
+package ignition
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	base := "variant: fcos\nversion: 1.5.0\n"
+	node1 := `systemd:
+  units:
+    - name: a.service
+      enabled: true
+    - name: b.service
+      enabled: true
+`
+	from, to := t.TempDir(), t.TempDir()
+	writeFiles(t, from, map[string]string{
+		"coreos/base/base.yaml":      base,
+		"coreos/same/host.yaml":      "",
+		"coreos/node1/host.yaml":     node1,
+		"coreos/removed/host.yaml":   "",
+		"coreos/broken/host.yaml":    "",
+		"coreos/secrets/host.yaml":   "passwd: {users: [{name: core, password_hash: {secret: users/core}}]}\n",
+		"coreos/unrelated/host.yaml": "",
+	})
+	writeFiles(t, to, map[string]string{
+		"coreos/base/base.yaml": base,
+		"coreos/same/host.yaml": "",
+		"coreos/node1/host.yaml": `systemd:
+  units:
+    - name: b.service
+      enabled: false
+    - name: c.service
+      enabled: true
+`,
+		"coreos/added/host.yaml":     "",
+		"coreos/broken/host.yaml":    "storage: [broken\n",
+		"coreos/secrets/host.yaml":   "passwd: {users: [{name: core, password_hash: {secret: users/admin}}]}\n",
+		"coreos/unrelated/host.yaml": "",
+	})
+
+	diffs, err := Diff(context.Background(), &Handler{ConfigRoot: from}, &Handler{ConfigRoot: to})
+	if err != nil {
+		t.Fatalf("Diff() got err %s", err)
+	}
+	byHost := make(map[string]HostDiff)
+	for _, d := range diffs {
+		byHost[d.Host] = d
+	}
+	if len(diffs) != 5 {
+		t.Errorf("Diff() got %d diffs wanted 5: %v", len(diffs), diffs)
+	}
+	if d := byHost["added"]; d.Status != DiffAdded {
+		t.Errorf("added got %+v", d)
+	}
+	if d := byHost["removed"]; d.Status != DiffRemoved {
+		t.Errorf("removed got %+v", d)
+	}
+	if d := byHost["broken"]; d.Status != DiffError || d.Error == "" {
+		t.Errorf("broken got %+v", d)
+	}
+	want := []Change{
+		{Path: "$.systemd.units[a.service]", Old: map[string]any{"name": "a.service", "enabled": true}},
+		{Path: "$.systemd.units[b.service].enabled", Old: true, New: false},
+		{Path: "$.systemd.units[c.service]", New: map[string]any{"name": "c.service", "enabled": true}},
+	}
+	if d := byHost["node1"]; d.Status != DiffChanged || !reflect.DeepEqual(d.Changes, want) {
+		t.Errorf("node1 got %+v wanted changes %v", d, want)
+	}
+	if d := byHost["secrets"]; d.Status != DiffChanged || len(d.Changes) != 1 || d.Changes[0].Path != "$.passwd.users[core].passwordHash" {
+		t.Errorf("secrets got %+v", d)
+	}
+}
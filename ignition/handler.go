@@ -1,232 +1,482 @@
 package ignition
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/coreos/butane/config"
 	"github.com/coreos/butane/config/common"
+	"github.com/nveeser/corepxe/accesslog"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/metrics"
+	"github.com/nveeser/corepxe/secrets"
+	"github.com/nveeser/corepxe/token"
 	"gopkg.in/yaml.v3"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"reflect"
-	"strings"
+	"sort"
 )
 
 type Handler struct {
 	ConfigRoot string
+
+	// Tokens, when set, restricts access to requests that carry a valid
+	// "token" query parameter issued for the host, or that present a
+	// verified TLS client certificate naming the host. Others get 403.
+	Tokens *token.Signer
+	// ClientIP returns the address of the client, which tokens bound to
+	// an IP are checked against; by default the remote address of the
+	// request.
+	ClientIP func(r *http.Request) string
+
+	// PhoneHome, when set, returns the URL that host should report its
+	// first boot to; a unit that does so is added to every config. r is
+	// nil when rendering outside of a request.
+	PhoneHome func(r *http.Request, host string) string
+
+	// Includes, when set, returns the Butane files, relative to the
+	// osname directory, merged after "base/base.yaml" and before the
+	// host's "host.yaml", e.g. those of the groups of the inventory host
+	// whose config is "<osname>/<config>", preferring the one with the
+	// given MAC address as Host does.
+	Includes func(osname, config, mac string) []string
+
+	// Host, when set, returns the inventory host whose Ignition config is
+	// "<osname>/<config>", preferring the one with the given MAC address,
+	// and its variables. It may return a nil host. They are the data
+	// Butane files are executed with as templates (see TemplateData).
+	Host func(osname, config, mac string) (*inventory.Host, map[string]any)
+
+	// Secrets resolves the secret references of Butane configs (see
+	// secretKey). They are only resolved in the rendered Ignition, never
+	// in the Butane shown with "?debug".
+	Secrets secrets.Backend
+
+	// Revision, when set, is the config revision ConfigRoot holds, e.g.
+	// the git commit it was checked out from.
+	Revision string
+
+	// Pinned, when set, returns the directory holding the config revision
+	// the machine with the given MAC address is pinned to, and that
+	// revision, or "" when it is not pinned. The Ignition config of a
+	// pinned machine is rendered from that directory.
+	Pinned func(mac string) (root, revision string, err error)
+
+	cache renderCache
 }
 
+// RevisionHeader is the response header naming the config revision an
+// Ignition config was rendered from (see Handler.Revision).
+const RevisionHeader = "X-Config-Revision"
+
+// ErrNotFound is returned when the requested osname or host has no
+// configuration under ConfigRoot.
+var ErrNotFound = errors.New("not found")
+
+// ServeHTTP serves the Ignition config of a host. With "?debug" it serves
+// the merged Butane instead, with "?debug=provenance" where each of its
+// values was set as JSON (see Provenance), and with "?debug=annotated"
+// the Butane with that as comments.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	osname := r.PathValue("osname")
 	host := r.PathValue("name")
 
-	log.Printf("RemoteHost: %s\n", r.RemoteAddr)
+	slog.Debug("Ignition request", "remote", r.RemoteAddr, "osname", osname, "host", host)
+	accesslog.Annotate(r.Context(), slog.String("osname", osname), slog.String("host", host))
 
-	osDir := filepath.Join(h.ConfigRoot, osname)
-	if _, err := os.Stat(osDir); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			http.Error(w, fmt.Sprintf("invalid osname: %s", err), http.StatusNotFound)
-			return
-		}
-		http.Error(w, fmt.Sprintf("error reading source config ConfigRoot: %s", err), http.StatusInternalServerError)
+	if err := h.authorize(r, osname, host); err != nil {
+		slog.Warn("Ignition denied", "osname", osname, "host", host, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
-	// /path/to/config/root
-	//
-	merge := &merge{
-		base: osDir,
-		pathKeys: []string{
-			".local",
-			".contents_local",
-			".ssh_authorized_keys_local",
-		},
+	var data []byte
+	var stale error
+	src, err := h.source(r, osname, host)
+	if err == nil {
+		if src.revision != "" {
+			w.Header().Set(RevisionHeader, src.revision)
+		}
+		switch debug, ok := r.URL.Query()["debug"]; {
+		case !ok:
+			data, stale, err = h.render(r.Context(), src)
+		case debug[0] == "provenance", debug[0] == "annotated":
+			data, err = h.debugProvenance(src, debug[0] == "annotated")
+		default:
+			data, err = h.butane(src)
+		}
 	}
-	butaneData, err := merge.Merge("base/base.yaml", filepath.Join(host, "host.yaml"))
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error reading file: %s", err), http.StatusInternalServerError)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
-	}
-
-	if r.URL.Query().Has("debug") {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write(butaneData)
-		if err != nil {
-			log.Printf("Error writing Butane: %s", err)
-		}
+	case err != nil:
+		slog.Error("Error rendering Ignition", "osname", osname, "host", host, "err", err)
+		metrics.IgnitionRenderFailures.WithLabelValues(osname, host).Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	data, report, err := config.TranslateBytes(butaneData, common.TranslateBytesOptions{
-		TranslateOptions: common.TranslateOptions{
-			FilesDir: osDir,
-		},
-	})
-	if err != nil {
-		log.Printf("Error during translate: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(report.String()))
-		return
+	if stale != nil {
+		w.Header().Set("Warning", `199 - "stale Ignition: the last render failed"`)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(data)
 	if err != nil {
-		log.Printf("Error writing Ignition: %s", err)
+		slog.Warn("Error writing Ignition", "err", err)
 		return
 	}
 }
 
-type merge struct {
-	base      string
-	config    map[string]any
-	pathKeys  []string
-	overwrite bool
-	append    bool
+// debugProvenance returns the Provenance of the config of host as JSON or,
+// when annotated, as the annotated Butane YAML.
+func (h *Handler) debugProvenance(src *source, annotated bool) ([]byte, error) {
+	p, err := h.provenance(src)
+	if err != nil {
+		return nil, err
+	}
+	if annotated {
+		return p.AnnotatedYAML()
+	}
+	return json.MarshalIndent(p, "", "  ")
 }
 
-func (m *merge) Merge(path ...string) ([]byte, error) {
-	for _, f := range path {
-		if err := m.mergeFile(f); err != nil {
-			return nil, fmt.Errorf("file[%s]: %w", path, err)
+func (h *Handler) authorize(r *http.Request, osname, host string) error {
+	if h.Tokens == nil {
+		return nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if err := r.TLS.PeerCertificates[0].VerifyHostname(host); err == nil {
+			return nil
 		}
 	}
-	return yaml.Marshal(m.config)
+	tok := r.URL.Query().Get("token")
+	if tok == "" {
+		return errors.New("no token")
+	}
+	mac := r.URL.Query().Get("mac")
+	var ih *inventory.Host
+	if h.Host != nil {
+		ih, _ = h.Host(osname, host, mac)
+	}
+	if ih != nil && mac != "" && !ih.HasMAC(mac) {
+		ih = nil
+	}
+	_, err := h.Tokens.Verify(tok, TokenHost(host, ih, mac), h.clientIP(r), mac)
+	return err
+}
+
+// TokenHost returns what a token for the Ignition config named config is
+// issued for: the config and the inventory host or, outside the inventory,
+// the MAC address of the machine. Machines sharing a config so cannot use
+// each other's tokens.
+func TokenHost(config string, host *inventory.Host, mac string) string {
+	switch {
+	case host != nil:
+		return config + "/" + host.Name
+	case mac != "":
+		return config + "/mac/" + inventory.NormalizeMAC(mac)
+	}
+	return config
 }
 
-func (m *merge) mergeFile(path string) error {
-	d, err := os.ReadFile(filepath.Join(m.base, path))
+func (h *Handler) clientIP(r *http.Request) string {
+	if h.ClientIP != nil {
+		return h.ClientIP(r)
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return fmt.Errorf("error file[%s]: %w", path, err)
+		return r.RemoteAddr
 	}
+	return ip
+}
 
-	config := map[string]any{}
-	if err := yaml.Unmarshal(d, &config); err != nil {
-		return fmt.Errorf("error reading yaml: %w", err)
+// Butane returns the merged Butane YAML for host: "base/base.yaml", then
+// the files returned by Includes, then "<host>/host.yaml", all relative
+// to the osname directory. Each file is preceded by the files listed in
+// its "includes", relative to it, and merged according to its
+// "merge_policy" (see Policy). Files are Go templates, executed with
+// TemplateData before they are parsed.
+func (h *Handler) Butane(osname, host string) ([]byte, error) {
+	src, err := h.source(nil, osname, host)
+	if err != nil {
+		return nil, err
 	}
+	return h.butane(src)
+}
 
-	m.resolvePathsObject(config, path, "$")
+func (h *Handler) butane(src *source) ([]byte, error) {
+	merge, err := h.merge(src, false)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(merge.config)
+}
 
-	if m.config == nil {
-		m.config = config
-		return nil
+// source is what the config of a host is built from, before any file is
+// read.
+type source struct {
+	osname, host string
+	// revision is the config revision osDir belongs to, if known.
+	revision  string
+	osDir     string
+	files     []string
+	data      *TemplateData
+	phoneHome string
+}
+
+// key returns a hash of s but for its template data, which along with
+// the files read and the fields of the data they reference identifies a
+// render.
+func (s *source) key() string {
+	b, _ := json.Marshal(struct {
+		OSDir     string
+		Files     []string
+		PhoneHome string
+	}{s.osDir, s.files, s.phoneHome})
+	return hashBytes(b)
+}
+
+// source returns the source of the config of host. r is nil when
+// rendering outside of a request, which is never for a pinned machine.
+func (h *Handler) source(r *http.Request, osname, host string) (*source, error) {
+	root, revision := h.ConfigRoot, h.Revision
+	if r != nil && h.Pinned != nil && r.URL.Query().Get("mac") != "" {
+		pinned, pinnedRevision, err := h.Pinned(r.URL.Query().Get("mac"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading pinned config revision: %w", err)
+		}
+		if pinned != "" {
+			root, revision = pinned, pinnedRevision
+		}
+	}
+	osDir, err := osDir(root, osname)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(osDir, host, "host.yaml")); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("invalid host %q: %w", host, ErrNotFound)
+	}
+	src := &source{
+		osname:   osname,
+		host:     host,
+		revision: revision,
+		osDir:    osDir,
+		files:    []string{"base/base.yaml"},
+		data:     h.templateData(r, osname, host),
+	}
+	if h.Includes != nil {
+		src.files = append(src.files, h.Includes(osname, host, src.data.Request.MAC)...)
+	}
+	src.files = append(src.files, filepath.Join(host, "host.yaml"))
+	if h.PhoneHome != nil {
+		src.phoneHome = h.PhoneHome(r, host)
+	}
+	return src, nil
+}
+
+// merge returns the merged Butane config of src, before secrets are
+// resolved, tracing where each value was set when trace is true.
+func (h *Handler) merge(src *source, trace bool) (*merge, error) {
+	merge := &merge{
+		base: src.osDir,
+		pathKeys: []string{
+			".local",
+			".contents_local",
+			".ssh_authorized_keys_local",
+		},
+		data:   src.data,
+		fields: make(map[string]bool),
+	}
+	if trace {
+		merge.trace = make(map[string][]Layer)
 	}
-	if err := m.mergeObjects(m.config, config, "$"); err != nil {
-		return fmt.Errorf("error during merge[%s]: %w", path, err)
+	if err := merge.mergeFiles(src.files...); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	if src.phoneHome != "" {
+		if err := addPhoneHome(merge.config, src.phoneHome); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return merge, nil
 }
 
-func (m *merge) resolvePathsObject(object map[string]any, relpath, ctxpath string) {
-	for k, v := range object {
-		cpath := ctxpath + "." + k
-		if vv, ok := m.resolvePathsValue(v, relpath, cpath); ok {
-			object[k] = vv
+// templateData returns the data the Butane files of host are executed
+// with. r is nil when rendering outside of a request.
+func (h *Handler) templateData(r *http.Request, osname, host string) *TemplateData {
+	data := &TemplateData{OS: osname, Config: host, Hostname: host}
+	if r != nil {
+		data.Request.MAC = r.URL.Query().Get("mac")
+		data.Request.RemoteIP = h.clientIP(r)
+	}
+	data.MAC = data.Request.MAC
+	if h.Host == nil {
+		return data
+	}
+	ih, vars := h.Host(osname, host, data.Request.MAC)
+	data.Vars = vars
+	if ih != nil {
+		data.Hostname = ih.Name
+		data.MACs = ih.MACs
+		data.UUID = ih.UUID
+		data.IPs = ih.IPs
+		data.Groups = ih.Groups
+		if data.MAC == "" && len(ih.MACs) > 0 {
+			data.MAC = ih.MACs[0]
 		}
 	}
+	return data
 }
 
-func (m *merge) resolvePathsValue(v any, relpath, ctxpath string) (any, bool) {
-	log.Printf("File[%s] ContextPath: %s", relpath, ctxpath)
-	switch v := v.(type) {
-	case []any:
-		var updated []any
-		for _, vi := range v {
-			if upv, ok := m.resolvePathsValue(vi, relpath, ctxpath); ok {
-				updated = append(updated, upv)
-			}
+// Render returns the Ignition JSON for host, translated from the Butane
+// returned by Butane with its secret references resolved. Renders are
+// cached until one of the files or secrets they were rendered from, or
+// the template data they reference, changes; secrets are read again at
+// most every secretsTTL. When a render fails, the last good one is
+// returned instead.
+func (h *Handler) Render(osname, host string) ([]byte, error) {
+	src, err := h.source(nil, osname, host)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := h.render(context.Background(), src)
+	return data, err
+}
+
+// render returns the Ignition JSON for host. When the render fails but an
+// earlier one for the same source succeeded, it returns that one along
+// with the failure as stale.
+func (h *Handler) render(ctx context.Context, src *source) (data []byte, stale, err error) {
+	base := src.osname + "/" + src.host + "@" + src.key()
+	var key string
+	if fields, ok := h.cache.fields(base); ok {
+		key = renderKey(base, src.data, fields)
+		if data, ok := h.cache.lookup(ctx, key, h.Secrets); ok {
+			return data, nil, nil
 		}
-		// only return true if all values in v were updated
-		return updated, len(updated) == len(v)
+	}
+	out, err := h.translate(ctx, src, h.Secrets)
+	if err != nil {
+		last := h.cache.last(key)
+		if last == nil {
+			return nil, nil, err
+		}
+		slog.Warn("Serving last good Ignition", "osname", src.osname, "host", src.host, "err", err)
+		metrics.IgnitionRenderFailures.WithLabelValues(src.osname, src.host).Inc()
+		return last, err, nil
+	}
+	h.cache.store(base, renderKey(base, src.data, out.fields), out)
+	return out.data, nil, nil
+}
 
-	case map[string]any:
-		m.resolvePathsObject(v, relpath, ctxpath)
+// renderKey returns the cache key of the render of the source with key
+// base whose files reference the given fields of data.
+func renderKey(base string, data *TemplateData, fields []string) string {
+	return base + "/" + hashBytes(fieldValues(data, fields))
+}
+
+// rendered is a translated config and what it was rendered from.
+type rendered struct {
+	data []byte
+	// inputs are the absolute paths of the files it was rendered from.
+	inputs []string
+	// secrets holds the hash of each secret it references, by reference.
+	secrets map[string]string
+	// fields are the fields of the template data it references (see
+	// templateFields).
+	fields []string
+}
+
+// translate renders src with the secrets of b.
+func (h *Handler) translate(ctx context.Context, src *source, b secrets.Backend) (*rendered, error) {
+	merge, err := h.merge(src, false)
+	if err != nil {
+		return nil, err
+	}
+	out := &rendered{secrets: make(map[string]string)}
+	for _, f := range merge.inputs() {
+		out.inputs = append(out.inputs, filepath.Join(src.osDir, f))
+	}
+	for f := range merge.fields {
+		out.fields = append(out.fields, f)
+	}
+	sort.Strings(out.fields)
+	if b != nil {
+		b = &hashingBackend{Backend: b, sums: out.secrets}
+	}
+	if _, err := resolveSecrets(ctx, b, merge.config, "$"); err != nil {
+		return nil, err
+	}
+	butaneData, err := yaml.Marshal(merge.config)
+	if err != nil {
+		return nil, err
+	}
+	data, report, err := config.TranslateBytes(butaneData, common.TranslateBytesOptions{
+		TranslateOptions: common.TranslateOptions{
+			FilesDir: src.osDir,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error during translate: %w\n%s", err, report.String())
+	}
+	out.data = data
+	return out, nil
+}
 
-	case string:
-		if m.isRelativePath(ctxpath) {
-			vv := filepath.Join(filepath.Dir(relpath), v)
-			log.Printf("\t Update[%s] %s -> %s", ctxpath, v, vv)
-			return vv, true
+// OSNames returns the names of the directories in ConfigRoot that hold a
+// "base/base.yaml".
+func (h *Handler) OSNames() ([]string, error) {
+	entries, err := os.ReadDir(h.ConfigRoot)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(h.ConfigRoot, e.Name(), "base", "base.yaml")); err == nil {
+			names = append(names, e.Name())
 		}
 	}
-	return nil, false
+	return names, nil
 }
 
-func (m *merge) isRelativePath(contextPath string) bool {
-	for _, key := range m.pathKeys {
-		if strings.HasPrefix(key, ".") && strings.HasSuffix(contextPath, key) {
-			return true
+// Hosts returns the names of the hosts configured for osname, which is
+// every directory other than "base" that holds a "host.yaml".
+func (h *Handler) Hosts(osname string) ([]string, error) {
+	osDir, err := osDir(h.ConfigRoot, osname)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(osDir)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == "base" {
+			continue
 		}
-		if key == contextPath {
-			return true
+		if _, err := os.Stat(filepath.Join(osDir, e.Name(), "host.yaml")); err == nil {
+			hosts = append(hosts, e.Name())
 		}
 	}
-	return false
-}
-
-func (m *merge) mergeObjects(dst, src map[string]any, path string) error {
-	for key, sv := range src {
-		cpath := path + "." + key
-		switch sv := sv.(type) {
-		case []any:
-			dv, exists := dst[key]
-			dvv, isSlice := dv.([]any) // if exists=false, then dv=nil and isSlice=false
-			switch {
-			case !exists:
-				dst[key] = sv
-
-			case exists && isSlice:
-				if m.append {
-					// If both are slices - copy from one slice to the other
-					sv = append(dvv, sv...)
-				}
-				dst[key] = sv
-
-			case exists && !isSlice:
-				return fmt.Errorf("key[%s] mismatch: src(%T) vs dst(%T)", cpath, sv, dv)
-
-			case exists && !m.overwrite:
-				return fmt.Errorf("key[%s] duplicated (overrwrite=false)", cpath)
-			}
-
-		case map[string]any:
-			dv, exists := dst[key]
-			dvv, isMap := dv.(map[string]any) // if exists=false, then dv=nil and isMap=false
-			switch {
-			case !exists:
-				// Dest Missing
-				dv := make(map[string]any)
-				dst[key] = dv
-				err := m.mergeObjects(dv, sv, cpath)
-				if err != nil {
-					return err
-				}
-			case isMap:
-				// Dest Merge
-				err := m.mergeObjects(dvv, sv, cpath)
-				if err != nil {
-					return err
-				}
-			default:
-				// Dest type mismatch
-				return fmt.Errorf("key[%s] mismatch: src(%T) vs dst(%T)", cpath, sv, dv)
-			}
+	return hosts, nil
+}
 
-		default:
-			dv, ok := dst[key]
-			switch {
-			case ok && reflect.DeepEqual(sv, dv):
-				continue
-			case ok && !m.overwrite:
-				return fmt.Errorf("duplicate Keys(overrwrite=false): %s", cpath)
-			default:
-				dst[key] = sv
-			}
+func osDir(root, osname string) (string, error) {
+	osDir := filepath.Join(root, osname)
+	if _, err := os.Stat(osDir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("invalid osname %q: %w", osname, ErrNotFound)
 		}
+		return "", fmt.Errorf("error reading source config ConfigRoot: %w", err)
 	}
-	return nil
+	return osDir, nil
 }
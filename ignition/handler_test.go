@@ -2,9 +2,12 @@ package ignition
 
 import (
 	"github.com/clarketm/json"
+	"github.com/nveeser/corepxe/secrets"
+	"github.com/nveeser/corepxe/token"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +31,150 @@ func TestIgnitionHandler(t *testing.T) {
 	}
 	t.Logf("Got: %+v", m)
 }
+
+func TestIgnitionHandlerToken(t *testing.T) {
+	signer := &token.Signer{
+		Key:    []byte("0123456789abcdef0123456789abcdef"),
+		BindIP: true,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /configs/{osname}/{name}", &Handler{
+		ConfigRoot: filepath.Join("./testdir"),
+		Tokens:     signer,
+	})
+	tok, err := signer.Sign("standard", "192.0.2.1", "")
+	if err != nil {
+		t.Fatalf("Sign() got err %s", err)
+	}
+	cases := []struct {
+		name   string
+		target string
+		remote string
+		want   int
+	}{
+		{name: "no token", target: "/configs/coreos/standard", want: http.StatusForbidden},
+		{name: "bad token", target: "/configs/coreos/standard?token=bad", want: http.StatusForbidden},
+		{name: "wrong ip", target: "/configs/coreos/standard?token=" + tok, remote: "192.0.2.2:1234", want: http.StatusForbidden},
+		{name: "ok", target: "/configs/coreos/standard?token=" + tok, want: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.target, nil)
+			if tc.remote != "" {
+				r.RemoteAddr = tc.remote
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got status %d wanted %d", w.Code, tc.want)
+				t.Logf("Body:\n %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestIgnitionHandlerPhoneHome(t *testing.T) {
+	h := &Handler{
+		ConfigRoot: filepath.Join("./testdir"),
+		PhoneHome: func(r *http.Request, host string) string {
+			return "https://pxe.example.com/phonehome/" + host
+		},
+	}
+	data, err := h.Render("coreos", "standard")
+	if err != nil {
+		t.Fatalf("Render() got err %s", err)
+	}
+	var cfg struct {
+		Storage struct {
+			Files []struct{ Path string }
+		}
+		Systemd struct {
+			Units []struct {
+				Name    string
+				Enabled bool
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("json.Unmarshal() got err %s", err)
+	}
+	var paths []string
+	for _, f := range cfg.Storage.Files {
+		paths = append(paths, f.Path)
+	}
+	if len(paths) != 3 || paths[2] != PhoneHomeScript {
+		t.Errorf("files got %v wanted base files and %s", paths, PhoneHomeScript)
+	}
+	if len(cfg.Systemd.Units) != 1 || cfg.Systemd.Units[0].Name != PhoneHomeUnit || !cfg.Systemd.Units[0].Enabled {
+		t.Errorf("units got %+v wanted enabled %s", cfg.Systemd.Units, PhoneHomeUnit)
+	}
+}
+
+func TestIgnitionHandlerSecrets(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"coreos/base/base.yaml": "variant: fcos\nversion: 1.5.0\n",
+		"coreos/node1/host.yaml": `
+passwd:
+  users:
+    - name: core
+      password_hash: {secret: users/core}
+storage:
+  files:
+    - path: /etc/kubernetes/join-token
+      contents: {secret: k8s/join-token}
+`,
+		"coreos/node2/host.yaml": `
+storage:
+  files:
+    - path: /etc/missing
+      contents: {secret: missing}
+`,
+	})
+	t.Setenv("TEST_SECRET_USERS_CORE", "$y$hash")
+	t.Setenv("TEST_SECRET_K8S_JOIN_TOKEN", "abcdef.0123456789abcdef")
+	mux := http.NewServeMux()
+	mux.Handle("GET /configs/{osname}/{name}", &Handler{
+		ConfigRoot: dir,
+		Secrets:    &secrets.Env{Prefix: "TEST_SECRET_"},
+	})
+	get := func(target string) (int, string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/configs/coreos/node1")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	var cfg struct {
+		Passwd struct {
+			Users []struct {
+				PasswordHash string `json:"passwordHash"`
+			}
+		}
+		Storage struct {
+			Files []struct {
+				Contents struct{ Source string }
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("json.Unmarshal() got err %s", err)
+	}
+	if cfg.Passwd.Users[0].PasswordHash != "$y$hash" {
+		t.Errorf("passwordHash got %q", cfg.Passwd.Users[0].PasswordHash)
+	}
+	if src := cfg.Storage.Files[0].Contents.Source; !strings.Contains(src, "abcdef.0123456789abcdef") {
+		t.Errorf("join-token source got %q wanted the secret", src)
+	}
+
+	code, body = get("/configs/coreos/node1?debug")
+	if code != http.StatusOK || strings.Contains(body, "abcdef") || strings.Contains(body, "$y$hash") || !strings.Contains(body, "secret: k8s/join-token") {
+		t.Errorf("debug got status %d and\n%s\nwanted the references but not the secrets", code, body)
+	}
+	if code, body := get("/configs/coreos/node2"); code != http.StatusInternalServerError || !strings.Contains(body, "secret not found: missing") {
+		t.Errorf("missing secret got status %d: %s", code, body)
+	}
+}
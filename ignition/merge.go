@@ -0,0 +1,373 @@
+package ignition
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// merge merges Butane files. Objects are merged recursively and the
+// entries of the keyed lists of listKeys by key; the Policy of each file
+// decides how other values are merged.
+type merge struct {
+	base     string
+	config   map[string]any
+	pathKeys []string
+	// data, when set, is the data files are executed with as templates.
+	data *TemplateData
+	// fields, when set, collects the fields of data the files reference
+	// (see templateFields).
+	fields map[string]bool
+	// locals holds the local files referenced, relative to base.
+	locals []string
+	// policies holds the merge policy of each file merged so far.
+	policies layerPolicies
+	// trace, when set, collects the values each file sets, by path (see
+	// Provenance).
+	trace map[string][]Layer
+
+	// merged holds the files merged so far, and including the chain of
+	// files whose includes are being merged.
+	merged    map[string]bool
+	including []string
+}
+
+// includesKey is the top level key of a Butane file listing the files,
+// relative to it, merged before it.
+const includesKey = "includes"
+
+// inputs returns the files the merged config was built from, the merged
+// files and the local files they reference, relative to base.
+func (m *merge) inputs() []string {
+	var files []string
+	for f := range m.merged {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return append(files, m.locals...)
+}
+
+func (m *merge) Merge(path ...string) ([]byte, error) {
+	if err := m.mergeFiles(path...); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(m.config)
+}
+
+func (m *merge) mergeFiles(path ...string) error {
+	for _, f := range path {
+		if err := m.mergeFile(f); err != nil {
+			return fmt.Errorf("file[%s]: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// mergeFile merges the file at path, relative to base, after the files
+// it includes. A file is merged only once, however often it is included.
+func (m *merge) mergeFile(path string) error {
+	path = filepath.Clean(path)
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("file[%s] is outside of the config directory", path)
+	}
+	for i, p := range m.including {
+		if p == path {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(m.including[i:], path), " -> "))
+		}
+	}
+	if m.merged[path] {
+		return nil
+	}
+
+	d, err := os.ReadFile(filepath.Join(m.base, path))
+	if err != nil {
+		return fmt.Errorf("error file[%s]: %w", path, err)
+	}
+	if m.data != nil {
+		if d, err = renderTemplate(path, d, m.data, m.fields); err != nil {
+			return err
+		}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(d, &doc); err != nil {
+		return fmt.Errorf("error reading yaml[%s]: %w", path, err)
+	}
+	v, err := decodeNode(&doc)
+	if err != nil {
+		return fmt.Errorf("error reading yaml: %w", err)
+	}
+	config, ok := v.(map[string]any)
+	if v != nil && !ok {
+		return fmt.Errorf("error reading yaml: wanted an object got %T", v)
+	}
+	if config == nil {
+		config = map[string]any{}
+	}
+
+	includes, err := takeIncludes(config)
+	if err != nil {
+		return fmt.Errorf("file[%s]: %w", path, err)
+	}
+	policy, err := takePolicy(config)
+	if err != nil {
+		return fmt.Errorf("file[%s]: %w", path, err)
+	}
+	m.including = append(m.including, path)
+	for _, inc := range includes {
+		incPath := filepath.Join(filepath.Dir(path), inc)
+		if err := m.mergeFile(incPath); err != nil {
+			return fmt.Errorf("include[%s]: %w", incPath, err)
+		}
+	}
+	m.including = m.including[:len(m.including)-1]
+	if m.merged == nil {
+		m.merged = make(map[string]bool)
+	}
+	m.merged[path] = true
+	m.policies = append(m.policies, policy)
+
+	m.resolvePathsObject(config, path, "$")
+	if m.trace != nil {
+		leaves(config, &doc, nil, "$", func(p string, v any, n, _ *yaml.Node) {
+			m.trace[p] = append(m.trace[p], Layer{File: path, Line: n.Line, Value: clean(v)})
+		})
+	}
+
+	if m.config == nil {
+		m.config = clean(config).(map[string]any)
+		return nil
+	}
+	if err := m.mergeObjects(m.config, config, "$", m.policies); err != nil {
+		return fmt.Errorf("error during merge[%s]: %w", path, err)
+	}
+	return nil
+}
+
+// takeIncludes removes includesKey from config and returns its value.
+func takeIncludes(config map[string]any) ([]string, error) {
+	v, ok := config[includesKey]
+	if !ok {
+		return nil, nil
+	}
+	delete(config, includesKey)
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("key[$.%s] mismatch: wanted list got %T", includesKey, v)
+	}
+	var includes []string
+	for _, item := range list {
+		inc, ok := item.(string)
+		if !ok || inc == "" {
+			return nil, fmt.Errorf("key[$.%s] holds %v, wanted a path", includesKey, item)
+		}
+		includes = append(includes, inc)
+	}
+	return includes, nil
+}
+
+func (m *merge) resolvePathsObject(object map[string]any, relpath, ctxpath string) {
+	for k, v := range object {
+		cpath := ctxpath + "." + k
+		if vv, ok := m.resolvePathsValue(v, relpath, cpath); ok {
+			object[k] = vv
+		}
+	}
+}
+
+func (m *merge) resolvePathsValue(v any, relpath, ctxpath string) (any, bool) {
+	switch v := v.(type) {
+	case []any:
+		var updated []any
+		for _, vi := range v {
+			if upv, ok := m.resolvePathsValue(vi, relpath, ctxpath); ok {
+				updated = append(updated, upv)
+			}
+		}
+		// only return true if all values in v were updated
+		return updated, len(updated) == len(v)
+
+	case map[string]any:
+		m.resolvePathsObject(v, relpath, ctxpath)
+
+	case *replaced:
+		if vv, ok := m.resolvePathsValue(v.value, relpath, ctxpath); ok {
+			v.value = vv
+		}
+
+	case string:
+		if m.isRelativePath(ctxpath) {
+			vv := filepath.Join(filepath.Dir(relpath), v)
+			m.locals = append(m.locals, vv)
+			slog.Debug("Resolved relative path", "file", relpath, "key", ctxpath, "from", v, "to", vv)
+			return vv, true
+		}
+	}
+	return nil, false
+}
+
+func (m *merge) isRelativePath(contextPath string) bool {
+	for _, key := range m.pathKeys {
+		if strings.HasPrefix(key, ".") && strings.HasSuffix(contextPath, key) {
+			return true
+		}
+		if key == contextPath {
+			return true
+		}
+	}
+	return false
+}
+
+// listKeys names the field identifying the entries of the keyed lists of
+// a Butane config, by the path of the list. "[]" stands for any entry of
+// a list.
+var listKeys = map[string]string{
+	"$.passwd.users":            "name",
+	"$.passwd.groups":           "name",
+	"$.storage.disks":           "device",
+	"$.storage.raid":            "name",
+	"$.storage.filesystems":     "device",
+	"$.storage.luks":            "name",
+	"$.storage.files":           "path",
+	"$.storage.directories":     "path",
+	"$.storage.links":           "path",
+	"$.systemd.units":           "name",
+	"$.systemd.units[].dropins": "name",
+}
+
+// entryIndex matches the entry part of a path, e.g. "[/etc/hosts]".
+var entryIndex = regexp.MustCompile(`\[[^\]]*\]`)
+
+// listKey returns the field identifying the entries of the list at path,
+// or "" when the list is not keyed.
+func listKey(path string) string {
+	return listKeys[entryIndex.ReplaceAllString(path, "[]")]
+}
+
+// mergeObjects merges src into dst with the strictest of policies.
+func (m *merge) mergeObjects(dst, src map[string]any, path string, policy layerPolicies) error {
+	for key, sv := range src {
+		cpath := path + "." + key
+		dv, exists := dst[key]
+		if sv == deleteMarker {
+			delete(dst, key)
+			continue
+		}
+		if r, ok := sv.(*replaced); ok || !exists {
+			// Replace Dest, or Dest Missing
+			if ok {
+				sv = r.value
+			}
+			dst[key] = clean(sv)
+			continue
+		}
+		switch sv := sv.(type) {
+		case []any:
+			dvv, isSlice := dv.([]any)
+			if !isSlice {
+				return fmt.Errorf("key[%s] mismatch: src(%T) vs dst(%T)", cpath, sv, dv)
+			}
+			if field := listKey(cpath); field != "" {
+				merged, err := m.mergeKeyed(dvv, sv, cpath, field, policy)
+				if err != nil {
+					return err
+				}
+				dst[key] = merged
+				continue
+			}
+			switch policy.at(cpath) {
+			case PolicyStrict:
+				if !reflect.DeepEqual(dvv, clean(sv)) {
+					return fmt.Errorf("key[%s] duplicated (policy %s)", cpath, PolicyStrict)
+				}
+			case PolicyAppend:
+				for _, item := range clean(sv).([]any) {
+					if !containsValue(dvv, item) {
+						dvv = append(dvv, item)
+					}
+				}
+				dst[key] = dvv
+			default:
+				dst[key] = clean(sv)
+			}
+
+		case map[string]any:
+			dvv, isMap := dv.(map[string]any)
+			if !isMap {
+				// Dest type mismatch
+				return fmt.Errorf("key[%s] mismatch: src(%T) vs dst(%T)", cpath, sv, dv)
+			}
+			// Dest Merge
+			if err := m.mergeObjects(dvv, sv, cpath, policy); err != nil {
+				return err
+			}
+
+		default:
+			switch {
+			case reflect.DeepEqual(sv, dv):
+				continue
+			case policy.at(cpath) == PolicyStrict:
+				return fmt.Errorf("key[%s] duplicated (policy %s)", cpath, PolicyStrict)
+			default:
+				dst[key] = sv
+			}
+		}
+	}
+	return nil
+}
+
+// mergeKeyed merges the keyed list src into dst: an entry of src with
+// the same field as an entry of dst is merged into it, or with
+// deleteMarker removes it, and other entries are appended.
+func (m *merge) mergeKeyed(dst, src []any, path, field string, policy layerPolicies) ([]any, error) {
+	index := func(k string) int {
+		for i, dv := range dst {
+			if entry, ok := dv.(map[string]any); ok && entry[field] == k {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, sv := range src {
+		entry, ok := sv.(map[string]any)
+		if !ok {
+			dst = append(dst, clean(sv))
+			continue
+		}
+		k, ok := entry[field].(string)
+		if !ok {
+			dst = append(dst, clean(sv))
+			continue
+		}
+		i := index(k)
+		switch {
+		case isDeleted(entry):
+			if i >= 0 {
+				dst = append(dst[:i:i], dst[i+1:]...)
+			}
+		case i >= 0:
+			if err := m.mergeObjects(dst[i].(map[string]any), entry, path+"["+k+"]", policy); err != nil {
+				return nil, err
+			}
+		default:
+			dst = append(dst, clean(entry))
+		}
+	}
+	return dst, nil
+}
+
+// containsValue reports whether list holds an item equal to v.
+func containsValue(list []any, v any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
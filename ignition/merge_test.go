@@ -0,0 +1,330 @@
+package ignition
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by path relative to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMergeKeyedLists(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, data string) {
+		t.Helper()
+		writeFiles(t, dir, map[string]string{name: data})
+	}
+	writeFile("base/base.yaml", `
+variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: core
+      groups: [wheel]
+storage:
+  files:
+    - path: /etc/hostname
+      mode: 0644
+      contents: {inline: base}
+    - path: /etc/motd
+      contents: {inline: hello}
+systemd:
+  units:
+    - name: a.service
+      enabled: true
+      dropins:
+        - name: 10-base.conf
+          contents: base
+`)
+	writeFile("node1/host.yaml", `
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [ssh-ed25519 AAAA]
+    - name: admin
+storage:
+  files:
+    - path: /etc/hostname
+      contents: {inline: node1}
+    - path: /etc/issue
+      contents: {inline: welcome}
+systemd:
+  units:
+    - name: a.service
+      enabled: false
+      dropins:
+        - name: 20-host.conf
+          contents: host
+`)
+	m := &merge{base: dir}
+	data, err := m.Merge("base/base.yaml", "node1/host.yaml")
+	if err != nil {
+		t.Fatalf("Merge() got err %s", err)
+	}
+	var got, want map[string]any
+	if err := yaml.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte(`
+variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: core
+      groups: [wheel]
+      ssh_authorized_keys: [ssh-ed25519 AAAA]
+    - name: admin
+storage:
+  files:
+    - path: /etc/hostname
+      mode: 0644
+      contents: {inline: node1}
+    - path: /etc/motd
+      contents: {inline: hello}
+    - path: /etc/issue
+      contents: {inline: welcome}
+systemd:
+  units:
+    - name: a.service
+      enabled: false
+      dropins:
+        - name: 10-base.conf
+          contents: base
+        - name: 20-host.conf
+          contents: host
+`), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() got\n%s", data)
+	}
+
+}
+
+func TestMergePolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"base/base.yaml": `
+variant: fcos
+version: 1.5.0
+kernel_arguments:
+  should_exist: [quiet]
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [key1]
+storage:
+  files:
+    - path: /etc/motd
+    - path: /etc/issue
+systemd:
+  units:
+    - name: a.service
+      enabled: true
+      dropins:
+        - name: 10-base.conf
+`,
+		"node1/host.yaml": `
+merge_policy:
+  default: strict
+  keys:
+    kernel_arguments: overwrite
+    passwd.users.ssh_authorized_keys: append
+kernel_arguments:
+  should_exist: [console=ttyS0]
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [key1, key2]
+storage:
+  files:
+    - path: /etc/motd
+      $delete: true
+systemd:
+  units:
+    - name: a.service
+      enabled: $delete
+      dropins: !replace
+        - name: 20-host.conf
+`,
+		"node2/host.yaml": `
+merge_policy:
+  default: strict
+version: 1.4.0
+`,
+		"node3/host.yaml": `
+merge_policy:
+  keys:
+    passwd.users: strict
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [key3]
+`,
+		"node4/host.yaml": "merge_policy: {default: merge}\n",
+		"groups/locked.yaml": `
+merge_policy:
+  keys:
+    version: strict
+    kernel_arguments: append
+`,
+		"node5/host.yaml": `
+merge_policy:
+  default: overwrite
+version: 1.4.0
+`,
+		"node6/host.yaml": `
+merge_policy:
+  default: overwrite
+kernel_arguments:
+  should_exist: [console=ttyS0]
+`,
+	})
+
+	m := &merge{base: dir}
+	data, err := m.Merge("base/base.yaml", "node1/host.yaml")
+	if err != nil {
+		t.Fatalf("Merge() got err %s", err)
+	}
+	var got, want map[string]any
+	if err := yaml.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte(`
+variant: fcos
+version: 1.5.0
+kernel_arguments:
+  should_exist: [console=ttyS0]
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [key1, key2]
+storage:
+  files:
+    - path: /etc/issue
+systemd:
+  units:
+    - name: a.service
+      dropins:
+        - name: 20-host.conf
+`), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() got\n%s", data)
+	}
+
+	for _, host := range []string{"node2", "node3", "node4"} {
+		m := &merge{base: dir}
+		if _, err := m.Merge("base/base.yaml", host+"/host.yaml"); err == nil {
+			t.Errorf("Merge(%s) got nil err", host)
+		}
+	}
+
+	// A later file cannot loosen the policy of an earlier one.
+	m = &merge{base: dir}
+	if _, err := m.Merge("base/base.yaml", "groups/locked.yaml", "node5/host.yaml"); err == nil {
+		t.Errorf("Merge(node5) overwriting a strict key got nil err")
+	}
+	m = &merge{base: dir}
+	data, err = m.Merge("base/base.yaml", "groups/locked.yaml", "node6/host.yaml")
+	if err != nil {
+		t.Fatalf("Merge(node6) got err %s", err)
+	}
+	if !strings.Contains(string(data), "- quiet\n        - console=ttyS0") {
+		t.Errorf("Merge(node6) got\n%s\nwanted kernel_arguments appended", data)
+	}
+}
+
+func TestMergeIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"base/base.yaml": "variant: fcos\nversion: 1.5.0\n",
+		"dc/east.yaml": `
+storage:
+  files:
+    - path: /etc/dc
+      contents: {local: east.conf}
+`,
+		"roles/k8s-worker.yaml": `
+includes: [../dc/east.yaml, common.yaml]
+storage:
+  files:
+    - path: /etc/role
+      contents: {inline: worker}
+`,
+		"roles/common.yaml": `
+includes: [../dc/east.yaml]
+storage:
+  files:
+    - path: /etc/role
+      contents: {inline: common}
+`,
+		"node1/host.yaml": `
+includes: [../roles/k8s-worker.yaml]
+storage:
+  files:
+    - path: /etc/host
+      contents: {inline: node1}
+`,
+		"loop/a.yaml":      "includes: [b.yaml]\n",
+		"loop/b.yaml":      "includes: [a.yaml]\n",
+		"loop/host.yaml":   "includes: [a.yaml]\n",
+		"escape/host.yaml": "includes: [../../etc/passwd]\n",
+	})
+
+	m := &merge{base: dir, pathKeys: []string{".local"}}
+	data, err := m.Merge("base/base.yaml", "node1/host.yaml")
+	if err != nil {
+		t.Fatalf("Merge() got err %s", err)
+	}
+	var got struct {
+		Storage struct {
+			Files []struct {
+				Path     string
+				Contents map[string]string
+			}
+		}
+	}
+	if err := yaml.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range got.Storage.Files {
+		paths = append(paths, f.Path)
+	}
+	// east.yaml is merged once, before the first file including it.
+	if want := []string{"/etc/dc", "/etc/role", "/etc/host"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("files got %v wanted %v", paths, want)
+	}
+	if f := got.Storage.Files[0]; f.Contents["local"] != "dc/east.conf" {
+		t.Errorf("local of /etc/dc got %q wanted it relative to dc/east.yaml", f.Contents["local"])
+	}
+	if f := got.Storage.Files[1]; f.Contents["inline"] != "worker" {
+		t.Errorf("/etc/role got %q wanted the including file to win", f.Contents["inline"])
+	}
+
+	m = &merge{base: dir}
+	_, err = m.Merge("base/base.yaml", "loop/host.yaml")
+	if err == nil || !strings.Contains(err.Error(), "include cycle: loop/a.yaml -> loop/b.yaml -> loop/a.yaml") {
+		t.Errorf("Merge(cycle) got err %v", err)
+	}
+	m = &merge{base: dir}
+	if _, err := m.Merge("base/base.yaml", "escape/host.yaml"); err == nil {
+		t.Errorf("Merge(include outside the config directory) got nil err")
+	}
+}
@@ -0,0 +1,91 @@
+package ignition
+
+import (
+	"fmt"
+)
+
+// Names of the script and systemd unit added by Handler.PhoneHome.
+const (
+	PhoneHomeScript = "/usr/local/bin/corepxe-phone-home"
+	PhoneHomeUnit   = "corepxe-phone-home.service"
+)
+
+// The script reports the hostname, boot ID, os-release and every MAC
+// address of the machine. The unit runs it once, on the first boot that
+// reaches the network.
+const phoneHomeScript = `#!/bin/sh
+set -eu
+args=""
+for a in /sys/class/net/*/address; do
+  args="$args --data-urlencode mac=$(cat "$a")"
+done
+exec curl -fsS --retry 10 --retry-delay 10 --retry-all-errors \
+  --data-urlencode "hostname=$(hostname)" \
+  --data-urlencode "boot_id@/proc/sys/kernel/random/boot_id" \
+  --data-urlencode "os_release@/etc/os-release" \
+  $args "%s"
+`
+
+const phoneHomeUnit = `[Unit]
+Description=Report first boot to corepxe
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!/var/lib/corepxe-phone-home.done
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=` + PhoneHomeScript + `
+ExecStartPost=/usr/bin/touch /var/lib/corepxe-phone-home.done
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// addPhoneHome adds the phone home script and unit to a merged Butane
+// config, keeping any files and units already there.
+func addPhoneHome(config map[string]any, url string) error {
+	file := map[string]any{
+		"path": PhoneHomeScript,
+		"mode": 0755,
+		"contents": map[string]any{
+			"inline": fmt.Sprintf(phoneHomeScript, url),
+		},
+	}
+	if err := appendList(config, file, "storage", "files"); err != nil {
+		return err
+	}
+	unit := map[string]any{
+		"name":     PhoneHomeUnit,
+		"enabled":  true,
+		"contents": phoneHomeUnit,
+	}
+	return appendList(config, unit, "systemd", "units")
+}
+
+// appendList appends v to the list at path in config, creating the list
+// and any parent objects as needed.
+func appendList(config map[string]any, v any, path ...string) error {
+	obj := config
+	ctx := "$"
+	for _, key := range path[:len(path)-1] {
+		ctx += "." + key
+		next, exists := obj[key]
+		if !exists {
+			next = make(map[string]any)
+			obj[key] = next
+		}
+		m, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("key[%s] mismatch: wanted object got %T", ctx, next)
+		}
+		obj = m
+	}
+	key := path[len(path)-1]
+	list, ok := obj[key].([]any)
+	if obj[key] != nil && !ok {
+		return fmt.Errorf("key[%s.%s] mismatch: wanted list got %T", ctx, key, obj[key])
+	}
+	obj[key] = append(list, v)
+	return nil
+}
@@ -0,0 +1,235 @@
+package ignition
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+)
+
+// Policy says how a Butane file is merged on top of the files before it.
+// Objects are always merged key by key and the keyed lists of listKeys
+// entry by entry; the policy decides what happens to other values both
+// files set. A file cannot loosen the policy of the files before it: a
+// value is merged with the strictest policy any of them sets for it.
+type Policy string
+
+const (
+	// PolicyStrict refuses to change a value: differing scalars, or
+	// differing lists, are an error.
+	PolicyStrict Policy = "strict"
+	// PolicyOverwrite replaces scalars and lists with the later file's.
+	PolicyOverwrite Policy = "overwrite"
+	// PolicyAppend replaces scalars and appends the items of lists that
+	// are not already there.
+	PolicyAppend Policy = "append"
+)
+
+// DefaultPolicy is the policy of files that do not set one.
+const DefaultPolicy = PolicyOverwrite
+
+func (p Policy) valid() bool {
+	return p == PolicyStrict || p == PolicyOverwrite || p == PolicyAppend
+}
+
+// strictness orders policies by how much of the earlier files' values
+// they keep.
+func (p Policy) strictness() int {
+	switch p {
+	case PolicyStrict:
+		return 2
+	case PolicyAppend:
+		return 1
+	}
+	return 0
+}
+
+// policyKey is the top level key of a Butane file setting how it is
+// merged:
+//
+//	merge_policy:
+//	  default: strict
+//	  keys:
+//	    storage: overwrite
+//	    passwd.users.ssh_authorized_keys: append
+//
+// Keys are dotted paths into the config, without list entries, and apply
+// to everything below them; the longest matching key wins.
+const policyKey = "merge_policy"
+
+// layerPolicy is the merge policy of one file.
+type layerPolicy struct {
+	Default Policy            `yaml:"default"`
+	Keys    map[string]Policy `yaml:"keys"`
+}
+
+// at returns the policy for the value at path, e.g.
+// "$.passwd.users[core].ssh_authorized_keys".
+func (lp *layerPolicy) at(path string) Policy {
+	key := strings.TrimPrefix(entryIndex.ReplaceAllString(path, ""), "$.")
+	best, policy := -1, lp.Default
+	for k, p := range lp.Keys {
+		if (key == k || strings.HasPrefix(key, k+".")) && len(k) > best {
+			best, policy = len(k), p
+		}
+	}
+	if policy == "" {
+		return DefaultPolicy
+	}
+	return policy
+}
+
+// layerPolicies are the merge policies of the files merged so far.
+type layerPolicies []*layerPolicy
+
+// at returns the strictest of the policies for the value at path.
+func (lps layerPolicies) at(path string) Policy {
+	policy := DefaultPolicy
+	for _, lp := range lps {
+		if p := lp.at(path); p.strictness() > policy.strictness() {
+			policy = p
+		}
+	}
+	return policy
+}
+
+// takePolicy removes policyKey from config and returns the policy it
+// sets.
+func takePolicy(config map[string]any) (*layerPolicy, error) {
+	lp := &layerPolicy{}
+	v, ok := config[policyKey]
+	if !ok {
+		return lp, nil
+	}
+	delete(config, policyKey)
+	data, err := yaml.Marshal(clean(v))
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(lp); err != nil {
+		return nil, fmt.Errorf("key[$.%s]: %w", policyKey, err)
+	}
+	if lp.Default != "" && !lp.Default.valid() {
+		return nil, fmt.Errorf("key[$.%s.default]: invalid policy %q", policyKey, lp.Default)
+	}
+	keys := make([]string, 0, len(lp.Keys))
+	for k := range lp.Keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !lp.Keys[k].valid() {
+			return nil, fmt.Errorf("key[$.%s.keys.%s]: invalid policy %q", policyKey, k, lp.Keys[k])
+		}
+	}
+	return lp, nil
+}
+
+// Directives of a Butane file that change what it inherits.
+const (
+	// replaceTag marks a value that replaces the inherited one rather
+	// than being merged into it, e.g. "users: !replace [...]".
+	replaceTag = "!replace"
+	// deleteMarker as the value of a key removes the inherited key, and
+	// as a key set to true in an entry of a keyed list removes the
+	// inherited entry, e.g. "{path: /etc/motd, $delete: true}".
+	deleteMarker = "$delete"
+)
+
+// replaced is a value tagged with replaceTag.
+type replaced struct {
+	value any
+}
+
+// decodeNode converts a YAML node into maps, lists and scalars like
+// yaml.Unmarshal does, keeping values tagged with replaceTag as
+// *replaced.
+func decodeNode(n *yaml.Node) (any, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return decodeNode(n.Content[0])
+	case yaml.AliasNode:
+		return decodeNode(n.Alias)
+	}
+	if n.Tag == replaceTag {
+		untagged := *n
+		untagged.Tag = ""
+		v, err := decodeNode(&untagged)
+		if err != nil {
+			return nil, err
+		}
+		return &replaced{v}, nil
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		m := make(map[string]any)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			var key string
+			if err := n.Content[i].Decode(&key); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n.Content[i].Line, err)
+			}
+			v, err := decodeNode(n.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		list := make([]any, 0, len(n.Content))
+		for _, item := range n.Content {
+			v, err := decodeNode(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	default:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		return v, nil
+	}
+}
+
+// clean returns v without directives: replaced values are unwrapped,
+// and deleted keys and entries dropped.
+func clean(v any) any {
+	switch v := v.(type) {
+	case *replaced:
+		return clean(v.value)
+	case map[string]any:
+		for k, vv := range v {
+			if vv == deleteMarker {
+				delete(v, k)
+				continue
+			}
+			v[k] = clean(vv)
+		}
+		return v
+	case []any:
+		list := v[:0]
+		for _, item := range v {
+			if isDeleted(item) {
+				continue
+			}
+			list = append(list, clean(item))
+		}
+		return list
+	}
+	return v
+}
+
+// isDeleted reports whether v is a list entry marked with deleteMarker.
+func isDeleted(v any) bool {
+	entry, ok := v.(map[string]any)
+	return ok && entry[deleteMarker] == true
+}
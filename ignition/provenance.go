@@ -0,0 +1,177 @@
+package ignition
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+// Provenance tells where each value of a merged Butane config was set.
+type Provenance struct {
+	// Keys holds every leaf of the config, in the order it is marshaled.
+	Keys []Key `json:"keys"`
+
+	config map[string]any
+}
+
+// Key is a leaf of a merged Butane config: a scalar, or a list other than
+// a keyed one (see listKeys).
+type Key struct {
+	// Path is the path of the key, e.g. "$.systemd.units[kubelet.service].enabled".
+	// The entries of keyed lists are named by their key.
+	Path string `json:"path"`
+	// Layer is the file that set the value. Its File is empty for values
+	// that are generated, e.g. the phone home unit.
+	Layer
+	// Overrode holds the files that set the key before, first to last.
+	Overrode []Layer `json:"overrode,omitempty"`
+	// Locals holds the absolute paths of the local files the value refers
+	// to, e.g. for "contents.local".
+	Locals []string `json:"locals,omitempty"`
+}
+
+// Layer is a value set by a Butane file. Line is a line of the file as
+// executed as a template.
+type Layer struct {
+	File  string `json:"file"`
+	Line  int    `json:"line,omitempty"`
+	Value any    `json:"value"`
+}
+
+func (l Layer) String() string {
+	if l.File == "" {
+		return "generated"
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// Provenance returns where each value of the Butane config returned by
+// Butane was set.
+func (h *Handler) Provenance(osname, host string) (*Provenance, error) {
+	src, err := h.source(nil, osname, host)
+	if err != nil {
+		return nil, err
+	}
+	return h.provenance(src)
+}
+
+func (h *Handler) provenance(src *source) (*Provenance, error) {
+	merge, err := h.merge(src, true)
+	if err != nil {
+		return nil, err
+	}
+	var n yaml.Node
+	if err := n.Encode(merge.config); err != nil {
+		return nil, err
+	}
+	p := &Provenance{config: merge.config}
+	leaves(merge.config, &n, nil, "$", func(path string, v any, _, _ *yaml.Node) {
+		key := Key{Path: path, Layer: Layer{Value: v}}
+		if layers := merge.trace[path]; len(layers) > 0 {
+			key.Layer = layers[len(layers)-1]
+			key.Value = v
+			if len(layers) > 1 {
+				key.Overrode = layers[:len(layers)-1]
+			}
+		}
+		if merge.isRelativePath(path) {
+			switch v := v.(type) {
+			case string:
+				key.Locals = []string{filepath.Join(src.osDir, v)}
+			case []any:
+				for _, item := range v {
+					if s, ok := item.(string); ok {
+						key.Locals = append(key.Locals, filepath.Join(src.osDir, s))
+					}
+				}
+			}
+		}
+		p.Keys = append(p.Keys, key)
+	})
+	return p, nil
+}
+
+// AnnotatedYAML returns the merged Butane config with a comment on each
+// leaf naming the file that set it and the files it overrode.
+func (p *Provenance) AnnotatedYAML() ([]byte, error) {
+	var n yaml.Node
+	if err := n.Encode(p.config); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]Key, len(p.Keys))
+	for _, k := range p.Keys {
+		keys[k.Path] = k
+	}
+	leaves(p.config, &n, nil, "$", func(path string, _ any, n, key *yaml.Node) {
+		k, ok := keys[path]
+		if !ok {
+			return
+		}
+		comment := k.Layer.String()
+		if len(k.Overrode) > 0 {
+			var overrode []string
+			for _, l := range k.Overrode {
+				overrode = append(overrode, l.String())
+			}
+			comment += ", overrode " + strings.Join(overrode, ", ")
+		}
+		if len(k.Locals) > 0 {
+			comment += ", local " + strings.Join(k.Locals, ", ")
+		}
+		if n.Kind == yaml.ScalarNode || key == nil {
+			n.LineComment = comment
+		} else {
+			key.LineComment = comment
+		}
+	})
+	return yaml.Marshal(&n)
+}
+
+// leaves calls fn with each leaf of v, the value decoded from n, its path
+// and the node of its key, if any. v may hold directives: deleted keys
+// and entries are skipped.
+func leaves(v any, n, key *yaml.Node, path string, fn func(path string, v any, n, key *yaml.Node)) {
+	for n.Kind == yaml.DocumentNode || n.Kind == yaml.AliasNode {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+		} else if len(n.Content) > 0 {
+			n = n.Content[0]
+		} else {
+			return
+		}
+	}
+	if r, ok := v.(*replaced); ok {
+		v = r.value
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			vv, ok := v[k]
+			if !ok || vv == deleteMarker {
+				continue
+			}
+			leaves(vv, n.Content[i+1], n.Content[i], path+"."+k, fn)
+		}
+		return
+	case []any:
+		field := listKey(path)
+		if field != "" && n.Kind == yaml.SequenceNode && len(n.Content) == len(v) {
+			for i, item := range v {
+				entry, ok := item.(map[string]any)
+				if !ok || isDeleted(entry) {
+					continue
+				}
+				if k, ok := entry[field].(string); ok {
+					leaves(entry, n.Content[i], nil, path+"["+k+"]", fn)
+				}
+			}
+			return
+		}
+	}
+	fn(path, v, n, key)
+}
@@ -0,0 +1,108 @@
+package ignition
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"coreos/base/base.yaml": `variant: fcos
+version: 1.5.0
+systemd:
+  units:
+    - name: kubelet.service
+      enabled: false
+storage:
+  files:
+    - path: /etc/motd
+      mode: 0644
+      contents:
+        local: motd
+`,
+		"coreos/base/motd": "hello",
+		"coreos/groups/k8s.yaml": `systemd:
+  units:
+    - name: kubelet.service
+      enabled: true
+`,
+		"coreos/node1/host.yaml": `storage:
+  files:
+    - path: /etc/motd
+      mode: 0600
+`,
+	})
+	h := &Handler{
+		ConfigRoot: dir,
+		Includes: func(osname, config, mac string) []string {
+			return []string{"groups/k8s.yaml"}
+		},
+	}
+	p, err := h.Provenance("coreos", "node1")
+	if err != nil {
+		t.Fatalf("Provenance() got err %s", err)
+	}
+	keys := make(map[string]Key)
+	for _, k := range p.Keys {
+		keys[k.Path] = k
+	}
+	want := map[string]Key{
+		"$.systemd.units[kubelet.service].enabled": {
+			Path:     "$.systemd.units[kubelet.service].enabled",
+			Layer:    Layer{File: "groups/k8s.yaml", Line: 4, Value: true},
+			Overrode: []Layer{{File: "base/base.yaml", Line: 6, Value: false}},
+		},
+		"$.storage.files[/etc/motd].mode": {
+			Path:     "$.storage.files[/etc/motd].mode",
+			Layer:    Layer{File: "node1/host.yaml", Line: 4, Value: 0600},
+			Overrode: []Layer{{File: "base/base.yaml", Line: 10, Value: 0644}},
+		},
+		"$.storage.files[/etc/motd].contents.local": {
+			Path:   "$.storage.files[/etc/motd].contents.local",
+			Layer:  Layer{File: "base/base.yaml", Line: 12, Value: "base/motd"},
+			Locals: []string{filepath.Join(dir, "coreos", "base", "motd")},
+		},
+		"$.version": {
+			Path:  "$.version",
+			Layer: Layer{File: "base/base.yaml", Line: 2, Value: "1.5.0"},
+		},
+	}
+	for path, w := range want {
+		if got := keys[path]; !reflect.DeepEqual(got, w) {
+			t.Errorf("key %s got %+v wanted %+v", path, got, w)
+		}
+	}
+
+	annotated, err := p.AnnotatedYAML()
+	if err != nil {
+		t.Fatalf("AnnotatedYAML() got err %s", err)
+	}
+	for _, line := range []string{
+		"enabled: true # groups/k8s.yaml:4, overrode base/base.yaml:6",
+		"mode: 384 # node1/host.yaml:4, overrode base/base.yaml:10",
+	} {
+		if !strings.Contains(string(annotated), line) {
+			t.Errorf("AnnotatedYAML() got\n%s\nwanted a line %q", annotated, line)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /configs/{osname}/{name}", h)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/configs/coreos/node1?debug=provenance", nil))
+	var got Provenance
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got.Keys) != len(p.Keys) {
+		t.Errorf("?debug=provenance got status %d and\n%s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/configs/coreos/node1?debug=annotated", nil))
+	if w.Body.String() != string(annotated) {
+		t.Errorf("?debug=annotated got status %d and\n%s", w.Code, w.Body)
+	}
+}
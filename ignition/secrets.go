@@ -0,0 +1,69 @@
+package ignition
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/secrets"
+	"strings"
+)
+
+// secretKey marks a secret reference in a Butane config. In a resource,
+// e.g. "contents: {secret: k8s/join-token}", it stands for "inline" with
+// the secret; elsewhere "{secret: users/core}" stands for the secret as
+// a string, e.g. as a password_hash.
+const secretKey = "secret"
+
+// resolveSecrets replaces the secret references in v, found at path, with
+// the secrets from b, and returns the result.
+func resolveSecrets(ctx context.Context, b secrets.Backend, v any, path string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if ref, ok := v[secretKey].(string); ok {
+			return resolveSecret(ctx, b, v, ref, path)
+		}
+		for k, vv := range v {
+			resolved, err := resolveSecrets(ctx, b, vv, path+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = resolved
+		}
+	case []any:
+		for i, item := range v {
+			resolved, err := resolveSecrets(ctx, b, item, path+"[]")
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	}
+	return v, nil
+}
+
+func resolveSecret(ctx context.Context, b secrets.Backend, v map[string]any, ref, path string) (any, error) {
+	if b == nil {
+		return nil, fmt.Errorf("key[%s]: secret %s referenced but no secrets backend is configured", path, ref)
+	}
+	value, err := b.Get(ctx, ref)
+	if errors.Is(err, secrets.ErrNotFound) {
+		return nil, fmt.Errorf("key[%s]: %w", path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key[%s]: error reading secret %s: %w", path, ref, err)
+	}
+	if !strings.HasSuffix(path, ".contents") && !strings.HasSuffix(path, ".append[]") {
+		if len(v) != 1 {
+			return nil, fmt.Errorf("key[%s]: a secret reference may not have other keys", path)
+		}
+		return string(value), nil
+	}
+	for _, k := range []string{"inline", "local", "source"} {
+		if _, ok := v[k]; ok {
+			return nil, fmt.Errorf("key[%s]: %s and %s are exclusive", path, secretKey, k)
+		}
+	}
+	delete(v, secretKey)
+	v["inline"] = string(value)
+	return v, nil
+}
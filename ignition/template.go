@@ -0,0 +1,305 @@
+package ignition
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"math/big"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// TemplateData is the data Butane files are executed with as templates.
+type TemplateData struct {
+	// OS and Config name the config being rendered,
+	// "<ConfigRoot>/<OS>/<Config>/host.yaml".
+	OS     string
+	Config string
+	// Hostname is the name of the inventory host, or Config when the
+	// host is not in the inventory.
+	Hostname string
+	// MAC is the MAC address the config was requested for, or the first
+	// of the inventory host's.
+	MAC    string
+	MACs   []string
+	UUID   string
+	IPs    []string
+	Groups []string
+	// Vars are the variables of the host's groups, in order, overridden
+	// by the host's own.
+	Vars map[string]any
+	// Request describes the request for the config; it is empty when
+	// rendering outside of a request.
+	Request RequestInfo
+}
+
+// RequestInfo describes the request for an Ignition config.
+type RequestInfo struct {
+	RemoteIP string
+	// MAC is the "mac" query parameter.
+	MAC string
+}
+
+// templateFuncs are the functions available to Butane templates, in
+// addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	// default returns v, or def when v is empty: {{ .Vars.disk | default "/dev/sda" }}
+	"default": func(def, v any) any {
+		if isEmpty(v) {
+			return def
+		}
+		return v
+	},
+	// join joins the items of a list with sep: {{ join "," .IPs }}
+	"join": func(sep string, list any) (string, error) {
+		v := reflect.ValueOf(list)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return "", fmt.Errorf("join: wanted a list got %T", list)
+		}
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(items, sep), nil
+	},
+	// indent indents every line of s by n spaces.
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	// toYaml encodes v as YAML, without the trailing newline.
+	"toYaml": func(v any) (string, error) {
+		data, err := yaml.Marshal(v)
+		return strings.TrimSuffix(string(data), "\n"), err
+	},
+	"cidrhost":    cidrHost,
+	"cidrnetmask": cidrNetmask,
+	"cidrsubnet":  cidrSubnet,
+	// cidrip returns the address of an interface address like
+	// "10.0.0.5/24".
+	"cidrip": func(s string) (string, error) {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return "", err
+		}
+		return p.Addr().String(), nil
+	},
+}
+
+// renderTemplate executes the Butane file text, named name in errors,
+// with data. When fields is not nil, the fields of data the template
+// references are added to it (see templateFields).
+func renderTemplate(name string, text []byte, data *TemplateData, fields map[string]bool) ([]byte, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil {
+		for _, f := range templateFields(t) {
+			fields[f] = true
+		}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// templateFields returns the fields of TemplateData that t and the
+// templates it defines reference, e.g. "Hostname" or "Request.MAC", or
+// "." when they use the data as a whole. Fields referenced where dot is
+// not the data, e.g. inside "range", are left out: the field dot was set
+// from is referenced already.
+func templateFields(t *template.Template) []string {
+	fields := make(map[string]bool)
+	for _, tt := range t.Templates() {
+		if tt.Tree != nil {
+			walkFields(tt.Tree.Root, true, fields)
+		}
+	}
+	var list []string
+	for f := range fields {
+		list = append(list, f)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// walkFields adds the fields of TemplateData that node references to
+// fields. root is whether dot is the data in node.
+func walkFields(node parse.Node, root bool, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkFields(c, root, fields)
+		}
+	case *parse.ActionNode:
+		walkFields(n.Pipe, root, fields)
+	case *parse.TemplateNode:
+		walkFields(n.Pipe, root, fields)
+	case *parse.IfNode:
+		walkFields(n.Pipe, root, fields)
+		walkFields(n.List, root, fields)
+		walkFields(n.ElseList, root, fields)
+	case *parse.RangeNode:
+		walkFields(n.Pipe, root, fields)
+		walkFields(n.List, false, fields)
+		walkFields(n.ElseList, root, fields)
+	case *parse.WithNode:
+		walkFields(n.Pipe, root, fields)
+		walkFields(n.List, false, fields)
+		walkFields(n.ElseList, root, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkFields(cmd, root, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkFields(arg, root, fields)
+		}
+	case *parse.ChainNode:
+		walkFields(n.Node, root, fields)
+	case *parse.DotNode:
+		if root {
+			fields["."] = true
+		}
+	case *parse.FieldNode:
+		if root {
+			fields[fieldPath(n.Ident)] = true
+		}
+	case *parse.VariableNode:
+		switch {
+		case len(n.Ident) == 1 && n.Ident[0] == "$":
+			fields["."] = true
+		case n.Ident[0] == "$":
+			fields[fieldPath(n.Ident[1:])] = true
+		}
+	}
+}
+
+// fieldPath returns the field of TemplateData that ident, a chain of
+// field names starting at the data, reads. Only the fields of Request
+// are told apart.
+func fieldPath(ident []string) string {
+	if len(ident) > 1 && ident[0] == "Request" {
+		return ident[0] + "." + ident[1]
+	}
+	return ident[0]
+}
+
+// fieldValues returns the values of the given fields of data, as returned
+// by templateFields, as JSON.
+func fieldValues(data *TemplateData, fields []string) []byte {
+	values := make([]any, len(fields))
+	v := reflect.ValueOf(data).Elem()
+	for i, f := range fields {
+		if f == "." {
+			values[i] = data
+			continue
+		}
+		fv := v
+		for _, name := range strings.Split(f, ".") {
+			if fv.Kind() != reflect.Struct {
+				fv = reflect.Value{}
+				break
+			}
+			fv = fv.FieldByName(name)
+		}
+		if fv.IsValid() {
+			values[i] = fv.Interface()
+		}
+	}
+	b, _ := json.Marshal(values)
+	return b
+}
+
+func isEmpty(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+// cidrHost returns the address of host number num in prefix; negative
+// numbers count back from the end: {{ cidrhost "10.0.0.0/24" 5 }} is
+// 10.0.0.5.
+func cidrHost(prefix string, num int) (string, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	p = p.Masked()
+	hostBits := p.Addr().BitLen() - p.Bits()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	n := big.NewInt(int64(num))
+	if num < 0 {
+		n.Add(n, size)
+	}
+	if n.Sign() < 0 || n.Cmp(size) >= 0 {
+		return "", fmt.Errorf("cidrhost: prefix %s has no host number %d", prefix, num)
+	}
+	return addOffset(p.Addr(), n).String(), nil
+}
+
+// cidrNetmask returns the netmask of an IPv4 prefix, e.g. 255.255.255.0.
+func cidrNetmask(prefix string) (string, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	if !p.Addr().Is4() {
+		return "", fmt.Errorf("cidrnetmask: %s is not an IPv4 prefix", prefix)
+	}
+	mask := uint32(0xffffffff) << (32 - p.Bits())
+	if p.Bits() == 0 {
+		mask = 0
+	}
+	return netip.AddrFrom4([4]byte{byte(mask >> 24), byte(mask >> 16), byte(mask >> 8), byte(mask)}).String(), nil
+}
+
+// cidrSubnet returns subnet number num of prefix extended by newBits:
+// {{ cidrsubnet "10.0.0.0/16" 8 2 }} is 10.0.2.0/24.
+func cidrSubnet(prefix string, newBits, num int) (string, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	p = p.Masked()
+	bits := p.Bits() + newBits
+	if newBits < 0 || bits > p.Addr().BitLen() {
+		return "", fmt.Errorf("cidrsubnet: cannot extend %s by %d bits", prefix, newBits)
+	}
+	if num < 0 || big.NewInt(int64(num)).Cmp(new(big.Int).Lsh(big.NewInt(1), uint(newBits))) >= 0 {
+		return "", fmt.Errorf("cidrsubnet: %s extended by %d bits has no subnet number %d", prefix, newBits, num)
+	}
+	offset := new(big.Int).Lsh(big.NewInt(int64(num)), uint(p.Addr().BitLen()-bits))
+	return netip.PrefixFrom(addOffset(p.Addr(), offset), bits).String(), nil
+}
+
+// addOffset returns addr plus n.
+func addOffset(addr netip.Addr, n *big.Int) netip.Addr {
+	b := addr.AsSlice()
+	sum := new(big.Int).Add(new(big.Int).SetBytes(b), n)
+	sum.FillBytes(b)
+	out, _ := netip.AddrFromSlice(b)
+	return out
+}
@@ -0,0 +1,124 @@
+package ignition
+
+import (
+	"github.com/nveeser/corepxe/inventory"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	data := &TemplateData{
+		Hostname: "node1",
+		IPs:      []string{"10.0.0.5", "10.0.0.6"},
+		Vars:     map[string]any{"disk": "/dev/nvme0n1", "dns": []any{"1.1.1.1", "8.8.8.8"}},
+	}
+	cases := []struct {
+		text string
+		want string
+	}{
+		{`{{ .Vars.disk | default "/dev/sda" }}`, "/dev/nvme0n1"},
+		{`{{ .Vars.missing | default "/dev/sda" }}`, "/dev/sda"},
+		{`{{ join "," .IPs }}`, "10.0.0.5,10.0.0.6"},
+		{`{{ join " " .Vars.dns }}`, "1.1.1.1 8.8.8.8"},
+		{`{{ "a\nb" | indent 2 }}`, "  a\n  b"},
+		{`{{ toYaml .Vars.dns }}`, "- 1.1.1.1\n- 8.8.8.8"},
+		{`{{ cidrhost "10.0.0.0/24" 5 }}`, "10.0.0.5"},
+		{`{{ cidrhost "10.0.0.0/24" -2 }}`, "10.0.0.254"},
+		{`{{ cidrhost "fd00::/64" 17 }}`, "fd00::11"},
+		{`{{ cidrnetmask "10.0.0.0/20" }}`, "255.255.240.0"},
+		{`{{ cidrsubnet "10.0.0.0/16" 8 2 }}`, "10.0.2.0/24"},
+		{`{{ cidrip "10.0.0.5/24" }}`, "10.0.0.5"},
+	}
+	for _, tc := range cases {
+		got, err := renderTemplate("test.yaml", []byte(tc.text), data, nil)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("renderTemplate(%s) got %q, %v wanted %q", tc.text, got, err, tc.want)
+		}
+	}
+
+	for _, text := range []string{
+		"a: 1\nb: {{ cidrhost \"10.0.0.0/30\" 4 }}\n",
+		"a: 1\n\nb: {{ .Nope }}\n",
+	} {
+		_, err := renderTemplate("node1/host.yaml", []byte(text), data, nil)
+		if err == nil || !strings.Contains(err.Error(), "node1/host.yaml:") {
+			t.Errorf("renderTemplate(%q) got err %v wanted it to name the file and line", text, err)
+		}
+	}
+}
+
+func TestHandlerTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"coreos/base/base.yaml": "variant: fcos\nversion: 1.5.0\n",
+		"coreos/worker/host.yaml": `
+storage:
+  files:
+    - path: /etc/hostname
+      contents: {inline: "{{ .Hostname }}"}
+    - path: /etc/disk
+      contents: {inline: "{{ .Vars.disk | default "/dev/sda" }} {{ .MAC }}"}
+`,
+	})
+	hosts := map[string]*inventory.Host{
+		"aa:aa:aa:aa:aa:01": {Name: "node1", MACs: []string{"aa:aa:aa:aa:aa:01"}},
+		"aa:aa:aa:aa:aa:02": {Name: "node2", MACs: []string{"aa:aa:aa:aa:aa:02"}, Vars: map[string]any{"disk": "/dev/vda"}},
+	}
+	h := &Handler{
+		ConfigRoot: dir,
+		Host: func(osname, config, mac string) (*inventory.Host, map[string]any) {
+			host := hosts[mac]
+			if host == nil {
+				host = hosts["aa:aa:aa:aa:aa:01"]
+			}
+			return host, host.Vars
+		},
+	}
+	r := httptest.NewRequest("GET", "/configs/coreos/worker?debug&mac=aa:aa:aa:aa:aa:02", nil)
+	src, err := h.source(r, "coreos", "worker")
+	if err != nil {
+		t.Fatalf("source() got err %s", err)
+	}
+	data, err := h.butane(src)
+	if err != nil {
+		t.Fatalf("butane() got err %s", err)
+	}
+	for _, want := range []string{"inline: node2", "inline: /dev/vda aa:aa:aa:aa:aa:02"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("butane() got\n%s\nwanted it to contain %q", data, want)
+		}
+	}
+	data, err = h.Butane("coreos", "worker")
+	if err != nil {
+		t.Fatalf("Butane() got err %s", err)
+	}
+	if !strings.Contains(string(data), "inline: /dev/sda aa:aa:aa:aa:aa:01") {
+		t.Errorf("Butane() got\n%s\nwanted the defaults of node1", data)
+	}
+}
+
+func TestTemplateFields(t *testing.T) {
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{"a: {{ .Hostname }}", []string{"Hostname"}},
+		{"a: {{ .Request.MAC }} {{ $.Vars.disk | default \"/dev/sda\" }}", []string{"Request.MAC", "Vars"}},
+		{"{{ range .IPs }}- {{ . }}{{ end }}{{ with .Request }}{{ .RemoteIP }}{{ end }}", []string{"IPs", "Request"}},
+		{"{{ toYaml . }}", []string{"."}},
+		{"{{ define \"x\" }}{{ .UUID }}{{ end }}{{ template \"x\" . }}", []string{".", "UUID"}},
+		{"a: 1", nil},
+	}
+	for _, tc := range cases {
+		tmpl, err := template.New("test").Funcs(templateFuncs).Parse(tc.text)
+		if err != nil {
+			t.Fatalf("Parse(%s) got err %s", tc.text, err)
+		}
+		if got := templateFields(tmpl); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("templateFields(%s) got %v wanted %v", tc.text, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package ignition
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/coreos/butane/config"
+	"github.com/coreos/butane/config/common"
+	"github.com/coreos/vcontext/path"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+)
+
+// Finding is a problem found validating the config of a host.
+type Finding struct {
+	OS   string `json:"os"`
+	Host string `json:"host"`
+	// Level is "error", "warning" or "info".
+	Level string `json:"level"`
+	// File and Line locate the value at fault, when it is known, in the
+	// Butane file, relative to the osname directory, that set it.
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	// Path is the path of the key at fault, as in Provenance.
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Levels of a Finding.
+const (
+	LevelError   = "error"
+	LevelWarning = "warning"
+	LevelInfo    = "info"
+)
+
+func (f Finding) String() string {
+	at := f.OS + "/" + f.Host
+	if f.File != "" {
+		at += fmt.Sprintf(": %s:%d", f.File, f.Line)
+	}
+	if f.Path != "" {
+		at += ": " + f.Path
+	}
+	return fmt.Sprintf("%s: %s: %s", at, f.Level, f.Message)
+}
+
+// ValidateAll validates the config of every host of every osname (see
+// Validate).
+func (h *Handler) ValidateAll(ctx context.Context) ([]Finding, error) {
+	osnames, err := h.OSNames()
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, osname := range osnames {
+		hosts, err := h.Hosts(osname)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			f, err := h.Validate(ctx, osname, host)
+			if err != nil {
+				return nil, err
+			}
+			findings = append(findings, f...)
+		}
+	}
+	return findings, nil
+}
+
+// Validate renders the config of host, never from the cache, and returns
+// every error and warning of the merge and the Butane translation, and
+// the local files referenced that do not exist. Without Secrets, secret
+// references are replaced by placeholders.
+func (h *Handler) Validate(ctx context.Context, osname, host string) ([]Finding, error) {
+	src, err := h.source(nil, osname, host)
+	if err != nil {
+		return nil, err
+	}
+	finding := func(level string, k *Key, path, msg string) Finding {
+		f := Finding{OS: osname, Host: host, Level: level, Path: path, Message: msg}
+		if k != nil {
+			f.File, f.Line = k.File, k.Line
+		}
+		return f
+	}
+	p, err := h.provenance(src)
+	if err != nil {
+		return []Finding{finding(LevelError, nil, "", err.Error())}, nil
+	}
+
+	var findings []Finding
+	missing := make(map[string]bool)
+	for i, k := range p.Keys {
+		for _, local := range k.Locals {
+			if _, err := os.Stat(local); errors.Is(err, os.ErrNotExist) {
+				missing[k.Path] = true
+				findings = append(findings, finding(LevelError, &p.Keys[i], k.Path, fmt.Sprintf("local file %s does not exist", local)))
+			}
+		}
+	}
+
+	b := h.Secrets
+	if b == nil {
+		b = placeholderSecrets{}
+	}
+	if _, err := resolveSecrets(ctx, b, p.config, "$"); err != nil {
+		return append(findings, finding(LevelError, nil, "", err.Error())), nil
+	}
+	butaneData, err := yaml.Marshal(p.config)
+	if err != nil {
+		return nil, err
+	}
+	_, report, err := config.TranslateBytes(butaneData, common.TranslateBytesOptions{
+		TranslateOptions: common.TranslateOptions{
+			FilesDir: src.osDir,
+		},
+	})
+	for _, e := range report.Entries {
+		kpath := keyPath(p.config, e.Context)
+		if missing[kpath] {
+			continue
+		}
+		findings = append(findings, finding(e.Kind.String(), p.key(kpath), kpath, e.Message))
+	}
+	if err != nil && !report.IsFatal() {
+		findings = append(findings, finding(LevelError, nil, "", err.Error()))
+	}
+	return findings, nil
+}
+
+// key returns the leaf at path or, for the path of an object or a keyed
+// list, its first leaf.
+func (p *Provenance) key(path string) *Key {
+	for i, k := range p.Keys {
+		if k.Path == path {
+			return &p.Keys[i]
+		}
+	}
+	for i, k := range p.Keys {
+		if strings.HasPrefix(k.Path, path+".") || strings.HasPrefix(k.Path, path+"[") {
+			return &p.Keys[i]
+		}
+	}
+	return nil
+}
+
+// keyPath converts the path of a value of config in a Butane report, in
+// which list entries are numbered, to the path of its key in Provenance.
+func keyPath(config map[string]any, c path.ContextPath) string {
+	kpath := "$"
+	var v any = config
+	for _, e := range c.Path {
+		switch vv := v.(type) {
+		case map[string]any:
+			k, ok := e.(string)
+			if !ok {
+				return kpath
+			}
+			kpath += "." + k
+			v = vv[k]
+		case []any:
+			i, ok := e.(int)
+			field := listKey(kpath)
+			if !ok || field == "" || i < 0 || i >= len(vv) {
+				return kpath
+			}
+			entry, _ := vv[i].(map[string]any)
+			k, ok := entry[field].(string)
+			if !ok {
+				return kpath
+			}
+			kpath += "[" + k + "]"
+			v = entry
+		default:
+			return kpath
+		}
+	}
+	return kpath
+}
+
+// placeholderSecrets resolves every secret reference to a placeholder.
+type placeholderSecrets struct{}
+
+func (placeholderSecrets) Get(_ context.Context, ref string) ([]byte, error) {
+	return []byte("secret:" + ref), nil
+}
@@ -0,0 +1,67 @@
+package ignition
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"coreos/base/base.yaml": "variant: fcos\nversion: 1.5.0\n",
+		"coreos/good/host.yaml": `storage:
+  files:
+    - path: /etc/token
+      contents: {secret: token}
+`,
+		"coreos/node1/host.yaml": `systemd:
+  units:
+    - name: kubelet.service
+      enabled: true
+      bogus: 1
+storage:
+  files:
+    - path: /etc/motd
+      contents:
+        local: motd
+`,
+		"coreos/node2/host.yaml": "storage: [broken\n",
+	})
+	h := &Handler{ConfigRoot: dir}
+	ctx := context.Background()
+
+	findings, err := h.ValidateAll(ctx)
+	if err != nil {
+		t.Fatalf("ValidateAll() got err %s", err)
+	}
+	byHost := make(map[string][]Finding)
+	for _, f := range findings {
+		byHost[f.Host] = append(byHost[f.Host], f)
+	}
+	if got := byHost["good"]; len(got) != 0 {
+		t.Errorf("good got findings %v wanted none", got)
+	}
+	want := []Finding{
+		{
+			OS: "coreos", Host: "node1", Level: LevelError,
+			File: "node1/host.yaml", Line: 10, Path: "$.storage.files[/etc/motd].contents.local",
+			Message: "local file " + filepath.Join(dir, "coreos", "node1", "motd") + " does not exist",
+		},
+		{
+			OS: "coreos", Host: "node1", Level: LevelWarning,
+			File: "node1/host.yaml", Line: 5, Path: "$.systemd.units[kubelet.service]",
+			Message: "Unused key bogus",
+		},
+	}
+	if got := byHost["node1"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("node1 got findings\n%v\nwanted\n%v", got, want)
+	}
+	if got := byHost["node2"]; len(got) != 1 || got[0].Level != LevelError {
+		t.Errorf("node2 got findings %v wanted an error", got)
+	}
+	if _, err := h.Validate(ctx, "coreos", "missing"); err == nil {
+		t.Errorf("Validate(missing) got no err")
+	}
+}
@@ -0,0 +1,568 @@
+// Package inventory describes the machines corepxe provisions: hosts,
+// identified by MAC address, and the groups they belong to.
+//
+// The inventory is a YAML file, by default "inventory.yaml" in the config
+// directory:
+//
+//	groups:
+//	  k8s-worker:
+//	    vars:
+//	      role: worker
+//	    includes: [roles/k8s-worker.yaml]
+//	hosts:
+//	  node1:
+//	    macs: ["aa:bb:cc:dd:ee:ff"]
+//	    groups: [k8s-worker]
+//	    profile: install
+//	    vars:
+//	      disk: /dev/nvme0n1
+//	    bmc:
+//	      endpoint: https://10.0.0.10
+//	      username: admin
+//	      passwordSecret: bmc/node1
+//	      insecure: true
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/redfish"
+	"github.com/nveeser/corepxe/secrets"
+	"github.com/nveeser/corepxe/store"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultOS is the osname used for hosts that do not set one.
+const DefaultOS = "coreos"
+
+var ErrNotFound = errors.New("not found")
+
+// Host is a machine known to the inventory.
+type Host struct {
+	Name string   `yaml:"-" json:"name"`
+	MACs []string `yaml:"macs,omitempty" json:"macs,omitempty"`
+	UUID string   `yaml:"uuid,omitempty" json:"uuid,omitempty"`
+	IPs  []string `yaml:"ips,omitempty" json:"ips,omitempty"`
+	// Groups the host belongs to, in increasing order of precedence.
+	Groups []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	// Profile is the iPXE template the host boots. When empty the host
+	// boots whatever template it asks for.
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+	// OS and Config name the Ignition config of the host,
+	// "<ConfigDir>/<OS>/<Config>/host.yaml". They default to DefaultOS
+	// and the host name.
+	OS     string         `yaml:"os,omitempty" json:"os,omitempty"`
+	Config string         `yaml:"config,omitempty" json:"config,omitempty"`
+	Vars   map[string]any `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// BMC is the Redfish endpoint used to power cycle and PXE boot the
+	// host. It may be nil.
+	BMC *BMC `yaml:"bmc,omitempty" json:"bmc,omitempty"`
+}
+
+// BMC is the Redfish endpoint of a host's baseboard management
+// controller.
+type BMC struct {
+	// Endpoint is the base URL of the BMC, e.g. "https://10.0.0.10".
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	// Password is the password of Username. Prefer PasswordSecret, which
+	// keeps it out of the inventory. It is never shown by the API (see
+	// Host.Redacted).
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+	// PasswordSecret is the secret reference, e.g. "bmc/node1", of the
+	// password, resolved with the secret backends instead of Password.
+	PasswordSecret string `yaml:"passwordSecret,omitempty" json:"passwordSecret,omitempty"`
+	// System is the path of the computer system; by default the first
+	// one the BMC lists.
+	System string `yaml:"system,omitempty" json:"system,omitempty"`
+	// Insecure skips verification of the BMC's TLS certificate.
+	Insecure bool `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+// Redfish returns a client for the BMC, looking up PasswordSecret in
+// backend, which may be nil when it is not set.
+func (b *BMC) Redfish(ctx context.Context, backend secrets.Backend) (*redfish.Client, error) {
+	password := b.Password
+	if b.PasswordSecret != "" {
+		if backend == nil {
+			return nil, fmt.Errorf("BMC password secret %s: no secret backend is configured", b.PasswordSecret)
+		}
+		v, err := backend.Get(ctx, b.PasswordSecret)
+		if err != nil {
+			return nil, fmt.Errorf("BMC password: %w", err)
+		}
+		password = string(v)
+	}
+	return &redfish.Client{
+		Endpoint: b.Endpoint,
+		Username: b.Username,
+		Password: password,
+		System:   b.System,
+		Insecure: b.Insecure,
+	}, nil
+}
+
+// Group is a set of hosts sharing variables.
+type Group struct {
+	Name string         `yaml:"-" json:"name"`
+	Vars map[string]any `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// Includes are Butane files, relative to the OS config directory,
+	// merged into the Ignition config of the group's hosts after
+	// base/base.yaml and before their host.yaml.
+	Includes []string `yaml:"includes,omitempty" json:"includes,omitempty"`
+}
+
+// OSName returns the host's OS, or DefaultOS.
+func (h *Host) OSName() string {
+	if h.OS == "" {
+		return DefaultOS
+	}
+	return h.OS
+}
+
+// Redacted returns a copy of the host without its BMC password, for
+// showing to API clients.
+func (h *Host) Redacted() *Host {
+	c := copyHost(h)
+	if c.BMC != nil {
+		c.BMC.Password = ""
+	}
+	return c
+}
+
+// HasMAC reports whether mac is one of the host's MAC addresses.
+func (h *Host) HasMAC(mac string) bool {
+	mac = NormalizeMAC(mac)
+	for _, m := range h.MACs {
+		if NormalizeMAC(m) == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigName returns the host's Config, or its name.
+func (h *Host) ConfigName() string {
+	if h.Config == "" {
+		return h.Name
+	}
+	return h.Config
+}
+
+// Inventory is the contents of an inventory file.
+type Inventory struct {
+	Groups map[string]*Group `yaml:"groups,omitempty"`
+	Hosts  map[string]*Host  `yaml:"hosts,omitempty"`
+}
+
+// Validate checks that names are set, MACs are unique, groups exist, BMC
+// endpoints are URLs and group includes are relative paths.
+func (inv *Inventory) Validate() error {
+	macs := make(map[string]string)
+	for name, h := range inv.Hosts {
+		if name == "" || strings.ContainsAny(name, "/\\") {
+			return fmt.Errorf("invalid host name %q", name)
+		}
+		for _, mac := range h.MACs {
+			mac = NormalizeMAC(mac)
+			if other, ok := macs[mac]; ok {
+				return fmt.Errorf("host %s: MAC %s is also used by %s", name, mac, other)
+			}
+			macs[mac] = name
+		}
+		if h.BMC != nil {
+			if u, err := url.Parse(h.BMC.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("host %s: invalid BMC endpoint %q", name, h.BMC.Endpoint)
+			}
+		}
+		for _, g := range h.Groups {
+			if _, ok := inv.Groups[g]; !ok {
+				return fmt.Errorf("host %s: unknown group %q", name, g)
+			}
+		}
+	}
+	for name, g := range inv.Groups {
+		for _, inc := range g.Includes {
+			if !filepath.IsLocal(inc) {
+				return fmt.Errorf("group %s: include %q is not a relative path within the OS config directory", name, inc)
+			}
+		}
+	}
+	return nil
+}
+
+// File is an Inventory backed by a YAML file or, when opened with Open,
+// by a store. A missing file is an empty inventory. It is safe for
+// concurrent use.
+type File struct {
+	Path string
+
+	mu   sync.Mutex
+	inv  *Inventory
+	repo store.Repository
+}
+
+// Buckets of the store holding an inventory opened with Open.
+const (
+	HostBucket  = "hosts"
+	GroupBucket = "groups"
+)
+
+// Open returns the inventory kept in repo. When repo holds no inventory
+// yet it is seeded from the YAML file at seed, if there is one.
+func Open(repo store.Repository, seed string) (*File, error) {
+	inv := &Inventory{
+		Groups: make(map[string]*Group),
+		Hosts:  make(map[string]*Host),
+	}
+	err := repo.ForEach(HostBucket, func(key string, value []byte) error {
+		h := &Host{}
+		if err := json.Unmarshal(value, h); err != nil {
+			return fmt.Errorf("error reading host %s: %w", key, err)
+		}
+		h.Name = key
+		inv.Hosts[key] = h
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = repo.ForEach(GroupBucket, func(key string, value []byte) error {
+		g := &Group{}
+		if err := json.Unmarshal(value, g); err != nil {
+			return fmt.Errorf("error reading group %s: %w", key, err)
+		}
+		g.Name = key
+		inv.Groups[key] = g
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(inv.Hosts) == 0 && len(inv.Groups) == 0 && seed != "" {
+		f, err := Load(seed)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveRepo(repo, f.inv); err != nil {
+			return nil, err
+		}
+		inv = f.inv
+	}
+	if err := inv.Validate(); err != nil {
+		return nil, fmt.Errorf("stored inventory: %w", err)
+	}
+	return &File{inv: inv, repo: repo}, nil
+}
+
+// Load reads the inventory file at path.
+func Load(path string) (*File, error) {
+	f := &File{Path: path}
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.inv = &Inventory{}
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{}
+	if err := yaml.Unmarshal(body, inv); err != nil {
+		return nil, fmt.Errorf("error reading inventory %s: %w", path, err)
+	}
+	for name, h := range inv.Hosts {
+		if h == nil {
+			h = &Host{}
+			inv.Hosts[name] = h
+		}
+		h.Name = name
+	}
+	for name, g := range inv.Groups {
+		if g == nil {
+			g = &Group{}
+			inv.Groups[name] = g
+		}
+		g.Name = name
+	}
+	if err := inv.Validate(); err != nil {
+		return nil, fmt.Errorf("inventory %s: %w", path, err)
+	}
+	f.inv = inv
+	return f, nil
+}
+
+// Empty reports whether the inventory has no hosts.
+func (f *File) Empty() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.inv.Hosts) == 0
+}
+
+// Hosts returns copies of every host, sorted by name.
+func (f *File) Hosts() []*Host {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var hosts []*Host
+	for _, h := range f.inv.Hosts {
+		hosts = append(hosts, copyHost(h))
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+// Host returns a copy of the named host.
+func (f *File) Host(name string) (*Host, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.inv.Hosts[name]
+	if !ok {
+		return nil, fmt.Errorf("host %q: %w", name, ErrNotFound)
+	}
+	return copyHost(h), nil
+}
+
+// ByMAC returns a copy of the host with the given MAC address, or nil.
+func (f *File) ByMAC(mac string) *Host {
+	mac = NormalizeMAC(mac)
+	if mac == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, h := range f.inv.Hosts {
+		for _, m := range h.MACs {
+			if NormalizeMAC(m) == mac {
+				return copyHost(h)
+			}
+		}
+	}
+	return nil
+}
+
+// Groups returns copies of every group, sorted by name.
+func (f *File) Groups() []*Group {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var groups []*Group
+	for _, g := range f.inv.Groups {
+		c := *g
+		groups = append(groups, &c)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// ConfigHost returns the host whose Ignition config is
+// "<osname>/<config>": the one with MAC address mac if it has that
+// config, or else the first by name. It returns nil if there is none.
+// vars are the host's variables: those of its groups, in order,
+// overridden by its own.
+func (f *File) ConfigHost(osname, config, mac string) (host *Host, vars map[string]any) {
+	if h := f.ByMAC(mac); h != nil && h.OSName() == osname && h.ConfigName() == config {
+		host = h
+	}
+	for _, h := range f.Hosts() {
+		if host == nil && h.OSName() == osname && h.ConfigName() == config {
+			host = h
+		}
+	}
+	if host == nil {
+		return nil, nil
+	}
+	vars = make(map[string]any)
+	for _, name := range host.Groups {
+		if g, err := f.Group(name); err == nil {
+			for k, v := range g.Vars {
+				vars[k] = v
+			}
+		}
+	}
+	for k, v := range host.Vars {
+		vars[k] = v
+	}
+	return host, vars
+}
+
+// Includes returns the Includes of the groups of the host ConfigHost
+// picks for "<osname>/<config>" and mac, in the order of its groups,
+// without duplicates. Hosts sharing a config each get the includes of
+// their own groups.
+func (f *File) Includes(osname, config, mac string) []string {
+	host, _ := f.ConfigHost(osname, config, mac)
+	if host == nil {
+		return nil
+	}
+	var includes []string
+	seen := make(map[string]bool)
+	for _, name := range host.Groups {
+		g, err := f.Group(name)
+		if err != nil {
+			continue
+		}
+		for _, inc := range g.Includes {
+			if !seen[inc] {
+				seen[inc] = true
+				includes = append(includes, inc)
+			}
+		}
+	}
+	return includes
+}
+
+// Group returns a copy of the named group.
+func (f *File) Group(name string) (*Group, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	g, ok := f.inv.Groups[name]
+	if !ok {
+		return nil, fmt.Errorf("group %q: %w", name, ErrNotFound)
+	}
+	c := *g
+	return &c, nil
+}
+
+// PutHost adds or replaces h and saves the file.
+func (f *File) PutHost(h *Host) error {
+	return f.update(func(inv *Inventory) {
+		if inv.Hosts == nil {
+			inv.Hosts = make(map[string]*Host)
+		}
+		inv.Hosts[h.Name] = copyHost(h)
+	})
+}
+
+// DeleteHost removes the named host and saves the file.
+func (f *File) DeleteHost(name string) error {
+	if _, err := f.Host(name); err != nil {
+		return err
+	}
+	return f.update(func(inv *Inventory) { delete(inv.Hosts, name) })
+}
+
+// PutGroup adds or replaces g and saves the file.
+func (f *File) PutGroup(g *Group) error {
+	return f.update(func(inv *Inventory) {
+		if inv.Groups == nil {
+			inv.Groups = make(map[string]*Group)
+		}
+		c := *g
+		inv.Groups[g.Name] = &c
+	})
+}
+
+// DeleteGroup removes the named group and saves the file. Groups still
+// used by a host cannot be removed.
+func (f *File) DeleteGroup(name string) error {
+	if _, err := f.Group(name); err != nil {
+		return err
+	}
+	return f.update(func(inv *Inventory) { delete(inv.Groups, name) })
+}
+
+// update applies fn to a copy of the inventory, and if the result is
+// valid saves it and makes it current.
+func (f *File) update(fn func(inv *Inventory)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	next := &Inventory{
+		Groups: make(map[string]*Group),
+		Hosts:  make(map[string]*Host),
+	}
+	for k, g := range f.inv.Groups {
+		c := *g
+		next.Groups[k] = &c
+	}
+	for k, h := range f.inv.Hosts {
+		next.Hosts[k] = copyHost(h)
+	}
+	fn(next)
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	save := func() error { return saveFile(f.Path, next) }
+	if f.repo != nil {
+		save = func() error { return saveRepo(f.repo, next) }
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	f.inv = next
+	return nil
+}
+
+// saveRepo replaces the inventory held in repo with inv.
+func saveRepo(repo store.Repository, inv *Inventory) error {
+	return repo.Update(func(r store.Repository) error {
+		for _, b := range []string{HostBucket, GroupBucket} {
+			keys, err := store.Keys(r, b)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := r.Delete(b, k); err != nil {
+					return err
+				}
+			}
+		}
+		for name, h := range inv.Hosts {
+			if err := store.PutJSON(r, HostBucket, name, h); err != nil {
+				return err
+			}
+		}
+		for name, g := range inv.Groups {
+			if err := store.PutJSON(r, GroupBucket, name, g); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func saveFile(path string, inv *Inventory) error {
+	body, err := yaml.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func copyHost(h *Host) *Host {
+	c := *h
+	c.MACs = append([]string(nil), h.MACs...)
+	c.IPs = append([]string(nil), h.IPs...)
+	c.Groups = append([]string(nil), h.Groups...)
+	if h.BMC != nil {
+		bmc := *h.BMC
+		c.BMC = &bmc
+	}
+	return &c
+}
+
+// NormalizeMAC returns mac in lower case with ":" separators.
+func NormalizeMAC(mac string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(mac)), "-", ":")
+}
+
+var macPattern = regexp.MustCompile(`^[0-9a-fA-F]{2}([:-][0-9a-fA-F]{2}){5}$`)
+
+// ValidMAC reports whether mac is a 48-bit MAC address with ":" or "-"
+// separators, as iPXE and Linux print them.
+func ValidMAC(mac string) bool {
+	return macPattern.MatchString(strings.TrimSpace(mac))
+}
@@ -0,0 +1,172 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"github.com/nveeser/corepxe/secrets"
+	"github.com/nveeser/corepxe/store"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.yaml")
+	err := os.WriteFile(path, []byte(`
+groups:
+  workers:
+    vars:
+      role: worker
+    includes: [roles/worker.yaml, dc/east.yaml]
+  east:
+    includes: [dc/east.yaml]
+hosts:
+  node1:
+    macs: ["AA-BB-CC-DD-EE-FF"]
+    groups: [workers, east]
+    profile: install
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() got err %s", err)
+	}
+	h := f.ByMAC("aa:bb:cc:dd:ee:ff")
+	if h == nil || h.Name != "node1" || h.Profile != "install" || h.OSName() != DefaultOS || h.ConfigName() != "node1" {
+		t.Fatalf("ByMAC() got %+v", h)
+	}
+	if h := f.ByMAC("00:00:00:00:00:01"); h != nil {
+		t.Errorf("ByMAC(unknown) got %+v", h)
+	}
+	if got := f.Includes(DefaultOS, "node1", ""); len(got) != 2 || got[0] != "roles/worker.yaml" || got[1] != "dc/east.yaml" {
+		t.Errorf("Includes() got %v wanted the group includes without duplicates", got)
+	}
+	if h, vars := f.ConfigHost(DefaultOS, "node1", ""); h == nil || h.Name != "node1" || vars["role"] != "worker" {
+		t.Errorf("ConfigHost() got %+v, %v", h, vars)
+	}
+	if h, _ := f.ConfigHost(DefaultOS, "nope", ""); h != nil {
+		t.Errorf("ConfigHost(unknown config) got %+v", h)
+	}
+	if err := f.PutGroup(&Group{Name: "bad", Includes: []string{"../other/x.yaml"}}); err == nil {
+		t.Errorf("PutGroup(include outside the OS directory) got nil err")
+	}
+
+	if err := f.PutHost(&Host{Name: "node2", MACs: []string{"aa:bb:cc:dd:ee:ff"}}); err == nil {
+		t.Errorf("PutHost(duplicate MAC) got nil err")
+	}
+	if err := f.PutHost(&Host{Name: "node2", Groups: []string{"nope"}}); err == nil {
+		t.Errorf("PutHost(unknown group) got nil err")
+	}
+	if err := f.PutHost(&Host{Name: "node2", BMC: &BMC{Endpoint: "10.0.0.10"}}); err == nil {
+		t.Errorf("PutHost(BMC endpoint without scheme) got nil err")
+	}
+	if err := f.PutHost(&Host{Name: "node2", MACs: []string{"00:00:00:00:00:02"}, Config: "standard"}); err != nil {
+		t.Fatalf("PutHost() got err %s", err)
+	}
+
+	f, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load() got err %s", err)
+	}
+	if got := len(f.Hosts()); got != 2 {
+		t.Errorf("Hosts() got %d hosts wanted 2", got)
+	}
+	if h, err := f.Host("node2"); err != nil || h.ConfigName() != "standard" {
+		t.Errorf("Host(node2) got %+v, %v", h, err)
+	}
+	if err := f.DeleteHost("node3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteHost(node3) got err %v wanted %s", err, ErrNotFound)
+	}
+
+	empty, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil || !empty.Empty() {
+		t.Errorf("Load(missing) got %v, %v wanted empty inventory", empty, err)
+	}
+}
+
+func TestIncludesSharedConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.yaml")
+	err := os.WriteFile(path, []byte(`
+groups:
+  gpu:
+    includes: [roles/gpu.yaml]
+  storage:
+    includes: [roles/storage.yaml]
+hosts:
+  node1:
+    config: worker
+    macs: ["aa:bb:cc:dd:ee:01"]
+    groups: [gpu]
+  node2:
+    config: worker
+    macs: ["aa:bb:cc:dd:ee:02"]
+    groups: [storage]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() got err %s", err)
+	}
+	for mac, want := range map[string]string{
+		"aa:bb:cc:dd:ee:01": "roles/gpu.yaml",
+		"aa:bb:cc:dd:ee:02": "roles/storage.yaml",
+	} {
+		if got := f.Includes(DefaultOS, "worker", mac); len(got) != 1 || got[0] != want {
+			t.Errorf("Includes(%s) got %v wanted [%s]", mac, got, want)
+		}
+	}
+	if got := f.Includes(DefaultOS, "nope", ""); got != nil {
+		t.Errorf("Includes(unknown config) got %v wanted none", got)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	seed := filepath.Join(t.TempDir(), "inventory.yaml")
+	if err := os.WriteFile(seed, []byte("hosts:\n  node1:\n    macs: [\"aa:bb:cc:dd:ee:ff\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo := store.NewMemory()
+	f, err := Open(repo, seed)
+	if err != nil {
+		t.Fatalf("Open() got err %s", err)
+	}
+	if h := f.ByMAC("aa:bb:cc:dd:ee:ff"); h == nil || h.Name != "node1" {
+		t.Fatalf("ByMAC() got %+v", h)
+	}
+	if err := f.PutHost(&Host{Name: "node2"}); err != nil {
+		t.Fatalf("PutHost() got err %s", err)
+	}
+	if err := f.DeleteHost("node1"); err != nil {
+		t.Fatalf("DeleteHost() got err %s", err)
+	}
+
+	// Once the store holds an inventory the seed file is ignored.
+	f, err = Open(repo, seed)
+	if err != nil {
+		t.Fatalf("Open() got err %s", err)
+	}
+	hosts := f.Hosts()
+	if len(hosts) != 1 || hosts[0].Name != "node2" {
+		t.Errorf("Hosts() got %v wanted only node2", hosts)
+	}
+}
+
+func TestBMCPasswordSecret(t *testing.T) {
+	t.Setenv("TEST_BMC_NODE1", "hunter2")
+	b := &BMC{Endpoint: "https://10.0.0.10", Username: "admin", PasswordSecret: "bmc/node1"}
+	c, err := b.Redfish(context.Background(), &secrets.Env{Prefix: "TEST_"})
+	if err != nil || c.Password != "hunter2" {
+		t.Errorf("Redfish() got %+v, %v wanted password from the secret", c, err)
+	}
+	if _, err := b.Redfish(context.Background(), nil); err == nil {
+		t.Errorf("Redfish(no backend) got nil err")
+	}
+	h := &Host{Name: "node1", BMC: &BMC{Endpoint: "https://10.0.0.10", Password: "secret"}}
+	if got := h.Redacted(); got.BMC.Password != "" || h.BMC.Password != "secret" {
+		t.Errorf("Redacted() got password %q, original %q", got.BMC.Password, h.BMC.Password)
+	}
+}
@@ -0,0 +1,160 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/nveeser/corepxe/token"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Handler serves the machine timelines as JSON. With an "id" path value
+// it returns that machine, otherwise all machines.
+type Handler struct {
+	Tracker *Tracker
+}
+
+// PhoneHomeHandler accepts the first boot report posted by the unit that
+// ignition.Handler adds to each config, for the config host named by the
+// "host" path value. The form holds "hostname", "boot_id", the contents
+// of /etc/os-release as "os_release" and one "mac" per interface.
+type PhoneHomeHandler struct {
+	Tracker *Tracker
+	// Tokens verifies the "sig" query parameter, the Tag of the host for
+	// PhoneHomePurpose. Without Tokens every report is refused.
+	Tokens *token.Signer
+	// ClientIP returns the address of the client; by default the remote
+	// address of the request.
+	ClientIP func(r *http.Request) string
+}
+
+// PhoneHomePurpose is the purpose of the token.Signer Tag that signs the
+// phone home URL of a host.
+const PhoneHomePurpose = "phonehome"
+
+func (h *PhoneHomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+	if h.Tokens == nil {
+		http.Error(w, "forbidden: phone home needs a token key", http.StatusForbidden)
+		return
+	}
+	if err := h.Tokens.VerifyTag(r.URL.Query().Get("sig"), PhoneHomePurpose, host); err != nil {
+		slog.Warn("Phone home denied", "host", host, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := r.RemoteAddr
+	if h.ClientIP != nil {
+		ip = h.ClientIP(r)
+	} else if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	rep := &Report{
+		Host:      host,
+		Hostname:  strings.TrimSpace(r.PostForm.Get("hostname")),
+		OSRelease: osRelease(r.PostForm.Get("os_release")),
+		BootID:    strings.TrimSpace(r.PostForm.Get("boot_id")),
+		MACs:      r.PostForm["mac"],
+		IP:        ip,
+	}
+	m, err := h.Tracker.Provisioned(rep)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Machine provisioned", "machine", m.ID, "host", host, "hostname", m.Hostname, "release", m.OSRelease)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// osRelease picks the release out of the contents of /etc/os-release:
+// OSTREE_VERSION when present (the CoreOS build), otherwise VERSION.
+func osRelease(contents string) string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(contents, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		values[k] = strings.Trim(v, `"'`)
+	}
+	if v := values["OSTREE_VERSION"]; v != "" {
+		return v
+	}
+	return values["VERSION"]
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v any
+	var err error
+	if id := r.PathValue("id"); id != "" {
+		v, err = h.Tracker.Machine(id)
+	} else {
+		v, err = h.Tracker.Machines()
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// Reinstall requests a reinstall of the machine named by the "id" path
+// value, or of the machines named by "id" form values and of every
+// machine last provisioned with a "host" form value ("<osname>/<host>").
+// It responds with the machines that changed state.
+func (h *Handler) Reinstall(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := r.Form["id"]
+	if id := r.PathValue("id"); id != "" {
+		ids = []string{id}
+	}
+	for _, host := range r.Form["host"] {
+		hostIDs, err := h.Tracker.HostMachines(host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, hostIDs...)
+	}
+	if len(ids) == 0 {
+		http.Error(w, "no machines selected", http.StatusBadRequest)
+		return
+	}
+	changed, err := h.Tracker.RequestReinstall(ids...)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, m := range changed {
+		slog.Info("Machine reinstall requested", "machine", m.ID)
+	}
+	writeJSON(w, changed)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,64 @@
+package lifecycle
+
+import (
+	"github.com/nveeser/corepxe/token"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPhoneHomeHandler(t *testing.T) {
+	tr := &Tracker{}
+	err := tr.Record(Identity{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.0.5"}, Event{Stage: StageIgnition, Status: 200, Detail: "coreos/node1"})
+	if err != nil {
+		t.Fatalf("Record() got err %s", err)
+	}
+	signer := &token.Signer{Key: []byte("0123456789abcdef0123456789abcdef")}
+	mux := http.NewServeMux()
+	mux.Handle("POST /phonehome/{host}", &PhoneHomeHandler{Tracker: tr, Tokens: signer})
+
+	postTo := func(host, sig string, form url.Values) int {
+		target := "/phonehome/" + host + "?" + url.Values{"sig": {sig}}.Encode()
+		r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "10.0.0.9:1234"
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	post := func(form url.Values) int {
+		return postTo("node1", signer.Tag(PhoneHomePurpose, "node1"), form)
+	}
+	machine := url.Values{"mac": {"aa:bb:cc:dd:ee:ff"}}
+	if code := postTo("node1", "", machine); code != http.StatusForbidden {
+		t.Errorf("unsigned report got status %d wanted %d", code, http.StatusForbidden)
+	}
+	if code := postTo("node1", signer.Tag(PhoneHomePurpose, "node2"), machine); code != http.StatusForbidden {
+		t.Errorf("report signed for another host got status %d wanted %d", code, http.StatusForbidden)
+	}
+	if code := postTo("node2", signer.Tag(PhoneHomePurpose, "node2"), machine); code != http.StatusNotFound {
+		t.Errorf("report for a host the machine was not installed with got status %d wanted %d", code, http.StatusNotFound)
+	}
+
+	if code := post(url.Values{"mac": {"00:00:00:00:00:01"}}); code != http.StatusNotFound {
+		t.Errorf("unknown machine got status %d wanted %d", code, http.StatusNotFound)
+	}
+	code := post(url.Values{
+		"hostname":   {"node1\n"},
+		"boot_id":    {"1234\n"},
+		"os_release": {"NAME=\"Fedora Linux\"\nVERSION=\"40 (CoreOS)\"\nOSTREE_VERSION='40.20240728.3.0'\n"},
+		"mac":        {"00:00:00:00:00:01", "AA:BB:CC:DD:EE:FF"},
+	})
+	if code != http.StatusNoContent {
+		t.Fatalf("phone home got status %d wanted %d", code, http.StatusNoContent)
+	}
+	m, err := tr.Machine("aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatalf("Machine() got err %s", err)
+	}
+	if m.Stage != StageProvisioned || m.Hostname != "node1" || m.BootID != "1234" || m.OSRelease != "40.20240728.3.0" || m.State != StateInstalled || m.IP != "10.0.0.9" {
+		t.Errorf("Machine() got %+v", m)
+	}
+}
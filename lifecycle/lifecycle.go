@@ -0,0 +1,459 @@
+// Package lifecycle correlates the requests made by a machine while it
+// PXE boots and installs into a per-machine provisioning timeline.
+package lifecycle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/store"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stage is a step of the provisioning process, named after the request
+// that marks it.
+type Stage string
+
+const (
+	StageIPXE     Stage = "ipxe"
+	StageKernel   Stage = "kernel"
+	StageInitrd   Stage = "initrd"
+	StageRootfs   Stage = "rootfs"
+	StageIgnition Stage = "ignition"
+	// StageProvisioned is reported by the installed OS on first boot.
+	StageProvisioned Stage = "provisioned"
+	// StageLocalBoot is recorded when an installed machine is told to
+	// boot from its disk. It is not a provisioning step, so it is kept in
+	// the timeline without changing the stage of the machine.
+	StageLocalBoot Stage = "localboot"
+)
+
+// DefaultStallTimeout is used when Tracker.StallTimeout is zero.
+const DefaultStallTimeout = 30 * time.Minute
+
+// DefaultMaxEvents is used when Tracker.MaxEvents is zero.
+const DefaultMaxEvents = 200
+
+// DefaultMaxMachines is used when Tracker.MaxMachines is zero.
+const DefaultMaxMachines = 10000
+
+var ErrNotFound = errors.New("machine not found")
+
+// Identity is what a request tells us about the machine that sent it.
+type Identity struct {
+	MAC  string
+	UUID string
+	IP   string
+}
+
+// Event is one request in a machine's timeline.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Stage  Stage     `json:"stage"`
+	Status int       `json:"status"`
+	IP     string    `json:"ip,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	// Revision is the config revision the Ignition config served was
+	// rendered from, when configs are kept in git.
+	Revision string `json:"revision,omitempty"`
+}
+
+// Machine is the provisioning timeline of one machine.
+type Machine struct {
+	ID      string    `json:"id"`
+	MAC     string    `json:"mac,omitempty"`
+	UUID    string    `json:"uuid,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Stage   Stage     `json:"stage,omitempty"` // last stage that succeeded
+	Updated time.Time `json:"updated"`
+	Events  []Event   `json:"events"`
+
+	// Set from the first boot report of the installed OS.
+	Hostname    string    `json:"hostname,omitempty"`
+	OSRelease   string    `json:"osRelease,omitempty"`
+	BootID      string    `json:"bootId,omitempty"`
+	Provisioned time.Time `json:"provisioned,omitempty"`
+
+	// State is where the machine is in the install-once state machine.
+	State State `json:"state"`
+	// Host is the config host ("<osname>/<host>") the machine last
+	// fetched Ignition for.
+	Host string `json:"host,omitempty"`
+	// Release, when set, pins the CoreOS release the machine boots
+	// instead of the current release of its stream.
+	Release string `json:"release,omitempty"`
+	// ConfigRevision is the config revision of the Ignition config the
+	// machine last fetched, which it was installed with.
+	ConfigRevision string `json:"configRevision,omitempty"`
+	// ConfigPin, when set, pins the config revision the Ignition config
+	// of the machine is rendered from instead of the current one.
+	ConfigPin string `json:"configPin,omitempty"`
+
+	// Stalled is set when the machine started but did not finish
+	// provisioning within the stall timeout. It is computed, not stored.
+	Stalled bool `json:"stalled"`
+	// stallReported records that CheckStalled already logged the stall.
+	stallReported bool
+}
+
+// Tracker records machine timelines, one record per machine in Store.
+type Tracker struct {
+	// Store holds the timelines; nil means they are kept in memory.
+	Store        store.Repository
+	StallTimeout time.Duration
+	MaxEvents    int
+	// MaxMachines bounds the machines kept. A new machine past it
+	// replaces the least recently updated one that never started
+	// installing, or is not recorded when there is none.
+	MaxMachines int
+	// InstalledStage is the stage that moves a machine to StateInstalled.
+	// Zero means StageProvisioned, which needs the phone home unit;
+	// StageIgnition can be used without it.
+	InstalledStage Stage
+
+	mu       sync.Mutex
+	loaded   bool
+	machines map[string]*Machine
+	now      func() time.Time
+}
+
+// Record appends ev to the timeline of the machine identified by id,
+// creating the machine if needed. A malformed MAC or UUID is an error.
+func (t *Tracker) Record(id Identity, ev Event) error {
+	if err := validIdentity(id); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return err
+	}
+	m := t.find(id)
+	if m == nil {
+		key := machineID(id)
+		if key == "" {
+			return errors.New("no identity for machine")
+		}
+		if err := t.makeRoom(); err != nil {
+			return err
+		}
+		m = &Machine{ID: key, State: StateNew}
+		t.machines[key] = m
+	}
+	if id.MAC != "" {
+		m.MAC = normalizeMAC(id.MAC)
+	}
+	if id.UUID != "" {
+		m.UUID = strings.ToLower(id.UUID)
+	}
+	if id.IP != "" {
+		m.IP = id.IP
+	}
+	if ev.Time.IsZero() {
+		ev.Time = t.time()
+	}
+	m.Events = append(m.Events, ev)
+	if max := t.maxEvents(); len(m.Events) > max {
+		m.Events = m.Events[len(m.Events)-max:]
+	}
+	if ev.Status < 400 && ev.Stage != StageLocalBoot {
+		m.Stage = ev.Stage
+		if ev.Stage == StageIgnition {
+			m.Host = ev.Detail
+			if ev.Revision != "" {
+				m.ConfigRevision = ev.Revision
+			}
+		}
+		t.advance(m, ev.Stage)
+	}
+	m.Updated = ev.Time
+	m.stallReported = false
+	return t.save(m)
+}
+
+// Report is sent by a machine on the first boot of its installed OS.
+type Report struct {
+	// Host is the config host the machine was installed with; only a
+	// machine that last fetched its Ignition config matches.
+	Host      string
+	Hostname  string
+	OSRelease string
+	BootID    string
+	MACs      []string
+	IP        string
+}
+
+// Provisioned records that the machine that sent rep has booted its
+// installed OS.
+func (t *Tracker) Provisioned(rep *Report) (*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	var m *Machine
+	for _, mac := range rep.MACs {
+		if m = t.find(Identity{MAC: mac}); m != nil {
+			break
+		}
+	}
+	if m == nil {
+		m = t.find(Identity{IP: rep.IP})
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%w: no machine with MACs %v or IP %s", ErrNotFound, rep.MACs, rep.IP)
+	}
+	if _, config, _ := strings.Cut(m.Host, "/"); config != rep.Host {
+		return nil, fmt.Errorf("%w: machine %s was not installed with %s", ErrNotFound, m.ID, rep.Host)
+	}
+	now := t.time()
+	m.Events = append(m.Events, Event{
+		Time:   now,
+		Stage:  StageProvisioned,
+		Status: 200,
+		IP:     rep.IP,
+		Detail: rep.OSRelease,
+	})
+	m.Stage = StageProvisioned
+	m.Updated = now
+	m.Hostname = rep.Hostname
+	m.OSRelease = rep.OSRelease
+	m.BootID = rep.BootID
+	m.Provisioned = now
+	if rep.IP != "" {
+		m.IP = rep.IP
+	}
+	t.advance(m, StageProvisioned)
+	if err := t.save(m); err != nil {
+		return nil, err
+	}
+	return t.snapshot(m), nil
+}
+
+// Machines returns every known machine, most recently updated first.
+func (t *Tracker) Machines() ([]*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	var ms []*Machine
+	for _, m := range t.machines {
+		ms = append(ms, t.snapshot(m))
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Updated.After(ms[j].Updated) })
+	return ms, nil
+}
+
+// Machine returns the machine with the given ID, MAC or UUID.
+func (t *Tracker) Machine(id string) (*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	m := t.lookup(id)
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return t.snapshot(m), nil
+}
+
+// lookup returns the machine with the given ID, MAC or UUID. t.mu must be
+// held.
+func (t *Tracker) lookup(id string) *Machine {
+	if m := t.machines[id]; m != nil {
+		return m
+	}
+	if m := t.find(Identity{MAC: id}); m != nil {
+		return m
+	}
+	return t.find(Identity{UUID: id})
+}
+
+// CheckStalled logs a warning for each machine that has stalled since the
+// last call, and returns them.
+func (t *Tracker) CheckStalled() ([]*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	var stalled []*Machine
+	for _, m := range t.machines {
+		if !t.stalled(m) || m.stallReported {
+			continue
+		}
+		m.stallReported = true
+		slog.Warn("Machine provisioning stalled", "machine", m.ID, "stage", m.Stage, "updated", m.Updated)
+		stalled = append(stalled, t.snapshot(m))
+	}
+	return stalled, nil
+}
+
+// find returns the machine matching id by MAC, then UUID, then IP.
+// t.mu must be held.
+func (t *Tracker) find(id Identity) *Machine {
+	match := func(f func(m *Machine) bool) *Machine {
+		var found *Machine
+		for _, m := range t.machines {
+			if f(m) && (found == nil || m.Updated.After(found.Updated)) {
+				found = m
+			}
+		}
+		return found
+	}
+	if mac := normalizeMAC(id.MAC); mac != "" {
+		if m := match(func(m *Machine) bool { return m.MAC == mac }); m != nil {
+			return m
+		}
+		// A MAC identifies the machine on its own, so only adopt a
+		// machine seen by IP before its MAC was known.
+		if id.IP == "" {
+			return nil
+		}
+		return match(func(m *Machine) bool { return m.MAC == "" && m.IP == id.IP })
+	}
+	if uuid := strings.ToLower(id.UUID); uuid != "" {
+		if m := match(func(m *Machine) bool { return m.UUID == uuid }); m != nil {
+			return m
+		}
+	}
+	if id.IP != "" {
+		return match(func(m *Machine) bool { return m.IP == id.IP })
+	}
+	return nil
+}
+
+func (t *Tracker) stalled(m *Machine) bool {
+	timeout := t.StallTimeout
+	if timeout == 0 {
+		timeout = DefaultStallTimeout
+	}
+	done := m.Stage == StageIgnition || m.Stage == StageProvisioned || m.State == StateInstalled
+	return !done && t.time().Sub(m.Updated) > timeout
+}
+
+// snapshot returns a copy of m that is safe to use without t.mu.
+func (t *Tracker) snapshot(m *Machine) *Machine {
+	c := *m
+	c.Events = append([]Event(nil), m.Events...)
+	c.Stalled = t.stalled(m)
+	return &c
+}
+
+func (t *Tracker) time() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// makeRoom forgets the least recently updated machine that never started
+// installing when t holds MaxMachines. t.mu must be held.
+func (t *Tracker) makeRoom() error {
+	max := t.MaxMachines
+	if max == 0 {
+		max = DefaultMaxMachines
+	}
+	if len(t.machines) < max {
+		return nil
+	}
+	var oldest *Machine
+	for _, m := range t.machines {
+		if m.State != StateNew || m.Release != "" || m.ConfigPin != "" {
+			continue
+		}
+		if oldest == nil || m.Updated.Before(oldest.Updated) {
+			oldest = m
+		}
+	}
+	if oldest == nil {
+		return fmt.Errorf("tracking %d machines, none of which can be forgotten", len(t.machines))
+	}
+	if err := t.Store.Delete(Bucket, oldest.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	delete(t.machines, oldest.ID)
+	slog.Info("Forgot machine to make room", "id", oldest.ID, "updated", oldest.Updated)
+	return nil
+}
+
+func (t *Tracker) maxEvents() int {
+	if t.MaxEvents == 0 {
+		return DefaultMaxEvents
+	}
+	return t.MaxEvents
+}
+
+// Bucket is the store bucket holding one record per machine, keyed by ID.
+const Bucket = "machines"
+
+// load reads the machines from the store on first use. t.mu must be held.
+func (t *Tracker) load() error {
+	if t.loaded {
+		return nil
+	}
+	if t.Store == nil {
+		t.Store = store.NewMemory()
+	}
+	t.machines = make(map[string]*Machine)
+	err := t.Store.ForEach(Bucket, func(key string, value []byte) error {
+		m := &Machine{}
+		if err := json.Unmarshal(value, m); err != nil {
+			return fmt.Errorf("error reading machine %s: %w", key, err)
+		}
+		if m.State == "" {
+			m.State = StateNew
+		}
+		t.machines[m.ID] = m
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.loaded = true
+	return nil
+}
+
+// save writes m to the store. t.mu must be held.
+func (t *Tracker) save(m *Machine) error {
+	return store.PutJSON(t.Store, Bucket, m.ID, m)
+}
+
+// machineID picks the key for a new machine: its MAC, else its UUID,
+// else its IP address.
+func machineID(id Identity) string {
+	switch {
+	case id.MAC != "":
+		return normalizeMAC(id.MAC)
+	case id.UUID != "":
+		return strings.ToLower(id.UUID)
+	default:
+		return id.IP
+	}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$`)
+
+// validIdentity returns an error when the MAC or UUID of id is malformed.
+func validIdentity(id Identity) error {
+	if id.MAC != "" && !inventory.ValidMAC(id.MAC) {
+		return fmt.Errorf("invalid MAC address %q", id.MAC)
+	}
+	if id.UUID != "" && !uuidPattern.MatchString(id.UUID) {
+		return fmt.Errorf("invalid UUID %q", id.UUID)
+	}
+	return nil
+}
+
+func normalizeMAC(mac string) string {
+	return strings.ReplaceAll(strings.ToLower(mac), "-", ":")
+}
@@ -0,0 +1,161 @@
+package lifecycle
+
+import (
+	"errors"
+	"github.com/nveeser/corepxe/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	db, err := store.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tr := &Tracker{
+		Store:        db,
+		StallTimeout: time.Minute,
+		now:          func() time.Time { return now },
+	}
+	steps := []struct {
+		id    Identity
+		stage Stage
+	}{
+		{Identity{MAC: "AA-BB-CC-DD-EE-FF", IP: "10.0.0.5"}, StageIPXE},
+		{Identity{IP: "10.0.0.5"}, StageKernel},
+		{Identity{IP: "10.0.0.5"}, StageInitrd},
+		{Identity{MAC: "11:22:33:44:55:66", IP: "10.0.0.6"}, StageIPXE},
+	}
+	for _, s := range steps {
+		if err := tr.Record(s.id, Event{Stage: s.stage, Status: 200}); err != nil {
+			t.Fatalf("Record() got err %s", err)
+		}
+	}
+
+	m, err := tr.Machine("aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatalf("Machine() got err %s", err)
+	}
+	if m.Stage != StageInitrd || len(m.Events) != 3 {
+		t.Errorf("Machine() got stage %s with %d events wanted %s with 3", m.Stage, len(m.Events), StageInitrd)
+	}
+
+	now = now.Add(2 * time.Minute)
+	stalled, err := tr.CheckStalled()
+	if err != nil {
+		t.Fatalf("CheckStalled() got err %s", err)
+	}
+	if len(stalled) != 2 {
+		t.Errorf("CheckStalled() got %d machines wanted 2", len(stalled))
+	}
+	if stalled, _ := tr.CheckStalled(); len(stalled) != 0 {
+		t.Errorf("second CheckStalled() got %d machines wanted 0", len(stalled))
+	}
+
+	if err := tr.Record(Identity{IP: "10.0.0.5"}, Event{Stage: StageIgnition, Status: 200}); err != nil {
+		t.Fatalf("Record() got err %s", err)
+	}
+	now = now.Add(time.Hour)
+
+	// A new Tracker reads the timelines back from the store.
+	tr2 := &Tracker{Store: db, StallTimeout: time.Minute, now: tr.now}
+	ms, err := tr2.Machines()
+	if err != nil {
+		t.Fatalf("Machines() got err %s", err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("Machines() got %d wanted 2", len(ms))
+	}
+	if ms[0].ID != "aa:bb:cc:dd:ee:ff" || ms[0].Stage != StageIgnition || ms[0].Stalled {
+		t.Errorf("Machines()[0] got %s %s stalled=%v wanted aa:bb:cc:dd:ee:ff %s stalled=false", ms[0].ID, ms[0].Stage, ms[0].Stalled, StageIgnition)
+	}
+	if !ms[1].Stalled {
+		t.Errorf("Machines()[1] got stalled=false wanted true")
+	}
+}
+
+func TestTrackerInstalledNotStalled(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	db, err := store.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tr := &Tracker{
+		Store:          db,
+		StallTimeout:   time.Minute,
+		InstalledStage: StageIgnition,
+		now:            func() time.Time { return now },
+	}
+	id := Identity{MAC: "aa:bb:cc:dd:ee:ff"}
+	for _, stage := range []Stage{StageIPXE, StageIgnition, StageLocalBoot, StageIPXE} {
+		if err := tr.Record(id, Event{Stage: stage, Status: 200}); err != nil {
+			t.Fatalf("Record() got err %s", err)
+		}
+	}
+	now = now.Add(time.Hour)
+	m, err := tr.Machine(id.MAC)
+	if err != nil {
+		t.Fatalf("Machine() got err %s", err)
+	}
+	if m.State != StateInstalled || m.Stalled {
+		t.Errorf("Machine() got state %s stalled=%v wanted %s stalled=false", m.State, m.Stalled, StateInstalled)
+	}
+}
+
+func TestTrackerRejectsInvalidIdentity(t *testing.T) {
+	tr := &Tracker{}
+	for _, id := range []Identity{
+		{MAC: "not-a-mac"},
+		{MAC: "aa:bb:cc:dd:ee:ff:00"},
+		{UUID: "../../etc"},
+		{MAC: "aa:bb:cc:dd:ee:ff", UUID: "1234"},
+	} {
+		if err := tr.Record(id, Event{Stage: StageIPXE, Status: 200}); err == nil {
+			t.Errorf("Record(%+v) got nil err", id)
+		}
+	}
+	if err := tr.Record(Identity{UUID: "4C4C4544-0042-3510-8052-B4C04F384D32"}, Event{Stage: StageIPXE, Status: 200}); err != nil {
+		t.Errorf("Record() with a valid UUID got err %s", err)
+	}
+	if ms, _ := tr.Machines(); len(ms) != 1 {
+		t.Errorf("Machines() got %d wanted 1", len(ms))
+	}
+}
+
+func TestTrackerMaxMachines(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tr := &Tracker{
+		MaxMachines: 2,
+		now:         func() time.Time { return now },
+	}
+	record := func(mac string, status int) error {
+		now = now.Add(time.Minute)
+		return tr.Record(Identity{MAC: mac}, Event{Stage: StageIPXE, Status: status})
+	}
+	if err := record("aa:aa:aa:aa:aa:01", 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := record("aa:aa:aa:aa:aa:02", 404); err != nil {
+		t.Fatal(err)
+	}
+	// The unknown machine that never started installing makes room.
+	if err := record("aa:aa:aa:aa:aa:03", 200); err != nil {
+		t.Fatalf("Record() past MaxMachines got err %s", err)
+	}
+	if _, err := tr.Machine("aa:aa:aa:aa:aa:02"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Machine(02) got err %v wanted ErrNotFound", err)
+	}
+	if _, err := tr.Machine("aa:aa:aa:aa:aa:01"); err != nil {
+		t.Errorf("Machine(01) got err %s wanted the installing machine kept", err)
+	}
+	if err := record("aa:aa:aa:aa:aa:04", 404); err == nil {
+		t.Errorf("Record() with only installing machines got nil err")
+	}
+	if ms, _ := tr.Machines(); len(ms) != 2 {
+		t.Errorf("Machines() got %d wanted 2", len(ms))
+	}
+}
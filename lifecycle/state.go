@@ -0,0 +1,126 @@
+package lifecycle
+
+import (
+	"fmt"
+)
+
+// State is a machine's place in the install-once state machine:
+//
+//	new -> installing -> installed -> reinstall-requested -> installing ...
+//
+// A machine starts installing when it boots the installer, and is
+// installed once it reaches Tracker.InstalledStage. Installed machines are
+// booted from their local disk until a reinstall is requested.
+type State string
+
+const (
+	StateNew        State = "new"
+	StateInstalling State = "installing"
+	StateInstalled  State = "installed"
+	StateReinstall  State = "reinstall-requested"
+)
+
+// advance moves m along the state machine after a successful request for
+// stage. t.mu must be held.
+func (t *Tracker) advance(m *Machine, stage Stage) {
+	installed := t.InstalledStage
+	if installed == "" {
+		installed = StageProvisioned
+	}
+	switch {
+	case stage == installed && m.State == StateInstalling:
+		m.State = StateInstalled
+	case stage == StageProvisioned:
+		// The installed OS reported in, whatever we thought before.
+		m.State = StateInstalled
+	case (stage == StageIPXE || stage == StageKernel) && (m.State == StateNew || m.State == StateReinstall):
+		m.State = StateInstalling
+	}
+}
+
+// RequestReinstall moves the machines with the given IDs (or MACs or
+// UUIDs) to StateReinstall, so they boot the installer on their next PXE
+// boot. Machines that are not yet installed are left as they are.
+func (t *Tracker) RequestReinstall(ids ...string) ([]*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	var ms []*Machine
+	for _, id := range ids {
+		m := t.lookup(id)
+		if m == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		ms = append(ms, m)
+	}
+	var changed []*Machine
+	for _, m := range ms {
+		if m.State != StateInstalled {
+			continue
+		}
+		m.State = StateReinstall
+		if err := t.save(m); err != nil {
+			return nil, err
+		}
+		changed = append(changed, t.snapshot(m))
+	}
+	return changed, nil
+}
+
+// HostMachines returns the IDs of the machines that last fetched Ignition
+// for host ("<osname>/<host>").
+func (t *Tracker) HostMachines(host string) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range t.machines {
+		if m.Host == host {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Pin sets the CoreOS release the machine with the given ID (or MAC or
+// UUID) boots. An empty release unpins the machine.
+func (t *Tracker) Pin(id, release string) (*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	m := t.lookup(id)
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	m.Release = release
+	if err := t.save(m); err != nil {
+		return nil, err
+	}
+	return t.snapshot(m), nil
+}
+
+// PinConfig sets the config revision the Ignition config of the machine
+// with the given ID (or MAC or UUID) is rendered from. An empty revision
+// unpins the machine.
+func (t *Tracker) PinConfig(id, revision string) (*Machine, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	m := t.lookup(id)
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	m.ConfigPin = revision
+	if err := t.save(m); err != nil {
+		return nil, err
+	}
+	return t.snapshot(m), nil
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nveeser/corepxe/accesslog"
+	"github.com/nveeser/corepxe/coreos"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/secrets"
 	"github.com/nveeser/corepxe/server"
-	"log"
+	"github.com/nveeser/corepxe/token"
+	"log/slog"
 	"os"
+	"strings"
 )
 
 var srv server.IPXE
@@ -11,6 +20,7 @@ var srv server.IPXE
 var defaultConfigDir = "/home/nicholas/pxe-files/configs/"
 var defaultImageDir = "/home/nicholas/pxe-files/images/"
 var defaultListenAddr = "0.0.0.0:8086"
+var defaultStateDir = "/home/nicholas/pxe-files/state/"
 
 func init() {
 	srv.ConfigDir = os.Getenv("COREPXE_SERVER_CONFIG_DIR")
@@ -25,8 +35,229 @@ func init() {
 	if srv.ListenAddr == "" {
 		srv.ListenAddr = defaultListenAddr
 	}
+	srv.StateDir = os.Getenv("COREPXE_SERVER_STATE_DIR")
+	if srv.StateDir == "" {
+		srv.StateDir = defaultStateDir
+	}
+	srv.ExternalURL = os.Getenv("COREPXE_SERVER_EXTERNAL_URL")
+	srv.TLSCertFile = os.Getenv("COREPXE_SERVER_TLS_CERT")
+	srv.TLSKeyFile = os.Getenv("COREPXE_SERVER_TLS_KEY")
+	srv.TLSClientCAFile = os.Getenv("COREPXE_SERVER_TLS_CLIENT_CA")
+	trustedProxies = os.Getenv("COREPXE_SERVER_TRUSTED_PROXIES")
+}
+
+// trustedProxies is the comma separated form of srv.TrustedProxies.
+var trustedProxies string
+
+// Flags that build srv.IgnitionTokens.
+var (
+	tokenKeyFile string
+	tokenSigner  = &token.Signer{}
+)
+
+// command is a (sub)command of the corepxe binary. A command either runs
+// directly or dispatches to one of its subcommands.
+type command struct {
+	name  string
+	args  string
+	help  string
+	flags func(fs *flag.FlagSet)
+	run   func(args []string) error
+	subs  []*command
+}
+
+// errUsage is returned by commands invoked with the wrong arguments.
+var errUsage = errors.New("invalid usage")
+
+var commands = &command{
+	name: "corepxe",
+	subs: []*command{
+		serveCmd,
+		renderCmd,
+		mirrorCmd,
+		validateCmd,
+		diffCmd,
+		rollbackCmd,
+		stateCmd,
+		bmcCmd,
+	},
+}
+
+var serveCmd = &command{
+	name: "serve",
+	help: "run the iPXE boot server",
+	flags: func(fs *flag.FlagSet) {
+		fs.DurationVar(&srv.ShutdownTimeout, "shutdown-timeout", server.DefaultShutdownTimeout, "how long to wait for in-flight requests on SIGTERM")
+		fs.DurationVar(&srv.StallTimeout, "stall-timeout", lifecycle.DefaultStallTimeout, "time without progress after which an install is reported stalled")
+		fs.DurationVar(&srv.StreamMaxAge, "stream-max-age", coreos.DefaultMaxAge, "how long CoreOS stream metadata is served before it is fetched again")
+	},
+	run: func(args []string) error {
+		return srv.Run()
+	},
 }
 
 func main() {
-	log.Fatal(srv.Run())
+	fs := flag.NewFlagSet("corepxe", flag.ExitOnError)
+	fs.StringVar(&srv.ConfigDir, "config-dir", srv.ConfigDir, "config directory (env COREPXE_SERVER_CONFIG_DIR)")
+	fs.StringVar(&srv.ConfigRepo, "config-repo", os.Getenv("COREPXE_SERVER_CONFIG_REPO"), "git repository, bare or a work tree, to serve configs from instead of the config directory; its inventory.yaml only seeds the state database (env COREPXE_SERVER_CONFIG_REPO)")
+	fs.StringVar(&srv.ConfigRevision, "config-rev", "HEAD", "git revision of -config-repo to serve, resolved again on SIGHUP")
+	fs.StringVar(&srv.ImageDir, "image-dir", srv.ImageDir, "image directory (env COREPXE_SERVER_IMAGE_DIR)")
+	fs.StringVar(&srv.StateDir, "state-dir", srv.StateDir, "state directory, empty to disable machine tracking (env COREPXE_SERVER_STATE_DIR)")
+	fs.BoolVar(&srv.PhoneHome, "phone-home", false, "add a first boot report unit to every Ignition config; needs -token-key-file")
+	fs.BoolVar(&srv.LocalBootAfterInstall, "local-boot-after-install", false, "boot machines from disk once they report their first boot")
+	fs.StringVar(&srv.InventoryFile, "inventory", os.Getenv("COREPXE_SERVER_INVENTORY"), "inventory file, default inventory.yaml in the config directory (env COREPXE_SERVER_INVENTORY)")
+	fs.BoolVar(&srv.InventoryInStore, "inventory-in-store", false, "keep the inventory in the state database; the inventory file only seeds it")
+	fs.BoolVar(&srv.Discovery, "discovery", false, "boot machines missing from the inventory into hardware discovery")
+	fs.StringVar(&srv.APITokenFile, "api-token-file", os.Getenv("COREPXE_SERVER_API_TOKEN_FILE"), "bearer tokens, one per line; enables /api/v1, /admin and the dashboard (env COREPXE_SERVER_API_TOKEN_FILE)")
+	fs.StringVar(&srv.SecretsEnvPrefix, "secrets-env-prefix", "", "resolve Butane secret references from environment variables with this prefix, e.g. "+secrets.DefaultEnvPrefix)
+	fs.StringVar(&srv.SecretsAgeDir, "secrets-age-dir", os.Getenv("COREPXE_SERVER_SECRETS_AGE_DIR"), "resolve Butane secret references from <ref>.age files in this directory (env COREPXE_SERVER_SECRETS_AGE_DIR)")
+	fs.StringVar(&srv.SecretsAgeIdentityFile, "secrets-age-identity", os.Getenv("COREPXE_SERVER_SECRETS_AGE_IDENTITY"), "age identity file decrypting -secrets-age-dir (env COREPXE_SERVER_SECRETS_AGE_IDENTITY)")
+	fs.StringVar(&srv.VaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "resolve Butane secret references from this Vault server (env VAULT_ADDR)")
+	fs.StringVar(&srv.VaultMount, "vault-mount", secrets.DefaultVaultMount, "mount path of the Vault KV version 2 secrets engine")
+	fs.StringVar(&srv.VaultTokenFile, "vault-token-file", os.Getenv("COREPXE_SERVER_VAULT_TOKEN_FILE"), "file holding the Vault token (env COREPXE_SERVER_VAULT_TOKEN_FILE)")
+	fs.StringVar(&srv.ListenAddr, "listen", srv.ListenAddr, "listen address (env COREPXE_SERVER_LISTEN_ADDR)")
+	fs.StringVar(&srv.ExternalURL, "external-url", srv.ExternalURL, "base URL clients use to reach the server (env COREPXE_SERVER_EXTERNAL_URL)")
+	fs.StringVar(&srv.TLSCertFile, "tls-cert", srv.TLSCertFile, "TLS certificate file, enables HTTPS on -tls-listen next to HTTP (env COREPXE_SERVER_TLS_CERT)")
+	fs.StringVar(&srv.TLSListenAddr, "tls-listen", os.Getenv("COREPXE_SERVER_TLS_LISTEN_ADDR"), "HTTPS listen address, default "+server.DefaultTLSListenAddr+" (env COREPXE_SERVER_TLS_LISTEN_ADDR)")
+	fs.StringVar(&srv.TLSKeyFile, "tls-key", srv.TLSKeyFile, "TLS key file (env COREPXE_SERVER_TLS_KEY)")
+	fs.StringVar(&srv.TLSClientCAFile, "tls-client-ca", srv.TLSClientCAFile, "CA bundle to verify client certificates (env COREPXE_SERVER_TLS_CLIENT_CA)")
+	fs.StringVar(&trustedProxies, "trusted-proxies", trustedProxies, "comma separated proxy addresses/CIDRs allowed to set X-Forwarded-* (env COREPXE_SERVER_TRUSTED_PROXIES)")
+	fs.StringVar(&tokenKeyFile, "token-key-file", os.Getenv("COREPXE_SERVER_TOKEN_KEY_FILE"), "HMAC key file; requires signed tokens to fetch Ignition (env COREPXE_SERVER_TOKEN_KEY_FILE)")
+	fs.DurationVar(&tokenSigner.TTL, "token-ttl", token.DefaultTTL, "lifetime of Ignition tokens")
+	fs.BoolVar(&tokenSigner.OneTime, "token-one-time", false, "Ignition tokens may only be used once")
+	fs.BoolVar(&tokenSigner.BindIP, "token-bind-ip", false, "Ignition tokens are only valid from the IP that fetched the iPXE script")
+	fs.BoolVar(&tokenSigner.BindMAC, "token-bind-mac", false, "Ignition tokens are only valid for the MAC that fetched the iPXE script")
+	fs.StringVar(&logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	fs.StringVar(&srv.AccessLog, "access-log", os.Getenv("COREPXE_SERVER_ACCESS_LOG"), "JSONL access log file (env COREPXE_SERVER_ACCESS_LOG)")
+	fs.Int64Var(&srv.AccessLogMaxSize, "access-log-max-size", accesslog.DefaultMaxSize, "rotate the access log at this many bytes")
+	fs.IntVar(&srv.AccessLogMaxBackups, "access-log-max-backups", 5, "number of rotated access logs to keep")
+	fs.Uint64Var(&srv.MinFreeDisk, "min-free-disk", server.DefaultMinFreeDisk, "free bytes in the image directory below which /readyz fails")
+	fs.Usage = func() { commands.usage(fs, "") }
+	fs.Parse(os.Args[1:])
+	if err := setupLogging(); err != nil {
+		fatal(err)
+	}
+	if trustedProxies != "" {
+		srv.TrustedProxies = strings.Split(trustedProxies, ",")
+	}
+	if tokenKeyFile != "" {
+		key, err := token.ReadKeyFile(tokenKeyFile)
+		if err != nil {
+			fatal(err)
+		}
+		tokenSigner.Key = key
+		srv.IgnitionTokens = tokenSigner
+	}
+
+	args := fs.Args()
+	if len(args) == 0 {
+		// Without a command behave as before subcommands existed.
+		args = []string{serveCmd.name}
+	}
+	if err := commands.dispatch("", args); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fatal(err)
+	}
+}
+
+var (
+	logLevel  string
+	logFormat string
+)
+
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("invalid -log-format: %q", logFormat)
+	}
+	return nil
+}
+
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
+
+func (c *command) dispatch(prefix string, args []string) error {
+	path := c.name
+	if prefix != "" {
+		path = prefix + " " + c.name
+	}
+	if c.subs == nil {
+		fs := flag.NewFlagSet(path, flag.ContinueOnError)
+		if c.flags != nil {
+			c.flags(fs)
+		}
+		fs.Usage = func() { c.usage(fs, prefix) }
+		args, err := parseInterspersed(fs, args)
+		if err != nil {
+			return errUsage
+		}
+		return c.run(args)
+	}
+	if len(args) == 0 {
+		c.usage(nil, prefix)
+		return errUsage
+	}
+	for _, sub := range c.subs {
+		if sub.name == args[0] {
+			return sub.dispatch(path, args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n", path, args[0])
+	c.usage(nil, prefix)
+	return errUsage
+}
+
+func (c *command) usage(fs *flag.FlagSet, prefix string) {
+	path := c.name
+	if prefix != "" {
+		path = prefix + " " + c.name
+	}
+	out := os.Stderr
+	if c.subs == nil {
+		fmt.Fprintf(out, "usage: %s [flags] %s\n", path, c.args)
+		if c.help != "" {
+			fmt.Fprintf(out, "\n%s\n", c.help)
+		}
+	} else {
+		fmt.Fprintf(out, "usage: %s <command> [args]\n\ncommands:\n", path)
+		for _, sub := range c.subs {
+			fmt.Fprintf(out, "  %-10s %s\n", sub.name, sub.help)
+		}
+	}
+	if fs != nil {
+		fmt.Fprintln(out, "\nflags:")
+		fs.PrintDefaults()
+	}
+}
+
+// parseInterspersed parses flags in args wherever they appear, rather than
+// stopping at the first positional argument, and returns the positional
+// arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
@@ -0,0 +1,95 @@
+// Package metrics defines the Prometheus metrics exported by corepxe.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Registry holds every corepxe metric along with the Go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "corepxe_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "corepxe_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: []float64{.005, .01, .05, .1, .5, 1, 5, 15, 60, 300},
+	}, []string{"route", "method"})
+
+	MirrorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "corepxe_mirror_requests_total",
+		Help: "Image mirror requests by filetype (kernel, initrd or rootfs) and result (hit, miss or error).",
+	}, []string{"filetype", "result"})
+
+	MirrorBytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "corepxe_mirror_served_bytes_total",
+		Help: "Bytes of image data sent to clients by filetype.",
+	}, []string{"filetype"})
+
+	MirrorBytesDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "corepxe_mirror_downloaded_bytes_total",
+		Help: "Bytes of image data downloaded from upstream by filetype.",
+	}, []string{"filetype"})
+
+	MirrorDownloadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "corepxe_mirror_downloads_in_flight",
+		Help: "Upstream image downloads currently in progress.",
+	})
+
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "corepxe_upstream_errors_total",
+		Help: "Failed upstream fetches by kind (image or stream).",
+	}, []string{"kind"})
+
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "corepxe_upstream_duration_seconds",
+		Help:    "Duration of upstream fetches by kind (image or stream).",
+		Buckets: []float64{.1, .5, 1, 5, 15, 60, 300, 900},
+	}, []string{"kind"})
+
+	StreamLoaded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "corepxe_stream_loaded_timestamp_seconds",
+		Help: "When the stream metadata was loaded into the cache.",
+	}, []string{"stream"})
+
+	StreamLastModified = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "corepxe_stream_last_modified_timestamp_seconds",
+		Help: "The last-modified time recorded in the cached stream metadata.",
+	}, []string{"stream"})
+
+	IgnitionRenderFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "corepxe_ignition_render_failures_total",
+		Help: "Failed Ignition renders by osname and host.",
+	}, []string{"osname", "host"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		MirrorRequests,
+		MirrorBytesServed,
+		MirrorBytesDownloaded,
+		MirrorDownloadsInFlight,
+		UpstreamErrors,
+		UpstreamDuration,
+		StreamLoaded,
+		StreamLastModified,
+		IgnitionRenderFailures,
+	)
+}
+
+// Handler serves Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
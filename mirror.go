@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/nveeser/corepxe/coreos"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+var mirrorCmd = &command{
+	name: "mirror",
+	help: "manage the image mirror in the image directory",
+	subs: []*command{
+		mirrorSyncCmd,
+		mirrorLsCmd,
+		mirrorGCCmd,
+	},
+}
+
+var mirrorSyncFlags struct {
+	streams string
+	arch    string
+	offline bool
+}
+
+var mirrorSyncCmd = &command{
+	name: "sync",
+	help: "refresh stream metadata and download the current PXE images",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&mirrorSyncFlags.streams, "stream", "stable", "comma separated list of streams")
+		fs.StringVar(&mirrorSyncFlags.arch, "arch", "x86_64", "architecture")
+		fs.BoolVar(&mirrorSyncFlags.offline, "offline", false, "use the cached stream metadata instead of refreshing it")
+	},
+	run: func(args []string) error {
+		if len(args) != 0 {
+			return usageError("mirror sync")
+		}
+		streams := srv.Streams()
+		m := srv.Mirror()
+		for _, name := range strings.Split(mirrorSyncFlags.streams, ",") {
+			if !mirrorSyncFlags.offline {
+				if _, err := streams.Refresh(name); err != nil {
+					slog.Warn("Using cached stream", "stream", name, "err", err)
+				}
+			}
+			artifacts, err := streams.PXEArtifacts(name, mirrorSyncFlags.arch)
+			if err != nil {
+				return fmt.Errorf("stream %s: %w", name, err)
+			}
+			for _, ft := range coreos.FileTypes {
+				artifact, ok := artifacts[ft]
+				if !ok {
+					continue
+				}
+				asset, err := coreos.NewAsset(ft, artifact)
+				if err != nil {
+					return err
+				}
+				fetched, err := m.Fetch(asset)
+				if err != nil {
+					return fmt.Errorf("stream %s: %s: %w", name, ft, err)
+				}
+				state := "present"
+				if fetched {
+					state = "fetched"
+				}
+				fmt.Printf("%s\t%s\t%s\n", name, state, asset.RelativePath())
+			}
+		}
+		return nil
+	},
+}
+
+var mirrorLsCmd = &command{
+	name: "ls",
+	help: "list the files in the mirror",
+	run: func(args []string) error {
+		if len(args) != 0 {
+			return usageError("mirror ls")
+		}
+		entries, err := srv.Mirror().List()
+		if err != nil {
+			return err
+		}
+		refs, err := srv.Streams().Referenced()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, e := range entries {
+			state := ""
+			if refs[e.Path] {
+				state = "current"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", e.Path, e.Size, e.ModTime.Format("2006-01-02 15:04"), state)
+		}
+		return tw.Flush()
+	},
+}
+
+var mirrorGCDryRun bool
+
+var mirrorGCCmd = &command{
+	name: "gc",
+	help: "remove images no longer referenced by any cached stream",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&mirrorGCDryRun, "n", false, "only print what would be removed")
+	},
+	run: func(args []string) error {
+		if len(args) != 0 {
+			return usageError("mirror gc")
+		}
+		m := srv.Mirror()
+		entries, err := m.List()
+		if err != nil {
+			return err
+		}
+		refs, err := srv.Streams().Referenced()
+		if err != nil {
+			return err
+		}
+		pinned, err := pinnedReleases()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			// Keep the stream metadata along with the images it names,
+			// and the images of releases machines are pinned to.
+			if refs[e.Path] || path.Ext(e.Path) == ".json" || pinned(e.Path) {
+				continue
+			}
+			fmt.Printf("remove %s\n", e.Path)
+			if mirrorGCDryRun {
+				continue
+			}
+			if err := m.Remove(e.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// pinnedReleases returns a function reporting whether a mirror path
+// belongs to a release some machine is pinned to.
+func pinnedReleases() (func(p string) bool, error) {
+	var releases []string
+	// Fail rather than forget the pins when the state is unavailable.
+	if _, err := srv.State(); err != nil {
+		return nil, err
+	}
+	defer srv.Close()
+	if t := srv.Tracker(); t != nil {
+		machines, err := t.Machines()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range machines {
+			if m.Release != "" {
+				releases = append(releases, m.Release)
+			}
+		}
+	}
+	return func(p string) bool {
+		for _, r := range releases {
+			if strings.Contains(path.Base(p), "-"+r+"-") {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
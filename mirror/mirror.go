@@ -3,17 +3,23 @@ package mirror
 import (
 	"errors"
 	"fmt"
+	"github.com/nveeser/corepxe/accesslog"
+	"github.com/nveeser/corepxe/metrics"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type ImageAsset interface {
 	RelativePath() string
+	// Kind is the type of file the asset is, e.g. "kernel", "initrd" or
+	// "rootfs". It labels the mirror metrics, so it takes few values.
+	Kind() string
 	Download(dir string) error
 }
 
@@ -22,35 +28,131 @@ type ImageMirror struct {
 }
 
 func (h *ImageMirror) ServeAsset(w http.ResponseWriter, r *http.Request, asset ImageAsset) {
+	name := asset.RelativePath()
+	fetched, err := h.Fetch(asset)
+	if err != nil {
+		metrics.MirrorRequests.WithLabelValues(asset.Kind(), "error").Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cache := "hit"
+	if fetched {
+		cache = "miss"
+	}
+	metrics.MirrorRequests.WithLabelValues(asset.Kind(), cache).Inc()
+	accesslog.Annotate(r.Context(), slog.String("cache", cache))
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeFile(cw, r, filepath.Join(h.RootDir, name))
+	metrics.MirrorBytesServed.WithLabelValues(asset.Kind()).Add(float64(cw.n))
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Fetch makes sure asset is present in the mirror, downloading it if it
+// is missing. It reports whether a download was needed.
+func (h *ImageMirror) Fetch(asset ImageAsset) (bool, error) {
 	localFile := filepath.Join(h.RootDir, asset.RelativePath())
 	_, err := os.Stat(localFile)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		http.Error(w, fmt.Sprintf("Stat Error: %s", err), http.StatusInternalServerError)
-		return
+		return false, fmt.Errorf("stat error: %w", err)
 	}
 	if err == nil {
-		http.ServeFile(w, r, localFile)
-		return
+		return false, nil
 	}
 	err = os.MkdirAll(filepath.Dir(localFile), 0755)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error Creating local dir: %s", err), http.StatusInternalServerError)
-		return
+		return false, fmt.Errorf("error creating local dir: %w", err)
 	}
-	log.Printf("[Image] Fetching %s", asset.RelativePath())
-	if err = asset.Download(h.RootDir); err != nil {
-		http.Error(w, fmt.Sprintf("Remote Error: %s", err), http.StatusInternalServerError)
-		return
+	slog.Info("Image fetching", "artifact", asset.RelativePath())
+	metrics.MirrorDownloadsInFlight.Inc()
+	start := time.Now()
+	err = asset.Download(h.RootDir)
+	metrics.MirrorDownloadsInFlight.Dec()
+	metrics.UpstreamDuration.WithLabelValues("image").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues("image").Inc()
+		return false, fmt.Errorf("remote error: %w", err)
+	}
+	if info, err := os.Stat(localFile); err == nil {
+		metrics.MirrorBytesDownloaded.WithLabelValues(asset.Kind()).Add(float64(info.Size()))
+	}
+	return true, nil
+}
+
+// Has reports whether asset is present in the mirror, without downloading
+// it.
+func (h *ImageMirror) Has(asset ImageAsset) (bool, error) {
+	_, err := os.Stat(filepath.Join(h.RootDir, asset.RelativePath()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Entry describes a file held in the mirror.
+type Entry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// List returns every regular file in the mirror, with paths relative to
+// RootDir.
+func (h *ImageMirror) List() ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(h.RootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(h.RootDir, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, Entry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// Remove deletes the file at relpath from the mirror.
+func (h *ImageMirror) Remove(relpath string) error {
+	if !filepath.IsLocal(relpath) {
+		return fmt.Errorf("invalid path: %s", relpath)
 	}
-	http.ServeFile(w, r, localFile)
+	return os.Remove(filepath.Join(h.RootDir, relpath))
 }
 
 type urlAsset struct {
 	remote  *url.URL
 	relpath string
+	kind    string
 }
 
 func (a *urlAsset) RelativePath() string { return a.relpath }
+func (a *urlAsset) Kind() string         { return a.kind }
 
 func (a *urlAsset) Download(dir string) error {
 	u := *a.remote
@@ -60,11 +162,11 @@ func (a *urlAsset) Download(dir string) error {
 		return err
 	}
 	localpath := filepath.Join(dir, a.relpath)
-	log.Printf("Fetch %s -> %s", u.String(), localpath)
+	slog.Info("Fetch", "url", u.String(), "path", localpath)
 
 	resp, err := http.Get(u.String())
 	if err != nil {
-		log.Printf("Error getting Image: %s: %s", u.String(), err)
+		slog.Warn("Error getting image", "url", u.String(), "err", err)
 		return err
 	}
 	if err := errRemote(resp); err != nil {
@@ -89,7 +191,7 @@ func errRemote(r *http.Response) error {
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error dumping response: %s", err)
+		slog.Warn("Error dumping response", "err", err)
 	}
 	if len(body) > 100 {
 		body = body[:100]
@@ -1,6 +1,8 @@
 package mirror
 
 import (
+	"github.com/nveeser/corepxe/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	rand "math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -33,6 +35,7 @@ func TestMirrorHandler(t *testing.T) {
 	asset := &urlAsset{
 		remote:  remoteu,
 		relpath: "foo/data",
+		kind:    "rootfs",
 	}
 	{
 		r := httptest.NewRequest("GET", "/", nil)
@@ -58,4 +61,45 @@ func TestMirrorHandler(t *testing.T) {
 	if called != 1 {
 		t.Errorf("remote got called %d times wanted %d", called, 1)
 	}
+	for _, result := range []string{"hit", "miss"} {
+		if got := testutil.ToFloat64(metrics.MirrorRequests.WithLabelValues("rootfs", result)); got != 1 {
+			t.Errorf("MirrorRequests[%s] got %v wanted 1", result, got)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.MirrorBytesServed.WithLabelValues("rootfs")); got != 2<<10 {
+		t.Errorf("MirrorBytesServed got %v wanted %d", got, 2<<10)
+	}
+}
+
+func TestMirrorListRemove(t *testing.T) {
+	imageDir := t.TempDir()
+	mirror := ImageMirror{imageDir}
+	if err := os.MkdirAll(filepath.Join(imageDir, "coreos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "coreos", "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := mirror.List()
+	if err != nil {
+		t.Fatalf("List() got err %s", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "coreos/data" || entries[0].Size != 4 {
+		t.Errorf("List() got %+v wanted [coreos/data]", entries)
+	}
+
+	if err := mirror.Remove("../data"); err == nil {
+		t.Errorf("Remove(../data) got nil wanted err")
+	}
+	if err := mirror.Remove("coreos/data"); err != nil {
+		t.Errorf("Remove() got err %s", err)
+	}
+	entries, err = mirror.List()
+	if err != nil {
+		t.Fatalf("List() got err %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("List() got %+v wanted []", entries)
+	}
 }
@@ -0,0 +1,218 @@
+// Package redfish is a minimal client for the DMTF Redfish API of a
+// machine's BMC: enough to read the power state, set a one-time boot
+// override and reset the machine.
+package redfish
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Power states of a computer system.
+const (
+	PowerOn  = "On"
+	PowerOff = "Off"
+)
+
+// Reset types of the ComputerSystem.Reset action.
+const (
+	ResetOn           = "On"
+	ResetForceOff     = "ForceOff"
+	ResetForceRestart = "ForceRestart"
+)
+
+// BootPXE is the boot source override target for network boot.
+const BootPXE = "Pxe"
+
+// DefaultTimeout bounds each request to the BMC.
+const DefaultTimeout = 30 * time.Second
+
+// Boot is the boot override of a computer system.
+type Boot struct {
+	BootSourceOverrideEnabled string `json:"BootSourceOverrideEnabled,omitempty"`
+	BootSourceOverrideTarget  string `json:"BootSourceOverrideTarget,omitempty"`
+}
+
+// System is the part of a Redfish ComputerSystem corepxe uses.
+type System struct {
+	ID         string `json:"Id"`
+	PowerState string `json:"PowerState"`
+	Boot       Boot   `json:"Boot"`
+}
+
+// Client talks to the BMC at Endpoint, e.g. "https://10.0.0.10", with
+// HTTP basic authentication.
+type Client struct {
+	Endpoint string
+	Username string
+	Password string
+	// System is the path of the computer system, e.g.
+	// "/redfish/v1/Systems/1". When empty the first member of
+	// /redfish/v1/Systems is used.
+	System string
+	// Insecure skips verification of the BMC's TLS certificate, which
+	// is usually self-signed.
+	Insecure bool
+	// HTTPClient is used to make requests; nil means a client with
+	// DefaultTimeout.
+	HTTPClient *http.Client
+}
+
+// Error is a failed Redfish request.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("redfish: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Status returns the computer system.
+func (c *Client) Status(ctx context.Context) (*System, error) {
+	path, err := c.system(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &System{}
+	return s, c.do(ctx, "GET", path, nil, s)
+}
+
+// SetBootOnce makes the system boot from target, e.g. BootPXE, on its
+// next boot only.
+func (c *Client) SetBootOnce(ctx context.Context, target string) error {
+	path, err := c.system(ctx)
+	if err != nil {
+		return err
+	}
+	body := map[string]any{
+		"Boot": &Boot{BootSourceOverrideEnabled: "Once", BootSourceOverrideTarget: target},
+	}
+	return c.do(ctx, "PATCH", path, body, nil)
+}
+
+// Reset performs the ComputerSystem.Reset action with resetType.
+func (c *Client) Reset(ctx context.Context, resetType string) error {
+	path, err := c.system(ctx)
+	if err != nil {
+		return err
+	}
+	body := map[string]string{"ResetType": resetType}
+	return c.do(ctx, "POST", path+"/Actions/ComputerSystem.Reset", body, nil)
+}
+
+// PXEBoot makes the system network boot once: it sets the boot override
+// and then restarts the system, or powers it on if it is off.
+func (c *Client) PXEBoot(ctx context.Context) error {
+	if err := c.SetBootOnce(ctx, BootPXE); err != nil {
+		return err
+	}
+	s, err := c.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if s.PowerState == PowerOff {
+		return c.Reset(ctx, ResetOn)
+	}
+	return c.Reset(ctx, ResetForceRestart)
+}
+
+// system returns the path of the computer system, looking it up the
+// first time.
+func (c *Client) system(ctx context.Context) (string, error) {
+	if c.System != "" {
+		return c.System, nil
+	}
+	var systems struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		} `json:"Members"`
+	}
+	if err := c.do(ctx, "GET", "/redfish/v1/Systems", nil, &systems); err != nil {
+		return "", err
+	}
+	if len(systems.Members) == 0 {
+		return "", errors.New("redfish: the BMC lists no computer systems")
+	}
+	c.System = systems.Members[0].ID
+	return c.System, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.Endpoint, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(c.Username, c.Password)
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &Error{StatusCode: resp.StatusCode, Message: errorMessage(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	hc := &http.Client{Timeout: DefaultTimeout}
+	if c.Insecure {
+		hc.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	c.HTTPClient = hc
+	return hc
+}
+
+// errorMessage returns the message of a Redfish error response, preferring
+// the more specific extended info.
+func errorMessage(data []byte) string {
+	var resp struct {
+		Error struct {
+			Message  string `json:"message"`
+			Extended []struct {
+				Message string `json:"Message"`
+			} `json:"@Message.ExtendedInfo"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &resp) != nil {
+		return strings.TrimSpace(string(data))
+	}
+	if len(resp.Error.Extended) > 0 && resp.Error.Extended[0].Message != "" {
+		return resp.Error.Extended[0].Message
+	}
+	return resp.Error.Message
+}
@@ -0,0 +1,49 @@
+package redfish_test
+
+import (
+	"context"
+	"errors"
+	"github.com/nveeser/corepxe/redfish"
+	"github.com/nveeser/corepxe/redfish/redfishtest"
+	"net/http"
+	"testing"
+)
+
+func TestPXEBoot(t *testing.T) {
+	bmc := redfishtest.NewServer("admin", "secret")
+	defer bmc.Close()
+	ctx := context.Background()
+
+	c := &redfish.Client{Endpoint: bmc.URL, Username: "admin", Password: "secret"}
+	if err := c.PXEBoot(ctx); err != nil {
+		t.Fatalf("PXEBoot() got err %s", err)
+	}
+	if c.System != redfishtest.SystemPath {
+		t.Errorf("System got %q wanted %q", c.System, redfishtest.SystemPath)
+	}
+	if boots := bmc.Boots(); len(boots) != 1 || boots[0] != redfish.BootPXE {
+		t.Errorf("system booted %v wanted [%s]", boots, redfish.BootPXE)
+	}
+
+	// A system that is off is powered on instead of restarted.
+	bmc.SetPowerState(redfish.PowerOff)
+	if err := c.PXEBoot(ctx); err != nil {
+		t.Fatalf("PXEBoot() got err %s", err)
+	}
+	if resets := bmc.Resets(); len(resets) != 2 || resets[1] != redfish.ResetOn {
+		t.Errorf("resets got %v wanted [%s %s]", resets, redfish.ResetForceRestart, redfish.ResetOn)
+	}
+	s, err := c.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status() got err %s", err)
+	}
+	if s.PowerState != redfish.PowerOn || s.Boot.BootSourceOverrideEnabled != "Disabled" {
+		t.Errorf("Status() got %+v wanted on with the override consumed", s)
+	}
+
+	bad := &redfish.Client{Endpoint: bmc.URL, Username: "admin", Password: "wrong"}
+	var rerr *redfish.Error
+	if err := bad.PXEBoot(ctx); !errors.As(err, &rerr) || rerr.StatusCode != http.StatusUnauthorized || rerr.Message != "invalid credentials" {
+		t.Errorf("PXEBoot(wrong password) got err %v", err)
+	}
+}
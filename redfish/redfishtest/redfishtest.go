@@ -0,0 +1,180 @@
+// Package redfishtest provides an in-process mock of a BMC's Redfish API
+// for tests.
+package redfishtest
+
+import (
+	"encoding/json"
+	"github.com/nveeser/corepxe/redfish"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// SystemPath is the path of the single computer system of a Server.
+const SystemPath = "/redfish/v1/Systems/1"
+
+// Server is a BMC managing one computer system. Resets take effect
+// immediately; a reset that boots the system consumes a "Once" boot
+// override and records its target in Boots.
+type Server struct {
+	*httptest.Server
+	Username string
+	Password string
+
+	mu     sync.Mutex
+	system redfish.System
+	boots  []string
+	resets []string
+}
+
+// NewServer starts a Server whose system is powered on and accepts the
+// given credentials. The caller must Close it.
+func NewServer(username, password string) *Server {
+	s := &Server{
+		Username: username,
+		Password: password,
+		system: redfish.System{
+			ID:         "1",
+			PowerState: redfish.PowerOn,
+			Boot:       redfish.Boot{BootSourceOverrideEnabled: "Disabled", BootSourceOverrideTarget: "None"},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /redfish/v1/Systems", s.systems)
+	mux.HandleFunc("GET "+SystemPath, s.get)
+	mux.HandleFunc("PATCH "+SystemPath, s.patch)
+	mux.HandleFunc("POST "+SystemPath+"/Actions/ComputerSystem.Reset", s.reset)
+	s.Server = httptest.NewServer(s.auth(mux))
+	return s
+}
+
+// SetPowerState sets the power state of the system.
+func (s *Server) SetPowerState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.system.PowerState = state
+}
+
+// System returns the state of the system.
+func (s *Server) System() redfish.System {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.system
+}
+
+// Boots returns the boot source override targets the system booted
+// from, in order.
+func (s *Server) Boots() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.boots...)
+}
+
+// Resets returns the reset types requested, in order.
+func (s *Server) Resets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.resets...)
+}
+
+func (s *Server) auth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != s.Username || pass != s.Password {
+			writeError(w, http.StatusUnauthorized, "invalid credentials")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) systems(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"Members": []map[string]string{{"@odata.id": SystemPath}},
+	})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.System())
+}
+
+func (s *Server) patch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Boot *redfish.Boot `json:"Boot"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Boot == nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+	switch req.Boot.BootSourceOverrideEnabled {
+	case "", "Once", "Continuous", "Disabled":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid BootSourceOverrideEnabled "+req.Boot.BootSourceOverrideEnabled)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Boot.BootSourceOverrideEnabled != "" {
+		s.system.Boot.BootSourceOverrideEnabled = req.Boot.BootSourceOverrideEnabled
+	}
+	if req.Boot.BootSourceOverrideTarget != "" {
+		s.system.Boot.BootSourceOverrideTarget = req.Boot.BootSourceOverrideTarget
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) reset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResetType string `json:"ResetType"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case req.ResetType == redfish.ResetForceOff:
+		s.system.PowerState = redfish.PowerOff
+	case req.ResetType == redfish.ResetOn && s.system.PowerState == redfish.PowerOff,
+		req.ResetType == redfish.ResetForceRestart && s.system.PowerState == redfish.PowerOn:
+		s.system.PowerState = redfish.PowerOn
+		s.boot()
+	default:
+		writeError(w, http.StatusConflict, "cannot "+req.ResetType+" a system that is "+s.system.PowerState)
+		return
+	}
+	s.resets = append(s.resets, req.ResetType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// boot records what the system boots from. Called with s.mu held.
+func (s *Server) boot() {
+	b := &s.system.Boot
+	switch b.BootSourceOverrideEnabled {
+	case "Once":
+		s.boots = append(s.boots, b.BootSourceOverrideTarget)
+		b.BootSourceOverrideEnabled = "Disabled"
+	case "Continuous":
+		s.boots = append(s.boots, b.BootSourceOverrideTarget)
+	default:
+		s.boots = append(s.boots, "None")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":                  "Base.1.0.GeneralError",
+			"message":               "A general error has occurred.",
+			"@Message.ExtendedInfo": []map[string]string{{"Message": msg}},
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var renderCmd = &command{
+	name: "render",
+	help: "render iPXE scripts and Ignition configs offline",
+	subs: []*command{
+		renderIgnitionCmd,
+		renderIPXECmd,
+	},
+}
+
+var (
+	renderIgnitionDebug      bool
+	renderIgnitionProvenance string
+)
+
+var renderIgnitionCmd = &command{
+	name: "ignition",
+	args: "<osname> <host>",
+	help: "print the Ignition served at /configs/<osname>/<host>",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&renderIgnitionDebug, "debug", false, "print the merged Butane instead of Ignition")
+		fs.StringVar(&renderIgnitionProvenance, "provenance", "", "print where each value of the merged Butane was set instead of Ignition: json or yaml")
+	},
+	run: func(args []string) error {
+		if len(args) != 2 {
+			return usageError("render ignition <osname> <host>")
+		}
+		h, err := srv.Ignition()
+		if err != nil {
+			return err
+		}
+		render := h.Render
+		switch renderIgnitionProvenance {
+		case "":
+		case "json", "yaml":
+			render = func(osname, host string) ([]byte, error) {
+				p, err := h.Provenance(osname, host)
+				if err != nil {
+					return nil, err
+				}
+				if renderIgnitionProvenance == "yaml" {
+					return p.AnnotatedYAML()
+				}
+				return json.MarshalIndent(p, "", "  ")
+			}
+		default:
+			return fmt.Errorf("invalid -provenance %q: wanted json or yaml", renderIgnitionProvenance)
+		}
+		if renderIgnitionDebug {
+			render = h.Butane
+		}
+		data, err := render(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+var renderIPXEMAC string
+
+var renderIPXECmd = &command{
+	name: "ipxe",
+	args: "<template> [--mac <addr>]",
+	help: "print the iPXE script served at /configs/ipxe/<template>",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&renderIPXEMAC, "mac", "", "MAC address of the client")
+	},
+	run: func(args []string) error {
+		if len(args) != 1 {
+			return usageError("render ipxe <template>")
+		}
+		return srv.RenderIPXE(os.Stdout, args[0], renderIPXEMAC)
+	},
+}
+
+func usageError(usage string) error {
+	fmt.Fprintf(os.Stderr, "usage: corepxe %s\n", usage)
+	return errUsage
+}
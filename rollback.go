@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var rollbackCmd = &command{
+	name: "rollback",
+	args: "<host>",
+	help: "ask the running server to pin the machines of a host to the config revision they were installed with, for the next reinstall; needs -api-token-file",
+	run: func(args []string) error {
+		if len(args) != 1 {
+			return usageError("rollback <host>")
+		}
+		c, err := srv.APIClient()
+		if err != nil {
+			return err
+		}
+		machines, err := c.RollbackHost(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		for _, m := range machines {
+			fmt.Printf("%s\t%s\n", m.ID, m.ConfigPin)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,56 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// AgeDir looks up secrets in a directory of files encrypted with age:
+// the reference "k8s/join-token" is the file "k8s/join-token.age",
+// created with e.g.
+//
+//	age -r <recipient> -o k8s/join-token.age
+type AgeDir struct {
+	Dir        string
+	Identities []age.Identity
+}
+
+// OpenAgeDir returns an AgeDir decrypting the files in dir with the
+// identities in identityFile.
+func OpenAgeDir(dir, identityFile string) (*AgeDir, error) {
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading age identities %s: %w", identityFile, err)
+	}
+	return &AgeDir{Dir: dir, Identities: ids}, nil
+}
+
+func (a *AgeDir) Get(_ context.Context, ref string) ([]byte, error) {
+	if !filepath.IsLocal(ref) {
+		return nil, fmt.Errorf("invalid secret reference %q", ref)
+	}
+	f, err := os.Open(filepath.Join(a.Dir, ref+".age"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, a.Identities...)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting secret %s: %w", ref, err)
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,62 @@
+// Package secrets resolves the secret references of Butane configs, e.g.
+// "k8s/join-token", from pluggable backends: the environment, a
+// directory of age encrypted files and a Vault compatible HTTP API.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned by backends that do not hold a secret.
+var ErrNotFound = errors.New("secret not found")
+
+// Backend looks up secrets by reference.
+type Backend interface {
+	Get(ctx context.Context, ref string) ([]byte, error)
+}
+
+// Chain looks up secrets in each of its backends in turn, returning the
+// first found.
+type Chain []Backend
+
+func (c Chain) Get(ctx context.Context, ref string) ([]byte, error) {
+	for _, b := range c {
+		v, err := b.Get(ctx, ref)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		return v, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+}
+
+// Env looks up secrets in environment variables: the reference
+// "k8s/join-token" with Prefix "COREPXE_SECRET_" is the variable
+// COREPXE_SECRET_K8S_JOIN_TOKEN.
+type Env struct {
+	Prefix string
+}
+
+// DefaultEnvPrefix is the usual Prefix of Env.
+const DefaultEnvPrefix = "COREPXE_SECRET_"
+
+func (e *Env) Get(_ context.Context, ref string) ([]byte, error) {
+	name := e.Prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, ref)
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	return []byte(v), nil
+}
@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"filippo.io/age"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("TEST_SECRET_K8S_JOIN_TOKEN", "from-env")
+	env := &Env{Prefix: "TEST_SECRET_"}
+
+	dir := t.TempDir()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "identity.txt"), []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "store", "users"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "store", "users", "core.age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := age.Encrypt(f, id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("from-age"))
+	w.Close()
+	f.Close()
+	ageDir, err := OpenAgeDir(filepath.Join(dir, "store"), filepath.Join(dir, "identity.txt"))
+	if err != nil {
+		t.Fatalf("OpenAgeDir() got err %s", err)
+	}
+
+	vaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/db/admin" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{
+				"data": map[string]any{"value": "from-vault", "user": "admin"},
+			},
+		})
+	}))
+	defer vaultServer.Close()
+	vault := &Vault{Address: vaultServer.URL, Token: "root", Mount: "kv"}
+
+	chain := Chain{env, ageDir, vault}
+	cases := map[string]string{
+		"k8s/join-token": "from-env",
+		"users/core":     "from-age",
+		"db/admin":       "from-vault",
+		"db/admin#user":  "admin",
+	}
+	for ref, want := range cases {
+		if got, err := chain.Get(ctx, ref); err != nil || string(got) != want {
+			t.Errorf("Get(%s) got %q, %v wanted %q", ref, got, err, want)
+		}
+	}
+	if _, err := chain.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) got err %v wanted %s", err, ErrNotFound)
+	}
+	if _, err := chain.Get(ctx, "db/admin#nope"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing field) got err %v", err)
+	}
+	if _, err := ageDir.Get(ctx, "../identity"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("AgeDir.Get(outside the directory) got err %v", err)
+	}
+	vault.Token = "wrong"
+	if _, err := vault.Get(ctx, "db/admin"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Vault.Get(wrong token) got err %v", err)
+	}
+}
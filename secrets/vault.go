@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Vault looks up secrets in a KV version 2 secrets engine of a HashiCorp
+// Vault compatible server. The reference "k8s/join-token#token" is the
+// field "token" of the secret at "k8s/join-token"; without a field it is
+// DefaultVaultField.
+type Vault struct {
+	// Address is the base URL of the server, e.g.
+	// "https://vault.example.com:8200".
+	Address string
+	Token   string
+	// Mount is the path the secrets engine is mounted at; empty means
+	// DefaultVaultMount.
+	Mount string
+	// HTTPClient is used to make requests; nil means a client with a 30s
+	// timeout.
+	HTTPClient *http.Client
+}
+
+const (
+	DefaultVaultMount = "secret"
+	DefaultVaultField = "value"
+)
+
+func (v *Vault) Get(ctx context.Context, ref string) ([]byte, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	if field == "" {
+		field = DefaultVaultField
+	}
+	mount := v.Mount
+	if mount == "" {
+		mount = DefaultVaultMount
+	}
+	u, err := url.JoinPath(v.Address, "v1", mount, "data", path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	hc := v.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	case resp.StatusCode != http.StatusOK:
+		var body struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(data, &body)
+		return nil, fmt.Errorf("vault: %s: %s %v", path, resp.Status, body.Errors)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("vault: %s: %w", path, err)
+	}
+	switch val := body.Data.Data[field].(type) {
+	case string:
+		return []byte(val), nil
+	case nil:
+		return nil, fmt.Errorf("vault: secret %s has no field %q", path, field)
+	default:
+		return json.Marshal(val)
+	}
+}
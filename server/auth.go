@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"github.com/nveeser/corepxe/client"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// APIClient returns a client for the API of the server as configured: at
+// ExternalURL, or else at ListenAddr, authenticating with the first token
+// of APITokenFile.
+func (c *IPXE) APIClient() (*client.Client, error) {
+	if c.APITokenFile == "" {
+		return nil, errors.New("the API is disabled without an API token file")
+	}
+	tokens, err := readAPITokens(c.APITokenFile)
+	if err != nil {
+		return nil, err
+	}
+	base := c.ExternalURL
+	if base == "" {
+		host, port, err := net.SplitHostPort(c.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+	return client.New(base, tokens[0]), nil
+}
+
+// readAPITokens reads bearer tokens from path, one per line. Blank lines
+// and lines starting with "#" are ignored.
+func readAPITokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tokens []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens in " + path)
+	}
+	return tokens, nil
+}
+
+// requireToken refuses requests without an "Authorization: Bearer" header
+// holding one of tokens. So that browsers can reach the dashboard, a token
+// is also accepted as the password of HTTP basic authentication. With no
+// tokens every request is refused, so that the admin routes are closed
+// unless APITokenFile is set.
+func requireToken(h http.Handler, tokens []string) http.Handler {
+	if len(tokens) == 0 {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "forbidden: the server has no API token file", http.StatusForbidden)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, got, ok = r.BasicAuth()
+		}
+		if ok {
+			for _, tok := range tokens {
+				if subtle.ConstantTimeCompare([]byte(got), []byte(tok)) == 1 {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		w.Header().Add("WWW-Authenticate", `Bearer realm="corepxe"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="corepxe"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	c := &IPXE{
+		ConfigDir:    t.TempDir(),
+		ImageDir:     t.TempDir(),
+		StateDir:     t.TempDir(),
+		APITokenFile: filepath.Join(t.TempDir(), "tokens"),
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.APITokenFile, []byte("# automation\nsecret-token\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	for _, tc := range []struct {
+		target, token string
+		want          int
+	}{
+		{"/api/v1/hosts", "", http.StatusUnauthorized},
+		{"/api/v1/hosts", "wrong", http.StatusUnauthorized},
+		{"/api/v1/hosts", "secret-token", http.StatusOK},
+		{"/api/v1/openapi.json", "secret-token", http.StatusOK},
+		{"/admin/machines", "", http.StatusUnauthorized},
+		{"/admin/machines", "secret-token", http.StatusOK},
+		{"/configs/ipxe/boot", "", http.StatusOK},
+		// Config sources are only served rendered, through the Ignition
+		// handler.
+		{"/configs/coreos/node1/host.yaml", "", http.StatusNotFound},
+		{"/configs/inventory.yaml", "secret-token", http.StatusNotFound},
+		{"/dashboard", "", http.StatusUnauthorized},
+		{"/dashboard", "secret-token", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("GET %s with token %q got status %d wanted %d", tc.target, tc.token, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminWithoutTokens(t *testing.T) {
+	c := &IPXE{
+		ConfigDir: t.TempDir(),
+		ImageDir:  t.TempDir(),
+		StateDir:  t.TempDir(),
+		Discovery: true,
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	for _, target := range []string{
+		"GET /dashboard",
+		"GET /admin/machines",
+		"POST /admin/machines/aa:bb:cc:dd:ee:ff/reinstall",
+		"POST /admin/discovered/aa:bb:cc:dd:ee:ff/approve",
+	} {
+		method, path, _ := strings.Cut(target, " ")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s without API tokens got status %d wanted 403", target, w.Code)
+		}
+	}
+}
+
+// withAPIToken gives c an API token file and returns its token.
+func withAPIToken(t *testing.T, c *IPXE) string {
+	t.Helper()
+	c.APITokenFile = filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(c.APITokenFile, []byte("test-token\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return "test-token"
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/nveeser/corepxe/gitconfig"
+	"github.com/nveeser/corepxe/lifecycle"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// configCheckout is a commit of ConfigRepo written to a directory.
+type configCheckout struct {
+	dir    string
+	commit string
+}
+
+// ConfigRoot returns the directory configs are served from: ConfigDir or,
+// with ConfigRepo, the checkout of ConfigRevision, made on first use and
+// again on SIGHUP.
+func (c *IPXE) ConfigRoot() (string, error) {
+	co, err := c.configCheckout()
+	if err != nil {
+		return "", err
+	}
+	if co == nil {
+		return c.ConfigDir, nil
+	}
+	return co.dir, nil
+}
+
+// configCheckout returns the checkout configs are served from, or nil
+// without ConfigRepo.
+func (c *IPXE) configCheckout() (*configCheckout, error) {
+	if c.ConfigRepo == "" {
+		return nil, nil
+	}
+	if co := c.loadedCheckout(); co != nil {
+		return co, nil
+	}
+	co, err := c.checkoutConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c.checkout.Store(co)
+	return co, nil
+}
+
+// loadedCheckout returns the checkout configs are served from, or nil if
+// none was made yet.
+func (c *IPXE) loadedCheckout() *configCheckout {
+	co, _ := c.checkout.Load().(*configCheckout)
+	return co
+}
+
+// checkoutConfig checks out the commit ConfigRevision of ConfigRepo
+// currently names.
+func (c *IPXE) checkoutConfig(ctx context.Context) (*configCheckout, error) {
+	rev := c.ConfigRevision
+	if rev == "" {
+		rev = "HEAD"
+	}
+	commit, err := gitconfig.Resolve(ctx, c.ConfigRepo, rev)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := c.exportCommit(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+	return &configCheckout{dir: dir, commit: commit}, nil
+}
+
+// gitDir is the git repository, or directory of one, config revisions
+// are read from.
+func (c *IPXE) gitDir() string {
+	if c.ConfigRepo != "" {
+		return c.ConfigRepo
+	}
+	return c.ConfigDir
+}
+
+// exportMarker is written, holding the commit, into the directory of an
+// exported commit once it is complete.
+const exportMarker = ".corepxe-export"
+
+// exportCommit returns the directory holding commit of gitDir, writing it
+// if needed. Commits are kept in "configs" in StateDir or, without one,
+// in a private temporary directory made for this server. An existing
+// directory is only used when its export completed.
+func (c *IPXE) exportCommit(ctx context.Context, commit string) (string, error) {
+	base, err := c.exportBase()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, commit)
+	if exported(dir, commit) {
+		return dir, nil
+	}
+	tmp, err := os.MkdirTemp(base, ".export-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := gitconfig.Export(ctx, c.gitDir(), commit, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, exportMarker), []byte(commit), 0644); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if _, err := os.Lstat(dir); err == nil && !exported(dir, commit) {
+		// Left from an export that did not complete, or not ours.
+		if err := os.RemoveAll(dir); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		// Another request exported the same commit first.
+		if exported(dir, commit) {
+			return dir, nil
+		}
+		return "", err
+	}
+	slog.Info("Exported config revision", "commit", commit, "dir", dir)
+	return dir, nil
+}
+
+// exportBase returns the directory commits are exported to.
+func (c *IPXE) exportBase() (string, error) {
+	if c.StateDir != "" {
+		base := filepath.Join(c.StateDir, "configs")
+		return base, os.MkdirAll(base, 0700)
+	}
+	if base, ok := c.exports.Load().(string); ok {
+		return base, nil
+	}
+	base, err := os.MkdirTemp("", "corepxe-configs-")
+	if err != nil {
+		return "", err
+	}
+	if !c.exports.CompareAndSwap(nil, base) {
+		os.Remove(base)
+		return c.exports.Load().(string), nil
+	}
+	return base, nil
+}
+
+// exported reports whether dir holds the complete export of commit.
+func exported(dir, commit string) bool {
+	b, err := os.ReadFile(filepath.Join(dir, exportMarker))
+	return err == nil && string(b) == commit
+}
+
+// pinnedConfig returns the directory of the config revision the machine
+// with the given MAC address is pinned to, and that revision, or "" when
+// it is not pinned.
+func (c *IPXE) pinnedConfig(mac string) (string, string, error) {
+	tracker := c.Tracker()
+	if tracker == nil {
+		return "", "", nil
+	}
+	m, err := tracker.Machine(mac)
+	if errors.Is(err, lifecycle.ErrNotFound) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if m.ConfigPin == "" {
+		return "", "", nil
+	}
+	dir, err := c.exportCommit(context.Background(), m.ConfigPin)
+	if err != nil {
+		return "", "", err
+	}
+	return dir, m.ConfigPin, nil
+}
+
+// ResolveConfigRevision returns the commit the git revision rev of the
+// config repository names.
+func (c *IPXE) ResolveConfigRevision(ctx context.Context, rev string) (string, error) {
+	return gitconfig.Resolve(ctx, c.gitDir(), rev)
+}
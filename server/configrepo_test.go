@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"github.com/nveeser/corepxe/inventory"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigRepoPinnedRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo := t.TempDir()
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", repo}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("git %v got err %s", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, data string) {
+		t.Helper()
+		path := filepath.Join(repo, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("boot"+templateSuffxix, "install")
+	write("inventory.yaml", "hosts:\n  node1:\n    macs: [\"aa:bb:cc:dd:ee:ff\"]\n")
+	write("coreos/base/base.yaml", "variant: fcos\nversion: 1.5.0\n")
+	write("coreos/node1/host.yaml", "storage: {files: [{path: /etc/motd, contents: {inline: first}}]}\n")
+	git("add", "-A")
+	git("commit", "-q", "-m", "first")
+	first := git("rev-parse", "HEAD")
+
+	c := &IPXE{
+		ConfigRepo: repo,
+		ImageDir:   t.TempDir(),
+		StateDir:   t.TempDir(),
+	}
+	// A directory for the commit without a completed export is replaced.
+	planted := filepath.Join(c.StateDir, "configs", first, "coreos/node1/host.yaml")
+	if err := os.MkdirAll(filepath.Dir(planted), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(planted, []byte("storage: {files: [{path: /etc/motd, contents: {inline: planted}}]}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	get := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/configs/coreos/node1?mac=aa:bb:cc:dd:ee:ff", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET got status %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+	w := get()
+	if got := w.Header().Get("X-Config-Revision"); got != first || strings.Contains(w.Body.String(), "planted") {
+		t.Errorf("got revision %q wanted %q: %s", got, first, w.Body.String())
+	}
+	m, err := c.Tracker().Machine("aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatalf("Machine() got err %s", err)
+	}
+	if m.ConfigRevision != first {
+		t.Errorf("ConfigRevision got %q wanted %q", m.ConfigRevision, first)
+	}
+
+	// The inventory of the checkout only seeds the store, which takes the
+	// writes.
+	inv, err := c.Inventory()
+	if err != nil {
+		t.Fatalf("Inventory() got err %s", err)
+	}
+	if err := inv.PutHost(&inventory.Host{Name: "node2", MACs: []string{"aa:bb:cc:dd:ee:01"}}); err != nil {
+		t.Fatalf("PutHost() got err %s", err)
+	}
+	root, err := c.ConfigRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "inventory.yaml")); err != nil || strings.Contains(string(b), "node2") {
+		t.Errorf("checkout inventory.yaml got %q, %v wanted it unchanged", b, err)
+	}
+	if inv, err := c.Inventory(); err != nil || len(inv.Hosts()) != 2 {
+		t.Errorf("Inventory() after PutHost got %v, %v wanted 2 hosts", inv, err)
+	}
+
+	// New commits are served after a reload, except to pinned machines.
+	write("coreos/node1/host.yaml", "storage: {files: [{path: /etc/motd, contents: {inline: second}}]}\n")
+	git("commit", "-q", "-a", "-m", "second")
+	second := git("rev-parse", "HEAD")
+	co, err := c.checkoutConfig(context.Background())
+	if err != nil {
+		t.Fatalf("checkoutConfig() got err %s", err)
+	}
+	c.checkout.Store(co)
+	if h, err = c.buildHandler(); err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	if w := get(); w.Header().Get("X-Config-Revision") != second || !strings.Contains(w.Body.String(), "second") {
+		t.Errorf("after reload got revision %q: %s", w.Header().Get("X-Config-Revision"), w.Body.String())
+	}
+
+	if _, err := c.Tracker().PinConfig("aa:bb:cc:dd:ee:ff", first); err != nil {
+		t.Fatalf("PinConfig() got err %s", err)
+	}
+	if w := get(); w.Header().Get("X-Config-Revision") != first || !strings.Contains(w.Body.String(), "first") {
+		t.Errorf("pinned got revision %q: %s", w.Header().Get("X-Config-Revision"), w.Body.String())
+	}
+}
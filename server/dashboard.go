@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"github.com/nveeser/corepxe/coreos"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/mirror"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+var dashboardTmpl = template.Must(template.New("index.html.tmpl").Funcs(template.FuncMap{
+	"size": formatSize,
+	"ago":  formatAgo,
+}).ParseFS(dashboardFS, "dashboard/index.html.tmpl"))
+
+// dashboardStages are the columns of the machine table, in boot order.
+var dashboardStages = []lifecycle.Stage{
+	lifecycle.StageIPXE,
+	lifecycle.StageKernel,
+	lifecycle.StageInitrd,
+	lifecycle.StageRootfs,
+	lifecycle.StageIgnition,
+	lifecycle.StageProvisioned,
+}
+
+// dashboard serves a read-only HTML overview of machines, streams, the
+// image mirror and recent requests.
+type dashboard struct {
+	tracker  *lifecycle.Tracker // nil when machines are not tracked
+	streams  *coreos.StreamCache
+	mirror   *mirror.ImageMirror
+	verifier *imageVerifier
+	requests *requestLog
+}
+
+type dashboardData struct {
+	Now      time.Time
+	Stages   []lifecycle.Stage
+	Tracking bool
+	Machines []*dashboardMachine
+	Streams  []*dashboardStream
+	Images   []*dashboardImage
+	Requests []requestRecord
+	Failures []requestRecord
+	Errors   []string // sections that could not be loaded
+}
+
+type dashboardMachine struct {
+	*lifecycle.Machine
+	// Reached holds, per column of Stages, whether the machine got there.
+	Reached []bool
+}
+
+type dashboardStream struct {
+	Name         string
+	Releases     map[string]string
+	LastModified string
+	Refreshed    time.Time
+}
+
+type dashboardImage struct {
+	mirror.Entry
+	Current bool
+	State   string
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data := &dashboardData{
+		Now:      time.Now(),
+		Stages:   dashboardStages,
+		Tracking: d.tracker != nil,
+	}
+	failed := func(section string, err error) {
+		data.Errors = append(data.Errors, fmt.Sprintf("%s: %s", section, err))
+	}
+	if d.tracker != nil {
+		machines, err := d.tracker.Machines()
+		if err != nil {
+			failed("machines", err)
+		}
+		for _, m := range machines {
+			data.Machines = append(data.Machines, &dashboardMachine{Machine: m, Reached: reached(m)})
+		}
+	}
+	for _, name := range coreos.StreamNames {
+		st, err := d.stream(name)
+		if err != nil {
+			failed("stream "+name, err)
+			continue
+		}
+		data.Streams = append(data.Streams, st)
+	}
+	if images, err := d.images(); err != nil {
+		failed("images", err)
+	} else {
+		data.Images = images
+	}
+	if d.requests != nil {
+		data.Requests, data.Failures = d.requests.recent()
+	}
+
+	var buf bytes.Buffer
+	if err := dashboardTmpl.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (d *dashboard) stream(name string) (*dashboardStream, error) {
+	st := &dashboardStream{Name: name, Releases: make(map[string]string)}
+	s, err := d.streams.Cached(name)
+	if err != nil || s == nil {
+		return st, err
+	}
+	st.LastModified = s.Metadata.LastModified
+	for arch := range s.Architectures {
+		if release, err := d.streams.Release(name, arch); err == nil {
+			st.Releases[arch] = release
+		}
+	}
+	st.Refreshed, err = d.streams.Refreshed(name)
+	return st, err
+}
+
+func (d *dashboard) images() ([]*dashboardImage, error) {
+	entries, err := d.mirror.List()
+	if err != nil {
+		return nil, err
+	}
+	sums, err := d.streams.Checksums()
+	if err != nil {
+		return nil, err
+	}
+	var images []*dashboardImage
+	for _, e := range entries {
+		want, current := sums[e.Path]
+		images = append(images, &dashboardImage{
+			Entry:   e,
+			Current: current,
+			State:   d.verifier.state(d.mirror.RootDir, e, want),
+		})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Path < images[j].Path })
+	return images, nil
+}
+
+// reached reports for each of dashboardStages whether m got there on its
+// latest boot.
+func reached(m *lifecycle.Machine) []bool {
+	last := -1
+	for i, s := range dashboardStages {
+		if s == m.Stage {
+			last = i
+		}
+	}
+	out := make([]bool, len(dashboardStages))
+	for i := range out {
+		out[i] = i <= last
+	}
+	return out
+}
+
+// dashboardStatic serves the stylesheet of the dashboard.
+func dashboardStatic() http.Handler {
+	sub, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServerFS(sub))
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatAgo(now, t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Truncate(time.Second).String() + " ago"
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/nveeser/corepxe/mirror"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	c := &IPXE{
+		ConfigDir: t.TempDir(),
+		ImageDir:  t.TempDir(),
+		StateDir:  t.TempDir(),
+	}
+	apiToken := withAPIToken(t, c)
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(c.ImageDir, "coreos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.ImageDir, "coreos/old-kernel"), make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "Bearer "+apiToken)
+		h.ServeHTTP(w, r)
+		return w
+	}
+	get("/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:ff")
+	get("/configs/ipxe/missing")
+
+	w := get("/dashboard")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /dashboard got status %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"aa:bb:cc:dd:ee:ff",
+		"coreos/old-kernel",
+		"2.0 KiB",
+		`<tr class="failed">`,
+		"/configs/ipxe/missing",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard missing %q", want)
+		}
+	}
+	if w := get("/dashboard/style.css"); w.Code != http.StatusOK {
+		t.Errorf("GET /dashboard/style.css got status %d", w.Code)
+	}
+	if w := get("/"); w.Code != http.StatusFound || w.Header().Get("Location") != "/dashboard" {
+		t.Errorf("GET / got status %d location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestImageVerifier(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "kernel"), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &mirror.ImageMirror{RootDir: root}
+	entries, err := m.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List() got %v, %v", entries, err)
+	}
+	want, err := sha256File(filepath.Join(root, "kernel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &imageVerifier{}
+	if got := v.state(root, entries[0], ""); got != verifyUnknown {
+		t.Errorf("state() without checksum got %s wanted %s", got, verifyUnknown)
+	}
+	wait := func(sum string) string {
+		for i := 0; i < 100; i++ {
+			if got := v.state(root, entries[0], sum); got != verifyPending {
+				return got
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return verifyPending
+	}
+	if got := wait(want); got != verifyOK {
+		t.Errorf("state() got %s wanted %s", got, verifyOK)
+	}
+	if got := wait(strings.Repeat("0", 64)); got != verifyMismatch {
+		t.Errorf("state() with wrong checksum got %s wanted %s", got, verifyMismatch)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/nveeser/corepxe/gitconfig"
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/inventory"
+	"os"
+	"path/filepath"
+)
+
+// IgnitionAt returns the ignition Handler Ignition returns, serving root
+// instead of ConfigRoot, e.g. another revision of it. Unless the inventory
+// is kept elsewhere, it is read from root too.
+func (c *IPXE) IgnitionAt(root string) (*ignition.Handler, error) {
+	var inv *inventory.File
+	var err error
+	if c.InventoryFile == "" && !c.inventoryInStore() {
+		inv, err = inventory.Load(filepath.Join(root, "inventory.yaml"))
+	} else {
+		inv, err = c.Inventory()
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := c.ignitionHandler(inv)
+	if err != nil {
+		return nil, err
+	}
+	h.ConfigRoot, h.Revision = root, ""
+	return h, nil
+}
+
+// ExportRevision writes the config directory as of the git revision rev
+// of ConfigRepo, or of ConfigDir without one, to a new temporary
+// directory, and returns it along with a function removing it.
+func (c *IPXE) ExportRevision(ctx context.Context, rev string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "corepxe-config-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	if _, err := gitconfig.Export(ctx, c.gitDir(), rev, dir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("revision %s: %w", rev, err)
+	}
+	return dir, cleanup, nil
+}
+
+// DiffIgnition returns how the Ignition config of each host differs
+// between from and to, each a config directory or a git revision (see
+// ExportRevision). An empty one stands for ConfigRoot as it is.
+func (c *IPXE) DiffIgnition(ctx context.Context, from, to string) ([]ignition.HostDiff, error) {
+	return c.diffIgnition(ctx, from, to, true)
+}
+
+// diffRevisions is DiffIgnition for the API, where from and to are only
+// git revisions, not paths on the server.
+func (c *IPXE) diffRevisions(ctx context.Context, from, to string) ([]ignition.HostDiff, error) {
+	return c.diffIgnition(ctx, from, to, false)
+}
+
+func (c *IPXE) diffIgnition(ctx context.Context, from, to string, dirs bool) ([]ignition.HostDiff, error) {
+	var handlers [2]*ignition.Handler
+	for i, rev := range []string{from, to} {
+		root, err := c.ConfigRoot()
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(rev); dirs && rev != "" && err == nil && fi.IsDir() {
+			root = rev
+		} else if rev != "" {
+			dir, cleanup, err := c.ExportRevision(ctx, rev)
+			if err != nil {
+				return nil, err
+			}
+			defer cleanup()
+			root = dir
+		}
+		h, err := c.IgnitionAt(root)
+		if err != nil {
+			return nil, err
+		}
+		handlers[i] = h
+	}
+	return ignition.Diff(ctx, handlers[0], handlers[1])
+}
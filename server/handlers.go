@@ -1,13 +1,28 @@
 package server
 
 import (
-	"fmt"
+	"errors"
+	"github.com/nveeser/corepxe/accesslog"
+	"github.com/nveeser/corepxe/api"
 	"github.com/nveeser/corepxe/coreos"
+	"github.com/nveeser/corepxe/discovery"
 	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/metrics"
 	"github.com/nveeser/corepxe/mirror"
-	"log"
+	"github.com/nveeser/corepxe/secrets"
+	"github.com/nveeser/corepxe/store"
+	"github.com/nveeser/corepxe/token"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,74 +30,567 @@ type IPXE struct {
 	ConfigDir  string
 	ImageDir   string
 	ListenAddr string
+
+	// ConfigRepo, when set, is a git repository, bare or not, or a
+	// directory of a work tree, whose commit ConfigRevision configs are
+	// served from instead of ConfigDir. The revision is checked out again
+	// on SIGHUP. Machines record the commit their Ignition config was
+	// rendered from and can be pinned to one.
+	ConfigRepo string
+	// ConfigRevision is the revision of ConfigRepo served, e.g. a branch;
+	// empty means "HEAD".
+	ConfigRevision string
+
+	// ShutdownTimeout bounds how long Run waits for in-flight requests
+	// (e.g. rootfs downloads) to finish after SIGTERM. Zero means
+	// DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable HTTPS on TLSListenAddr, in
+	// addition to HTTP on ListenAddr for iPXE builds without HTTPS. Both
+	// are re-read on SIGHUP along with the templates.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSListenAddr is the HTTPS listen address. Empty means
+	// DefaultTLSListenAddr.
+	TLSListenAddr string
+	// TLSClientCAFile optionally names a PEM bundle used to verify client
+	// certificates. Clients without a certificate are still accepted.
+	TLSClientCAFile string
+
+	// ExternalURL is the base URL clients use to reach the server, e.g.
+	// "https://pxe.example.com/". When empty URLs are built from the
+	// scheme and Host of each request.
+	ExternalURL string
+	// TrustedProxies lists the addresses or CIDR prefixes of reverse
+	// proxies whose X-Forwarded-Proto and X-Forwarded-Host headers are
+	// believed.
+	TrustedProxies []string
+
+	// IgnitionTokens, when set, is used to sign the Ignition URL in iPXE
+	// scripts and Ignition requests without a valid token are refused.
+	// It is kept across reloads so one-time tokens stay spent.
+	IgnitionTokens *token.Signer
+
+	// AccessLog names a file that receives one JSON object per request.
+	// It is rotated when it reaches AccessLogMaxSize bytes, keeping
+	// AccessLogMaxBackups old files. When empty requests are logged
+	// through the default slog.Logger.
+	AccessLog           string
+	AccessLogMaxSize    int64
+	AccessLogMaxBackups int
+
+	// StateDir holds corepxe's own state, such as machine timelines, in
+	// the database StateFile. When empty machines are not tracked.
+	StateDir string
+	// StallTimeout is how long a machine may go without a request before
+	// its install is considered stalled. Zero means
+	// lifecycle.DefaultStallTimeout.
+	StallTimeout time.Duration
+	// StreamMaxAge is how long CoreOS stream metadata is served before it
+	// is fetched again. Zero means coreos.DefaultMaxAge.
+	StreamMaxAge time.Duration
+	// PhoneHome adds a unit to every Ignition config that reports the
+	// first boot of the installed OS back to the server, to a URL signed
+	// with IgnitionTokens. It needs StateDir and IgnitionTokens.
+	PhoneHome bool
+	// LocalBootAfterInstall boots installed machines from their local disk
+	// instead of the installer, until a reinstall is requested. Machines
+	// are installed once they report their first boot or, without
+	// PhoneHome, once they fetch their Ignition config.
+	LocalBootAfterInstall bool
+
+	// InventoryFile names the inventory of known machines. When empty it
+	// is "inventory.yaml" in ConfigDir, or in the checkout of ConfigRepo.
+	// It is re-read on SIGHUP.
+	InventoryFile string
+	// InventoryInStore keeps the inventory in the state store instead of
+	// InventoryFile, which only seeds an empty store. It is implied by
+	// ConfigRepo without InventoryFile, as checkouts are not written to.
+	InventoryInStore bool
+	// Discovery boots machines whose MAC address is not in the inventory
+	// into a live image that reports their hardware. They are kept as
+	// pending machines until approved into the inventory. It needs
+	// StateDir.
+	Discovery bool
+
+	// APITokenFile names a file of bearer tokens, one per line, that
+	// enables the management API under /api/v1 and is required by it and
+	// by the /admin routes and the dashboard, which are refused without
+	// one. It is re-read on SIGHUP.
+	APITokenFile string
+
+	// Secret backends resolving the secret references of Butane configs,
+	// tried in this order. SecretsEnvPrefix enables environment variables
+	// with that prefix. SecretsAgeDir holds age encrypted secrets,
+	// decrypted with the identities in SecretsAgeIdentityFile. VaultAddr
+	// enables a Vault KV version 2 engine mounted at VaultMount, read with
+	// the token in VaultTokenFile.
+	SecretsEnvPrefix       string
+	SecretsAgeDir          string
+	SecretsAgeIdentityFile string
+	VaultAddr              string
+	VaultMount             string
+	VaultTokenFile         string
+
+	// RecentRequests is how many requests, and separately failed
+	// requests, the dashboard shows. Zero means DefaultRecentRequests.
+	RecentRequests int
+
+	// MinFreeDisk is the free space in bytes below which /readyz fails.
+	// Zero means DefaultMinFreeDisk.
+	MinFreeDisk uint64
+
+	// checkout holds the *configCheckout served, with ConfigRepo.
+	checkout atomic.Value
+	// exports holds the directory commits are exported to without
+	// StateDir, made on first use.
+	exports   atomic.Value
+	accessLog *slog.Logger
+	tracker   *lifecycle.Tracker
+	requests  *requestLog
+	verifier  *imageVerifier
+	state     *store.Bolt
+	stateErr  error
+}
+
+// Tracker returns the machine lifecycle Tracker, or nil when StateDir is
+// not set. The same Tracker is kept across reloads.
+func (c *IPXE) Tracker() *lifecycle.Tracker {
+	if c.tracker == nil && c.StateDir != "" {
+		state, err := c.State()
+		if err != nil {
+			slog.Warn("Machine tracking disabled", "err", err)
+			return nil
+		}
+		c.tracker = &lifecycle.Tracker{
+			Store:        state,
+			StallTimeout: c.StallTimeout,
+		}
+		if !c.PhoneHome {
+			c.tracker.InstalledStage = lifecycle.StageIgnition
+		}
+	}
+	return c.tracker
 }
 
-func (c *IPXE) Run() error {
-	handler, err := c.buildHandler()
+// Inventory reads the inventory file, or the inventory in the state store
+// with InventoryInStore.
+func (c *IPXE) Inventory() (*inventory.File, error) {
+	path := c.InventoryFile
+	if path == "" {
+		root, err := c.ConfigRoot()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(root, "inventory.yaml")
+	}
+	if !c.inventoryInStore() {
+		return inventory.Load(path)
+	}
+	state, err := c.State()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if state == nil {
+		if !c.InventoryInStore {
+			return nil, errors.New("with a config repository, the inventory is kept in the state store, which needs a state directory, unless an inventory file is set")
+		}
+		return nil, errors.New("the inventory can only be kept in the store with a state directory")
 	}
-	// Start the iPXE Boot Server.
-	fmt.Println("Starting CoreOS iPXE Server...")
-	fmt.Printf("Listening on %s\n", c.ListenAddr)
-	fmt.Printf("Configs: %s\n", c.ConfigDir)
-	fmt.Printf("Images: %s\n", c.ImageDir)
+	return inventory.Open(state, path)
+}
 
-	httpSrv := http.Server{
-		Addr:    c.ListenAddr,
-		Handler: handler,
+// inventoryInStore reports whether the inventory is kept in the state
+// store: with InventoryInStore, or with ConfigRepo and no InventoryFile.
+func (c *IPXE) inventoryInStore() bool {
+	return c.InventoryInStore || c.ConfigRepo != "" && c.InventoryFile == ""
+}
+
+// discoveryStore returns the store of pending machines, or nil when
+// Discovery is off.
+func (c *IPXE) discoveryStore() *discovery.Store {
+	if !c.Discovery || c.StateDir == "" {
+		return nil
+	}
+	state, err := c.State()
+	if err != nil {
+		slog.Warn("Discovery disabled", "err", err)
+		return nil
 	}
-	return httpSrv.ListenAndServe()
+	return &discovery.Store{Repo: state}
+}
+
+// newIPXEHandler returns the iPXE handler for the current config.
+func (c *IPXE) newIPXEHandler(urls *urlResolver, inv *inventory.File) (*ipxeHandler, error) {
+	root, err := c.ConfigRoot()
+	if err != nil {
+		return nil, err
+	}
+	h, err := newIPXEHandler(root)
+	if err != nil {
+		return nil, err
+	}
+	h.urls = urls
+	h.tokens = c.IgnitionTokens
+	h.inventory = inv
+	h.discovery = c.discoveryStore()
+	h.tracker = c.Tracker()
+	h.localBoot = c.LocalBootAfterInstall
+	return h, nil
+}
+
+func (c *IPXE) minFreeDisk() uint64 {
+	if c.MinFreeDisk == 0 {
+		return DefaultMinFreeDisk
+	}
+	return c.MinFreeDisk
 }
 
 func (c *IPXE) buildHandler() (http.Handler, error) {
 	mux := http.NewServeMux()
 
+	state, err := c.State()
+	if err != nil {
+		return nil, err
+	}
+	root, err := c.ConfigRoot()
+	if err != nil {
+		return nil, err
+	}
+	if t := c.IgnitionTokens; t != nil && t.OneTime && t.Store == nil && state != nil {
+		// Set before the first handler serves, and kept after.
+		t.Store = state
+	}
+
+	streams := c.Streams()
 	ih := &coreos.ImageHandler{
-		ImageMirror: &mirror.ImageMirror{
-			RootDir: filepath.Join(c.ImageDir, "/coreos/"),
-		},
-		Streams: &coreos.StreamCache{
-			LocalDir: filepath.Join(c.ImageDir, "/coreos/"),
-		},
+		ImageMirror: c.Mirror(),
+		Streams:     streams,
 	}
 	mux.Handle("GET /images/coreos/{filetype}", ih)
+	mux.Handle("GET /images/coreos/release/{release}/{filetype}", ih)
 
-	ignHandler := &ignition.Handler{
-		ConfigRoot: c.ConfigDir,
+	urls, err := c.urlResolver()
+	if err != nil {
+		return nil, err
+	}
+	inv, err := c.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	ignHandler, err := c.ignitionHandler(inv)
+	if err != nil {
+		return nil, err
 	}
 	mux.Handle("GET /configs/{osname}/{name}", ignHandler)
 
-	pxeHandler, err := NewIPXEHandler(c.ConfigDir)
+	pxeHandler, err := c.newIPXEHandler(urls, inv)
 	if err != nil {
 		return nil, err
 	}
 	mux.Handle("GET /configs/ipxe/{name}", pxeHandler)
 
-	mux.Handle("/configs/", http.StripPrefix("/configs/", http.FileServer(http.Dir(c.ConfigDir))))
-	return withLogging(mux), nil
+	var apiTokens []string
+	if c.APITokenFile != "" {
+		if apiTokens, err = readAPITokens(c.APITokenFile); err != nil {
+			return nil, err
+		}
+		as := &api.Server{
+			Inventory: inv,
+			Tracker:   c.Tracker(),
+			Streams:   streams,
+			Mirror:    c.Mirror(),
+			Ignition:  ignHandler,
+			State:     state,
+			Secrets:   ignHandler.Secrets,
+			RenderIPXE: func(w io.Writer, r *http.Request, name, mac string) error {
+				return pxeHandler.render(w, &ipxeRequest{Name: name, Base: urls.base(r), MAC: mac})
+			},
+			DiffIgnition:          c.diffRevisions,
+			ResolveConfigRevision: c.ResolveConfigRevision,
+		}
+		mux.Handle(api.Prefix+"/", requireToken(as.Handler(), apiTokens))
+	}
+	admin := func(h http.Handler) http.Handler { return requireToken(h, apiTokens) }
+
+	if store := pxeHandler.discovery; store != nil {
+		mux.Handle("GET /discovery/ignition/{mac}", &discovery.IgnitionHandler{
+			ReportURL: func(r *http.Request, mac string) string {
+				return urls.base(r).JoinPath("discovery/report", mac).String()
+			},
+		})
+		mux.Handle("POST /discovery/report/{mac}", &discovery.ReportHandler{
+			Store:    store,
+			ClientIP: urls.clientIP,
+		})
+		dh := &discovery.Handler{Store: store, Inventory: inv}
+		mux.Handle("GET /admin/discovered", admin(dh))
+		mux.Handle("GET /admin/discovered/{mac}", admin(dh))
+		mux.Handle("POST /admin/discovered/{mac}/approve", admin(http.HandlerFunc(dh.Approve)))
+		mux.Handle("DELETE /admin/discovered/{mac}", admin(http.HandlerFunc(dh.Reject)))
+	}
+
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", healthz)
+	mux.Handle("GET /readyz", &readiness{
+		configDir:   root,
+		imageDir:    c.ImageDir,
+		minFreeDisk: c.minFreeDisk(),
+		streams:     streams,
+		ipxe:        pxeHandler,
+	})
+
+	var handler http.Handler = mux
+	if tracker := c.Tracker(); tracker != nil {
+		lh := &lifecycle.Handler{Tracker: tracker}
+		mux.Handle("GET /admin/machines", admin(lh))
+		mux.Handle("GET /admin/machines/{id}", admin(lh))
+		mux.Handle("POST /admin/machines/{id}/reinstall", admin(http.HandlerFunc(lh.Reinstall)))
+		mux.Handle("POST /admin/reinstall", admin(http.HandlerFunc(lh.Reinstall)))
+		mux.Handle("POST /phonehome/{host}", &lifecycle.PhoneHomeHandler{
+			Tracker:  tracker,
+			Tokens:   c.IgnitionTokens,
+			ClientIP: urls.clientIP,
+		})
+		handler = withLifecycle(handler, tracker, urls)
+	}
+
+	// The dashboard state is kept across reloads like the tracker.
+	if c.requests == nil {
+		c.requests = newRequestLog(c.RecentRequests)
+		c.verifier = &imageVerifier{}
+	}
+	mux.Handle("GET /dashboard", admin(&dashboard{
+		tracker:  c.Tracker(),
+		streams:  streams,
+		mirror:   c.Mirror(),
+		verifier: c.verifier,
+		requests: c.requests,
+	}))
+	mux.Handle("GET /dashboard/", dashboardStatic())
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard", http.StatusFound))
+
+	logger := c.accessLog
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return withLogging(handler, logger, urls, c.requests), nil
+}
+
+// Mirror returns the ImageMirror rooted at ImageDir.
+func (c *IPXE) Mirror() *mirror.ImageMirror {
+	return &mirror.ImageMirror{
+		RootDir: c.ImageDir,
+	}
+}
+
+// Streams returns a StreamCache backed by the stream files in ImageDir.
+func (c *IPXE) Streams() *coreos.StreamCache {
+	maxAge := c.StreamMaxAge
+	if maxAge == 0 {
+		maxAge = coreos.DefaultMaxAge
+	}
+	return &coreos.StreamCache{
+		LocalDir: filepath.Join(c.ImageDir, "/coreos/"),
+		MaxAge:   maxAge,
+	}
+}
+
+// Ignition returns the ignition Handler serving ConfigRoot.
+func (c *IPXE) Ignition() (*ignition.Handler, error) {
+	inv, err := c.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	return c.ignitionHandler(inv)
 }
 
-func withLogging(h http.Handler) http.Handler {
+// ignitionHandler returns the ignition Handler serving ConfigRoot, which
+// merges the includes of the inventory groups of each host and renders
+// templates with the inventory.
+func (c *IPXE) ignitionHandler(inv *inventory.File) (*ignition.Handler, error) {
+	backend, err := c.Secrets()
+	if err != nil {
+		return nil, err
+	}
+	co, err := c.configCheckout()
+	if err != nil {
+		return nil, err
+	}
+	urls, err := c.urlResolver()
+	if err != nil {
+		return nil, err
+	}
+	h := &ignition.Handler{
+		ConfigRoot: c.ConfigDir,
+		Tokens:     c.IgnitionTokens,
+		ClientIP:   urls.clientIP,
+		Includes:   inv.Includes,
+		Host:       inv.ConfigHost,
+		Secrets:    backend,
+	}
+	if co != nil {
+		h.ConfigRoot, h.Revision = co.dir, co.commit
+	}
+	if c.Tracker() != nil {
+		h.Pinned = c.pinnedConfig
+	}
+	if c.PhoneHome && c.Tracker() != nil {
+		if c.IgnitionTokens == nil {
+			return nil, errors.New("phone home needs a token key to sign its URL")
+		}
+		h.PhoneHome = func(r *http.Request, host string) string {
+			base := c.offlineBase(urls)
+			if r != nil {
+				base = urls.base(r)
+			}
+			u := base.JoinPath("phonehome", host)
+			u.RawQuery = url.Values{"sig": {c.IgnitionTokens.Tag(lifecycle.PhoneHomePurpose, host)}}.Encode()
+			return u.String()
+		}
+	}
+	return h, nil
+}
+
+// Secrets returns the configured secret backends, or nil when there are
+// none.
+func (c *IPXE) Secrets() (secrets.Backend, error) {
+	var chain secrets.Chain
+	if c.SecretsEnvPrefix != "" {
+		chain = append(chain, &secrets.Env{Prefix: c.SecretsEnvPrefix})
+	}
+	if c.SecretsAgeDir != "" {
+		dir, err := secrets.OpenAgeDir(c.SecretsAgeDir, c.SecretsAgeIdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, dir)
+	}
+	if c.VaultAddr != "" {
+		var tok []byte
+		if c.VaultTokenFile != "" {
+			var err error
+			if tok, err = os.ReadFile(c.VaultTokenFile); err != nil {
+				return nil, err
+			}
+		}
+		chain = append(chain, &secrets.Vault{
+			Address: c.VaultAddr,
+			Token:   strings.TrimSpace(string(tok)),
+			Mount:   c.VaultMount,
+		})
+	}
+	if chain == nil {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// offlineBase is the base URL used when rendering outside of a request:
+// ExternalURL, or else ListenAddr.
+func (c *IPXE) offlineBase(urls *urlResolver) *url.URL {
+	if urls.external != nil {
+		ext := *urls.external
+		return &ext
+	}
+	return &url.URL{Scheme: "http", Host: c.ListenAddr}
+}
+
+// RenderIPXE writes the script produced by the iPXE template name for a
+// client with the given MAC address, as if it were served from ListenAddr.
+func (c *IPXE) RenderIPXE(w io.Writer, name, mac string) error {
+	urls, err := c.urlResolver()
+	if err != nil {
+		return err
+	}
+	inv, err := c.Inventory()
+	if err != nil {
+		return err
+	}
+	h, err := c.newIPXEHandler(urls, inv)
+	if err != nil {
+		return err
+	}
+	return h.render(w, &ipxeRequest{
+		Name: name,
+		Base: c.offlineBase(urls),
+		MAC:  mac,
+	})
+}
+
+// withLogging writes an access log record for every request to logger,
+// including any attributes added by handlers with accesslog.Annotate, and
+// records request metrics. When recent is set requests are also kept for
+// the dashboard.
+func withLogging(h http.Handler, logger *slog.Logger, urls *urlResolver, recent *requestLog) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		ctx, entry := accesslog.NewContext(r.Context())
+		r = r.WithContext(ctx)
 		ww := &statusRespWriter{ResponseWriter: w}
 		h.ServeHTTP(ww, r)
 		duration := time.Since(start)
-		log.Printf("%s %s%s %d %s", r.Method, r.URL.Path, r.URL.Query().Encode(), ww.code, duration)
+
+		if ww.code == 0 {
+			ww.code = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(ww.code)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, r.Method).Observe(duration.Seconds())
+
+		q := r.URL.Query()
+		if q.Has("token") {
+			q.Set("token", "REDACTED")
+		}
+		attrs := []slog.Attr{
+			slog.String("client_ip", urls.clientIP(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("query", q.Encode()),
+			slog.String("route", r.Pattern),
+			slog.Int("status", ww.code),
+			slog.Int64("bytes", ww.bytes),
+			slog.Duration("duration", duration),
+		}
+		for _, k := range []string{"mac", "uuid"} {
+			if q.Has(k) {
+				attrs = append(attrs, slog.String(k, q.Get(k)))
+			}
+		}
+		attrs = append(attrs, entry.Attrs()...)
+		logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+		if recent != nil {
+			recent.add(requestRecord{
+				Time:     start,
+				ClientIP: urls.clientIP(r),
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Route:    r.Pattern,
+				Status:   ww.code,
+				Bytes:    ww.bytes,
+				Duration: duration,
+			})
+		}
 	})
 }
 
 type statusRespWriter struct {
 	http.ResponseWriter
-	code int
+	code  int
+	bytes int64
 }
 
 func (l *statusRespWriter) Write(b []byte) (int, error) {
 	if l.code == 0 {
 		l.code = http.StatusOK
 	}
-	return l.ResponseWriter.Write(b)
+	n, err := l.ResponseWriter.Write(b)
+	l.bytes += int64(n)
+	return n, err
 }
 
 func (l *statusRespWriter) WriteHeader(statusCode int) {
@@ -91,3 +599,7 @@ func (l *statusRespWriter) WriteHeader(statusCode int) {
 	}
 	l.ResponseWriter.WriteHeader(statusCode)
 }
+
+func (l *statusRespWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
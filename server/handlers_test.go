@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/nveeser/corepxe/accesslog"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithLogging(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/coreos/{filetype}", func(w http.ResponseWriter, r *http.Request) {
+		accesslog.Annotate(r.Context(), slog.String("cache", "hit"))
+		w.Write([]byte("kernel"))
+	})
+	var buf bytes.Buffer
+	urls, err := (&IPXE{TrustedProxies: []string{"10.0.0.1"}}).urlResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withLogging(mux, slog.New(slog.NewJSONHandler(&buf, nil)), urls, nil)
+
+	r := httptest.NewRequest("GET", "/images/coreos/kernel?mac=aa:bb&token=secret", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.7, 10.0.0.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) got err %s", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":       "request",
+		"client_ip": "192.0.2.7",
+		"route":     "GET /images/coreos/{filetype}",
+		"status":    float64(200),
+		"bytes":     float64(6),
+		"mac":       "aa:bb",
+		"cache":     "hit",
+		"query":     "mac=aa%3Abb&token=REDACTED",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s got %v wanted %v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/coreos"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultMinFreeDisk is used when IPXE.MinFreeDisk is zero.
+const DefaultMinFreeDisk = 4 << 30
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// readiness checks the dependencies needed to boot machines.
+type readiness struct {
+	configDir   string
+	imageDir    string
+	minFreeDisk uint64
+	streams     *coreos.StreamCache
+	ipxe        *ipxeHandler
+}
+
+type checkResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (h *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func() (string, error){
+		"config_dir": func() (string, error) { return h.configDir, checkDir(h.configDir) },
+		"image_dir":  func() (string, error) { return h.imageDir, checkDir(h.imageDir) },
+		"templates":  h.checkTemplates,
+		"streams":    h.checkStreams,
+		"disk":       h.checkDisk,
+	}
+	resp := struct {
+		Status string                 `json:"status"`
+		Checks map[string]checkResult `json:"checks"`
+	}{
+		Status: "ok",
+		Checks: make(map[string]checkResult),
+	}
+	code := http.StatusOK
+	for name, check := range checks {
+		detail, err := check()
+		res := checkResult{OK: err == nil, Detail: detail}
+		if err != nil {
+			res.Error = err.Error()
+			resp.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+		resp.Checks[name] = res
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *readiness) checkTemplates() (string, error) {
+	var names []string
+	for _, t := range h.ipxe.tmplSet.Templates() {
+		if t.Name() != "" {
+			names = append(names, t.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", errors.New("no iPXE templates")
+	}
+	return strings.Join(names, ","), nil
+}
+
+func (h *readiness) checkStreams() (string, error) {
+	loaded, err := h.streams.Loaded()
+	if err != nil {
+		return "", err
+	}
+	if len(loaded) == 0 {
+		return "", errors.New("no streams loaded")
+	}
+	return strings.Join(loaded, ","), nil
+}
+
+func (h *readiness) checkDisk() (string, error) {
+	free, err := freeDisk(h.imageDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return "unsupported", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%d bytes free", free)
+	if free < h.minFreeDisk {
+		return detail, fmt.Errorf("below minimum of %d bytes", h.minFreeDisk)
+	}
+	return detail, nil
+}
+
+// checkDir makes sure dir can be listed and written to.
+func checkDir(dir string) error {
+	if _, err := os.ReadDir(dir); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
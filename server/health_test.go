@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	c := &IPXE{
+		ConfigDir:   t.TempDir(),
+		ImageDir:    t.TempDir(),
+		MinFreeDisk: 1,
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("#!ipxe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	get := func() (int, map[string]checkResult) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		var resp struct {
+			Checks map[string]checkResult
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("json.Unmarshal() got err %s", err)
+		}
+		return w.Code, resp.Checks
+	}
+
+	code, checks := get()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz without streams got %d wanted %d", code, http.StatusServiceUnavailable)
+	}
+	if checks["streams"].OK {
+		t.Errorf("streams check got ok wanted failure")
+	}
+
+	stable, err := os.ReadFile("../coreos/testdata/stable.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(c.ImageDir, "coreos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.ImageDir, "coreos", "stable.json"), stable, 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, checks = get()
+	if code != http.StatusOK {
+		t.Errorf("GET /readyz got %d wanted %d: %+v", code, http.StatusOK, checks)
+	}
+	for _, name := range []string{"config_dir", "image_dir", "templates", "streams", "disk"} {
+		if !checks[name].OK {
+			t.Errorf("check %s got %+v wanted ok", name, checks[name])
+		}
+	}
+}
@@ -1,58 +1,235 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/nveeser/corepxe/accesslog"
+	"github.com/nveeser/corepxe/discovery"
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/inventory"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/token"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"text/template"
 )
 
 const templateSuffxix = ".cfg.tmpl"
 
+var errNoTemplate = errors.New("invalid template name")
+
 func NewIPXEHandler(configDir string) (http.Handler, error) {
-	tmplSet, err := template.New("").ParseGlob(configDir + "*" + templateSuffxix)
+	return newIPXEHandler(configDir)
+}
+
+func newIPXEHandler(configDir string) (*ipxeHandler, error) {
+	tmplSet, err := template.New("").ParseGlob(filepath.Join(configDir, "*"+templateSuffxix))
 	if err != nil {
 		return nil, fmt.Errorf("error parsing template(s): %w", err)
 	}
 	return &ipxeHandler{
-		tmplSet,
+		tmplSet: tmplSet,
+		urls:    &urlResolver{},
 	}, nil
 }
 
 type ipxeHandler struct {
 	tmplSet *template.Template
+	urls    *urlResolver
+	tokens  *token.Signer
+	// tracker, when set, supplies the release machines are pinned to and,
+	// with localBoot, boots installed machines from disk.
+	tracker   *lifecycle.Tracker
+	localBoot bool
+	// inventory, when set, picks the profile and Ignition config of known
+	// machines.
+	inventory *inventory.File
+	// discovery, when set, gets the machines missing from inventory,
+	// which boot the discovery image.
+	discovery *discovery.Store
 }
 
+// localBootTemplate, when present in the config directory, replaces
+// localBootScript for machines that boot from disk.
+const localBootTemplate = "localboot"
+
+// localBootScript boots the first BIOS disk, or on failure (e.g. under
+// UEFI) hands control back to the firmware, which moves on to the next
+// boot device.
+const localBootScript = `#!ipxe
+echo Booting from local disk
+sanboot --no-describe --drive 0x80 || exit
+`
+
+// discoveryTemplate, when present in the config directory, replaces
+// discoveryScript for machines missing from the inventory.
+const discoveryTemplate = "discovery"
+
+// discoveryScript boots the live image with the discovery Ignition config.
+var discoveryScript = template.Must(template.New("").Parse(`#!ipxe
+echo Booting discovery image
+kernel {{.ImageURL}}/kernel initrd=main coreos.live.rootfs_url={{.ImageURL}}/rootfs ignition.firstboot ignition.platform.id=metal ignition.config.url={{.IgnitionURL}}
+initrd --name main {{.ImageURL}}/initrd
+boot
+`))
+
+// ipxeRequest holds what is known about the client asking for an iPXE
+// script.
+type ipxeRequest struct {
+	Name string   // template name, without templateSuffxix
+	Base *url.URL // base URL the client uses to reach the server
+	MAC  string
+	IP   string
+
+	// localBoot is set by render when it booted the client from disk.
+	localBoot bool
+}
+
+// bootHeader is set to "disk" on iPXE scripts that boot the client from
+// its local disk instead of the installer.
+const bootHeader = "X-Boot-From"
+
 func (h *ipxeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	name := r.PathValue("name")
+	req := &ipxeRequest{
+		Name: r.PathValue("name"),
+		Base: h.urls.base(r),
+		MAC:  r.URL.Query().Get("mac"),
+		IP:   h.urls.clientIP(r),
+	}
+	accesslog.Annotate(r.Context(), slog.String("template", req.Name))
+	if h.undiscovered(req.MAC) {
+		m, err := h.discovery.Seen(req.MAC, req.IP)
+		switch {
+		case errors.Is(err, discovery.ErrInvalidMAC):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accesslog.Annotate(r.Context(), slog.String("discovery", m.MAC))
+	}
+	var buf bytes.Buffer
+	err := h.render(&buf, req)
+	switch {
+	case errors.Is(err, errNoTemplate):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("error processing template: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if req.localBoot {
+		w.Header().Set(bootHeader, "disk")
+		accesslog.Annotate(r.Context(), slog.Bool("local_boot", true))
+	}
+	w.Write(buf.Bytes())
+}
+
+func (h *ipxeHandler) render(w io.Writer, req *ipxeRequest) error {
+	var machine *lifecycle.Machine
+	if h.tracker != nil && req.MAC != "" {
+		machine, _ = h.tracker.Machine(req.MAC)
+	}
+	if h.localBoot && machine != nil && machine.State == lifecycle.StateInstalled {
+		req.localBoot = true
+		return h.renderLocalBoot(w, req)
+	}
+	name := req.Name
+	osname, config := inventory.DefaultOS, "standard"
+	var host *inventory.Host
+	if h.inventory != nil {
+		host = h.inventory.ByMAC(req.MAC)
+	}
+	switch {
+	case host != nil:
+		if host.Profile != "" {
+			name = host.Profile
+		}
+		osname, config = host.OSName(), host.ConfigName()
+	case h.undiscovered(req.MAC):
+		return h.renderDiscovery(w, req)
+	}
 	t := h.tmplSet.Lookup(name + templateSuffxix)
 	if t == nil {
-		http.Error(w, "invalid template name", http.StatusNotFound)
-		return
+		return errNoTemplate
 	}
-	images := &url.URL{
-		Scheme: "http",
-		Host:   r.Host,
-		Path:   "images/coreos",
+	images := req.Base.JoinPath("images/coreos")
+	if machine != nil && machine.Release != "" {
+		images = images.JoinPath("release", machine.Release)
 	}
-	ignition := &url.URL{
-		Scheme: "http",
-		Host:   r.Host,
-		Path:   "configs/coreos/standard",
+	ignitionURL := req.Base.JoinPath("configs", osname, config)
+	q := url.Values{}
+	if h.tokens != nil {
+		tok, err := h.tokens.Sign(ignition.TokenHost(config, host, req.MAC), req.IP, req.MAC)
+		if err != nil {
+			return err
+		}
+		q.Set("token", tok)
 	}
+	// The MAC picks the inventory host among those sharing a config, and
+	// tells which machine a token was issued to.
+	if req.MAC != "" && (host != nil || h.tokens != nil) {
+		q.Set("mac", req.MAC)
+	}
+	ignitionURL.RawQuery = q.Encode()
 	data := &struct {
 		ImageURL    string
 		IgnitionURL string
 		InstallDev  string
+		MAC         string
+		Host        *inventory.Host // nil when not in the inventory
 	}{
 		ImageURL:    images.String(),
-		IgnitionURL: ignition.String(),
+		IgnitionURL: ignitionURL.String(),
 		InstallDev:  "/dev/sda",
+		MAC:         req.MAC,
+		Host:        host,
 	}
-	r.URL.Hostname()
+	return t.Execute(w, data)
+}
 
-	if err := t.Execute(w, data); err != nil {
-		http.Error(w, fmt.Sprintf("error processing template: %s", err), http.StatusInternalServerError)
-		return
+// undiscovered reports whether the machine with mac boots the discovery
+// image.
+func (h *ipxeHandler) undiscovered(mac string) bool {
+	return h.discovery != nil && mac != "" && (h.inventory == nil || h.inventory.ByMAC(mac) == nil)
+}
+
+func (h *ipxeHandler) renderDiscovery(w io.Writer, req *ipxeRequest) error {
+	mac := inventory.NormalizeMAC(req.MAC)
+	t := discoveryScript
+	if dt := h.tmplSet.Lookup(discoveryTemplate + templateSuffxix); dt != nil {
+		t = dt
+	}
+	data := &struct {
+		ImageURL    string
+		IgnitionURL string
+		MAC         string
+	}{
+		ImageURL:    req.Base.JoinPath("images/coreos").String(),
+		IgnitionURL: req.Base.JoinPath("discovery/ignition", mac).String(),
+		MAC:         mac,
+	}
+	return t.Execute(w, data)
+}
+
+func (h *ipxeHandler) renderLocalBoot(w io.Writer, req *ipxeRequest) error {
+	if t := h.tmplSet.Lookup(localBootTemplate + templateSuffxix); t != nil {
+		return t.Execute(w, req)
+	}
+	_, err := io.WriteString(w, localBootScript)
+	return err
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return ip
 }
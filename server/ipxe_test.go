@@ -0,0 +1,256 @@
+package server
+
+import (
+	"github.com/nveeser/corepxe/discovery"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/token"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIPXELocalBoot(t *testing.T) {
+	c := &IPXE{
+		ConfigDir:             t.TempDir(),
+		ImageDir:              t.TempDir(),
+		StateDir:              t.TempDir(),
+		LocalBootAfterInstall: true,
+	}
+	apiToken := withAPIToken(t, c)
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("install"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	do := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer "+apiToken)
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s got status %d: %s", method, target, w.Code, w.Body.String())
+		}
+		return w
+	}
+	state := func() lifecycle.State {
+		m, err := c.Tracker().Machine("aa:bb:cc:dd:ee:ff")
+		if err != nil {
+			t.Fatalf("Machine() got err %s", err)
+		}
+		return m.State
+	}
+
+	if got := do("GET", "/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:ff").Body.String(); got != "install" {
+		t.Errorf("new machine got %q wanted installer", got)
+	}
+	if got := state(); got != lifecycle.StateInstalling {
+		t.Errorf("state got %s wanted %s", got, lifecycle.StateInstalling)
+	}
+
+	// Without PhoneHome fetching Ignition completes the install.
+	err = c.Tracker().Record(lifecycle.Identity{IP: "192.0.2.1"}, lifecycle.Event{Stage: lifecycle.StageIgnition, Status: 200})
+	if err != nil {
+		t.Fatalf("Record() got err %s", err)
+	}
+	if got := state(); got != lifecycle.StateInstalled {
+		t.Errorf("state got %s wanted %s", got, lifecycle.StateInstalled)
+	}
+	if got := do("GET", "/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:ff").Body.String(); got != localBootScript {
+		t.Errorf("installed machine got %q wanted local boot", got)
+	}
+	// Booting from disk is kept in the timeline without going back to the
+	// first stage, so the machine is not reported stalled.
+	m, err := c.Tracker().Machine("aa:bb:cc:dd:ee:ff")
+	if err != nil {
+		t.Fatalf("Machine() got err %s", err)
+	}
+	if last := m.Events[len(m.Events)-1]; m.Stage != lifecycle.StageIgnition || last.Stage != lifecycle.StageLocalBoot {
+		t.Errorf("after local boot got stage %s, last event %s wanted %s, %s", m.Stage, last.Stage, lifecycle.StageIgnition, lifecycle.StageLocalBoot)
+	}
+
+	do("POST", "/admin/machines/aa:bb:cc:dd:ee:ff/reinstall")
+	if got := state(); got != lifecycle.StateReinstall {
+		t.Errorf("state got %s wanted %s", got, lifecycle.StateReinstall)
+	}
+	if got := do("GET", "/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:ff").Body.String(); got != "install" {
+		t.Errorf("reinstall machine got %q wanted installer", got)
+	}
+	if got := state(); got != lifecycle.StateInstalling {
+		t.Errorf("state got %s wanted %s", got, lifecycle.StateInstalling)
+	}
+}
+
+func TestIPXEDiscovery(t *testing.T) {
+	c := &IPXE{
+		ConfigDir: t.TempDir(),
+		ImageDir:  t.TempDir(),
+		StateDir:  t.TempDir(),
+		Discovery: true,
+	}
+	apiToken := withAPIToken(t, c)
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("{{.IgnitionURL}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "install"+templateSuffxix), []byte("install {{.Host.Name}} {{.IgnitionURL}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	do := func(method, target string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s got status %d: %s", method, target, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if got := do("GET", "/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:ff"); !strings.Contains(got, "ignition.config.url=http://example.com/discovery/ignition/aa:bb:cc:dd:ee:ff") {
+		t.Errorf("unknown machine got %q wanted discovery", got)
+	}
+	if got := do("GET", "/discovery/ignition/aa:bb:cc:dd:ee:ff"); !strings.Contains(got, discovery.ReportUnit) {
+		t.Errorf("discovery ignition got %q", got)
+	}
+	if got := do("GET", "/configs/ipxe/boot"); got != "http://example.com/configs/coreos/standard" {
+		t.Errorf("no MAC got %q", got)
+	}
+
+	r := httptest.NewRequest("POST", "/admin/discovered/aa:bb:cc:dd:ee:ff/approve", strings.NewReader("name=node1&profile=install"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+apiToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approve got status %d: %s", w.Code, w.Body.String())
+	}
+	if got := do("GET", "/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:ff"); got != "install node1 http://example.com/configs/coreos/node1?mac=aa%3Abb%3Acc%3Add%3Aee%3Aff" {
+		t.Errorf("approved machine got %q", got)
+	}
+}
+
+func TestIPXEPinnedRelease(t *testing.T) {
+	c := &IPXE{
+		ListenAddr: "pxe:8086",
+		ConfigDir:  t.TempDir(),
+		ImageDir:   t.TempDir(),
+		StateDir:   t.TempDir(),
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("{{.ImageURL}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Tracker().Record(lifecycle.Identity{MAC: "aa:bb:cc:dd:ee:ff"}, lifecycle.Event{Stage: lifecycle.StageIPXE, Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Tracker().Pin("aa:bb:cc:dd:ee:ff", "40.20240728.3.0"); err != nil {
+		t.Fatalf("Pin() got err %s", err)
+	}
+	var buf strings.Builder
+	if err := c.RenderIPXE(&buf, "boot", "aa:bb:cc:dd:ee:ff"); err != nil {
+		t.Fatalf("RenderIPXE() got err %s", err)
+	}
+	if got, want := buf.String(), "http://pxe:8086/images/coreos/release/40.20240728.3.0"; got != want {
+		t.Errorf("RenderIPXE() got %q wanted %q", got, want)
+	}
+}
+
+func TestIPXETokenBehindProxy(t *testing.T) {
+	c := &IPXE{
+		ConfigDir:      t.TempDir(),
+		ImageDir:       t.TempDir(),
+		TrustedProxies: []string{"10.0.0.1"},
+		IgnitionTokens: &token.Signer{Key: []byte("0123456789abcdef0123456789abcdef"), BindIP: true},
+	}
+	for name, data := range map[string]string{
+		"boot" + templateSuffxix:    "{{.IgnitionURL}}",
+		"coreos/base/base.yaml":     "variant: fcos\nversion: 1.5.0\n",
+		"coreos/standard/host.yaml": "",
+	} {
+		path := filepath.Join(c.ConfigDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	get := func(target, client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	u, err := url.Parse(get("/configs/ipxe/boot", "192.0.2.1").Body.String())
+	if err != nil || u.Query().Get("token") == "" {
+		t.Fatalf("iPXE script got Ignition URL %v, %v wanted one with a token", u, err)
+	}
+	// The token is bound to the client behind the proxy, not the proxy.
+	if w := get(u.RequestURI(), "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("Ignition from the client got status %d: %s", w.Code, w.Body.String())
+	}
+	if w := get(u.RequestURI(), "192.0.2.2"); w.Code != http.StatusForbidden {
+		t.Errorf("Ignition from another client got status %d wanted 403", w.Code)
+	}
+}
+
+func TestIPXETokenBoundToHost(t *testing.T) {
+	c := &IPXE{
+		ConfigDir:      t.TempDir(),
+		ImageDir:       t.TempDir(),
+		IgnitionTokens: &token.Signer{Key: []byte("0123456789abcdef0123456789abcdef")},
+	}
+	for name, data := range map[string]string{
+		"boot" + templateSuffxix:  "{{.IgnitionURL}}",
+		"coreos/base/base.yaml":   "variant: fcos\nversion: 1.5.0\n",
+		"coreos/worker/host.yaml": "",
+		"inventory.yaml": `
+hosts:
+  node1: {config: worker, macs: ["aa:bb:cc:dd:ee:01"]}
+  node2: {config: worker, macs: ["aa:bb:cc:dd:ee:02"]}
+`,
+	} {
+		path := filepath.Join(c.ConfigDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := c.buildHandler()
+	if err != nil {
+		t.Fatalf("buildHandler() got err %s", err)
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	u, err := url.Parse(get("/configs/ipxe/boot?mac=aa:bb:cc:dd:ee:01").Body.String())
+	if err != nil || u.Query().Get("token") == "" {
+		t.Fatalf("iPXE script got Ignition URL %v, %v wanted one with a token", u, err)
+	}
+	if w := get(u.RequestURI()); w.Code != http.StatusOK {
+		t.Errorf("Ignition of node1 got status %d: %s", w.Code, w.Body.String())
+	}
+	// node2 shares the config of node1 but cannot use its token.
+	q := u.Query()
+	q.Set("mac", "aa:bb:cc:dd:ee:02")
+	u.RawQuery = q.Encode()
+	if w := get(u.RequestURI()); w.Code != http.StatusForbidden {
+		t.Errorf("Ignition of node2 with the token of node1 got status %d wanted 403", w.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/lifecycle"
+	"log/slog"
+	"net/http"
+)
+
+// withLifecycle records requests for the provisioning routes in the
+// timeline of the machine that made them, along with the config revision
+// of the Ignition configs served.
+func withLifecycle(h http.Handler, tracker *lifecycle.Tracker, urls *urlResolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := &statusRespWriter{ResponseWriter: w}
+		h.ServeHTTP(ww, r)
+
+		stage, detail := lifecycleStage(r)
+		if stage == "" {
+			return
+		}
+		if stage == lifecycle.StageIPXE && ww.Header().Get(bootHeader) == "disk" {
+			stage = lifecycle.StageLocalBoot
+		}
+		if ww.code == 0 {
+			ww.code = http.StatusOK
+		}
+		q := r.URL.Query()
+		id := lifecycle.Identity{
+			MAC:  q.Get("mac"),
+			UUID: q.Get("uuid"),
+			IP:   urls.clientIP(r),
+		}
+		err := tracker.Record(id, lifecycle.Event{
+			Stage:    stage,
+			Status:   ww.code,
+			IP:       id.IP,
+			Path:     r.URL.Path,
+			Detail:   detail,
+			Revision: ww.Header().Get(ignition.RevisionHeader),
+		})
+		if err != nil {
+			slog.Warn("Error recording lifecycle event", "path", r.URL.Path, "err", err)
+		}
+	})
+}
+
+// lifecycleStage maps the route that served r to a provisioning stage.
+func lifecycleStage(r *http.Request) (lifecycle.Stage, string) {
+	switch r.Pattern {
+	case "GET /configs/ipxe/{name}":
+		return lifecycle.StageIPXE, r.PathValue("name")
+	case "GET /images/coreos/{filetype}", "GET /images/coreos/release/{release}/{filetype}":
+		switch ft := r.PathValue("filetype"); ft {
+		case "kernel":
+			return lifecycle.StageKernel, ""
+		case "initrd":
+			return lifecycle.StageInitrd, ""
+		case "rootfs":
+			return lifecycle.StageRootfs, ""
+		}
+	case "GET /configs/{osname}/{name}":
+		return lifecycle.StageIgnition, r.PathValue("osname") + "/" + r.PathValue("name")
+	}
+	return "", ""
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultRecentRequests is used when IPXE.RecentRequests is zero.
+const DefaultRecentRequests = 100
+
+// requestRecord is a request as shown on the dashboard.
+type requestRecord struct {
+	Time     time.Time
+	ClientIP string
+	Method   string
+	Path     string
+	Route    string
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// requestLog keeps the last requests and, separately, the last failed
+// requests, so errors stay visible among boot traffic.
+type requestLog struct {
+	max int
+
+	mu       sync.Mutex
+	requests []requestRecord
+	failures []requestRecord
+}
+
+func newRequestLog(max int) *requestLog {
+	if max <= 0 {
+		max = DefaultRecentRequests
+	}
+	return &requestLog{max: max}
+}
+
+func (l *requestLog) add(rec requestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests = appendRing(l.requests, rec, l.max)
+	if rec.Status >= 400 {
+		l.failures = appendRing(l.failures, rec, l.max)
+	}
+}
+
+// recent returns the last requests and failed requests, newest first.
+func (l *requestLog) recent() (requests, failures []requestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return reversed(l.requests), reversed(l.failures)
+}
+
+func appendRing(recs []requestRecord, rec requestRecord, max int) []requestRecord {
+	if len(recs) >= max {
+		recs = append(recs[:0], recs[len(recs)-max+1:]...)
+	}
+	return append(recs, rec)
+}
+
+func reversed(recs []requestRecord) []requestRecord {
+	out := make([]requestRecord, len(recs))
+	for i, rec := range recs {
+		out[len(recs)-1-i] = rec
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/nveeser/corepxe/accesslog"
+	"github.com/nveeser/corepxe/lifecycle"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultShutdownTimeout is used when IPXE.ShutdownTimeout is zero.
+const DefaultShutdownTimeout = 5 * time.Minute
+
+// Run serves until the process receives SIGTERM or SIGINT, at which point
+// it stops accepting connections and waits up to ShutdownTimeout for
+// in-flight requests to finish. SIGHUP rebuilds the handler, re-reading
+// the templates and configuration; if that fails the previous handler
+// stays in place. HTTP is served on ListenAddr and, with TLS, HTTPS on
+// TLSListenAddr.
+func (c *IPXE) Run() error {
+	ln, err := net.Listen("tcp", c.ListenAddr)
+	if err != nil {
+		return err
+	}
+	var tlsLn net.Listener
+	if c.tlsEnabled() {
+		if tlsLn, err = net.Listen("tcp", c.tlsListenAddr()); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+	return c.serve(ln, tlsLn, sigs)
+}
+
+// serve serves HTTP on ln and, when tlsLn is not nil, HTTPS on tlsLn.
+func (c *IPXE) serve(ln, tlsLn net.Listener, sigs <-chan os.Signal) error {
+	defer c.Close()
+	closeListeners := func() {
+		ln.Close()
+		if tlsLn != nil {
+			tlsLn.Close()
+		}
+	}
+	if c.AccessLog != "" {
+		f := &accesslog.File{
+			Path:       c.AccessLog,
+			MaxSize:    c.AccessLogMaxSize,
+			MaxBackups: c.AccessLogMaxBackups,
+		}
+		defer f.Close()
+		c.accessLog = slog.New(slog.NewJSONHandler(f, nil))
+	}
+	handler := &reloadHandler{}
+	if err := c.reload(handler); err != nil {
+		closeListeners()
+		return err
+	}
+	// Start the iPXE Boot Server.
+	tlsAddr := ""
+	if tlsLn != nil {
+		tlsAddr = tlsLn.Addr().String()
+	}
+	slog.Info("Starting CoreOS iPXE Server",
+		"addr", ln.Addr().String(),
+		"tlsAddr", tlsAddr,
+		"configs", c.ConfigDir,
+		"configRepo", c.ConfigRepo,
+		"images", c.ImageDir)
+
+	servers := []*http.Server{{Handler: handler}}
+	if tlsLn != nil {
+		servers = append(servers, &http.Server{Handler: handler, TLSConfig: c.tlsConfig(handler)})
+	}
+	if tracker := c.Tracker(); tracker != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go checkStalled(tracker, stop)
+	}
+
+	errc := make(chan error, len(servers))
+	go func() { errc <- servers[0].Serve(ln) }()
+	if tlsLn != nil {
+		// The certificate comes from TLSConfig.GetCertificate.
+		go func() { errc <- servers[1].ServeTLS(tlsLn, "", "") }()
+	}
+
+	for {
+		select {
+		case err := <-errc:
+			// One server failed; stop the other.
+			for _, s := range servers {
+				s.Close()
+			}
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				slog.Info("Reloading", "signal", sig.String())
+				if err := c.reload(handler); err != nil {
+					slog.Error("Error reloading, keeping previous handler", "err", err)
+				}
+				continue
+			}
+			slog.Info("Shutting down", "signal", sig.String(), "timeout", c.shutdownTimeout())
+			return c.shutdown(servers, errc)
+		}
+	}
+}
+
+// shutdown gracefully stops servers, all at once, which report to errc
+// when they stop serving.
+func (c *IPXE) shutdown(servers []*http.Server, errc <-chan error) error {
+	timeout := c.shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Warn("Shutdown incomplete, closing connections", "timeout", timeout, "err", err)
+				s.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	var err error
+	for range servers {
+		if serr := <-errc; !errors.Is(serr, http.ErrServerClosed) && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// checkStalled periodically logs machines whose install has stalled.
+func checkStalled(tracker *lifecycle.Tracker, stop <-chan struct{}) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if _, err := tracker.CheckStalled(); err != nil {
+				slog.Warn("Error checking for stalled machines", "err", err)
+			}
+		}
+	}
+}
+
+func (c *IPXE) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout == 0 {
+		return DefaultShutdownTimeout
+	}
+	return c.ShutdownTimeout
+}
+
+func (c *IPXE) reload(h *reloadHandler) error {
+	var cert *tls.Certificate
+	var clientCAs *x509.CertPool
+	if c.tlsEnabled() {
+		var err error
+		if cert, err = c.loadCertificate(); err != nil {
+			return err
+		}
+		if clientCAs, err = c.loadClientCAs(); err != nil {
+			return err
+		}
+	}
+	prev := c.loadedCheckout()
+	if c.ConfigRepo != "" {
+		co, err := c.checkoutConfig(context.Background())
+		if err != nil {
+			return err
+		}
+		if prev == nil || co.commit != prev.commit {
+			slog.Info("Serving config revision", "repo", c.ConfigRepo, "commit", co.commit)
+		}
+		c.checkout.Store(co)
+	}
+	handler, err := c.buildHandler()
+	if err != nil {
+		c.checkout.Store(prev)
+		return err
+	}
+	h.current.Store(&handler)
+	if cert != nil {
+		h.cert.Store(cert)
+		h.clientCAs.Store(clientCAs)
+	}
+	return nil
+}
+
+// reloadHandler forwards requests to a handler that can be swapped
+// atomically while requests are being served. It also holds the TLS
+// certificate and client CAs, which are reloaded at the same time.
+type reloadHandler struct {
+	current   atomic.Pointer[http.Handler]
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*h.current.Load()).ServeHTTP(w, r)
+}
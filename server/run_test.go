@@ -0,0 +1,246 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeReloadShutdown(t *testing.T) {
+	configDir := t.TempDir()
+	tmpl := filepath.Join(configDir, "boot"+templateSuffxix)
+	if err := os.WriteFile(tmpl, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &IPXE{
+		ConfigDir:       configDir,
+		ImageDir:        t.TempDir(),
+		ShutdownTimeout: time.Second,
+	}
+	sigs := make(chan os.Signal)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serve(ln, nil, sigs)
+	}()
+
+	get := func() string {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/configs/ipxe/boot")
+		if err != nil {
+			t.Fatalf("GET got err %s", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("GET got err %s", err)
+		}
+		return string(body)
+	}
+	if got := get(); got != "first" {
+		t.Errorf("GET got %q wanted %q", got, "first")
+	}
+
+	// A template that fails to parse keeps the previous handler.
+	if err := os.WriteFile(tmpl, []byte("{{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sigs <- syscall.SIGHUP
+	if got := get(); got != "first" {
+		t.Errorf("GET after bad reload got %q wanted %q", got, "first")
+	}
+
+	if err := os.WriteFile(tmpl, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sigs <- syscall.SIGHUP
+	// The unbuffered send only guarantees the signal was received, so
+	// send another to be sure the first reload completed.
+	sigs <- syscall.SIGHUP
+	if got := get(); got != "second" {
+		t.Errorf("GET after reload got %q wanted %q", got, "second")
+	}
+
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve() got err %s wanted nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve() did not return after SIGTERM")
+	}
+}
+
+func TestServeHTTPAndHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pxe"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &IPXE{
+		ConfigDir:       t.TempDir(),
+		ImageDir:        t.TempDir(),
+		TLSCertFile:     filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:      filepath.Join(dir, "key.pem"),
+		ShutdownTimeout: time.Second,
+	}
+	for path, block := range map[string]*pem.Block{
+		c.TLSCertFile: {Type: "CERTIFICATE", Bytes: der},
+		c.TLSKeyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("{{.ImageURL}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serve(ln, tlsLn, sigs)
+	}()
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	for _, tc := range []struct {
+		base, want string
+	}{
+		{"http://" + ln.Addr().String(), "http://"},
+		{"https://" + tlsLn.Addr().String(), "https://"},
+	} {
+		resp, err := client.Get(tc.base + "/configs/ipxe/boot")
+		if err != nil {
+			t.Fatalf("GET %s got err %s", tc.base, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || !strings.HasPrefix(string(body), tc.want) {
+			t.Errorf("GET %s got %q, %v wanted URLs starting with %s", tc.base, body, err, tc.want)
+		}
+	}
+
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve() got err %s wanted nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve() did not return after SIGTERM")
+	}
+}
+
+func TestReloadClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	c := &IPXE{
+		ConfigDir:       t.TempDir(),
+		ImageDir:        t.TempDir(),
+		TLSCertFile:     filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:      filepath.Join(dir, "key.pem"),
+		TLSClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	writeCert := func(cn string) *x509.Certificate {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, block := range map[string]*pem.Block{
+			c.TLSCertFile:     {Type: "CERTIFICATE", Bytes: der},
+			c.TLSClientCAFile: {Type: "CERTIFICATE", Bytes: der},
+			c.TLSKeyFile:      {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		} {
+			if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "boot"+templateSuffxix), []byte("{{.ImageURL}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &reloadHandler{}
+	cfg := c.tlsConfig(h)
+	for _, cn := range []string{"first", "second"} {
+		cert := writeCert(cn)
+		if err := c.reload(h); err != nil {
+			t.Fatalf("reload() got err %s", err)
+		}
+		got, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := x509.NewCertPool()
+		want.AddCert(cert)
+		if !got.ClientCAs.Equal(want) {
+			t.Errorf("after reload with %s got client CAs that do not match the CA file", cn)
+		}
+		if got.ClientAuth != tls.VerifyClientCertIfGiven {
+			t.Errorf("got ClientAuth %v wanted %v", got.ClientAuth, tls.VerifyClientCertIfGiven)
+		}
+	}
+}
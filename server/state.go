@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/discovery"
+	"github.com/nveeser/corepxe/lifecycle"
+	"github.com/nveeser/corepxe/store"
+	"os"
+	"path/filepath"
+)
+
+// StateFile is the name of the state database in StateDir.
+const StateFile = "state.db"
+
+// State returns the state store, the database StateFile in StateDir, or
+// nil when StateDir is empty. It is opened on first use and kept across
+// reloads; Close releases it.
+func (c *IPXE) State() (store.Repository, error) {
+	if c.state != nil || c.stateErr != nil || c.StateDir == "" {
+		if c.state == nil {
+			return nil, c.stateErr
+		}
+		return c.state, nil
+	}
+	if err := os.MkdirAll(c.StateDir, 0755); err != nil {
+		c.stateErr = err
+		return nil, err
+	}
+	db, err := store.Open(filepath.Join(c.StateDir, StateFile), stateMigrations(c.StateDir)...)
+	if err != nil {
+		c.stateErr = err
+		return nil, err
+	}
+	c.state = db
+	return db, nil
+}
+
+// Close releases the state store, and removes the config revisions
+// exported without StateDir.
+func (c *IPXE) Close() error {
+	if base, ok := c.exports.Load().(string); ok {
+		os.RemoveAll(base)
+	}
+	if c.state == nil {
+		return nil
+	}
+	err := c.state.Close()
+	c.state, c.tracker = nil, nil
+	return err
+}
+
+// stateMigrations are the schema migrations of the state database. Only
+// append to this list.
+func stateMigrations(dir string) []store.Migration {
+	return []store.Migration{
+		{
+			// Before the state database machines and discovered machines
+			// were kept as one JSON file each under StateDir.
+			Name: "import JSON state files",
+			Run: func(r store.Repository) error {
+				err := importJSONFiles(r, filepath.Join(dir, "machines"), lifecycle.Bucket, func(m *lifecycle.Machine) string { return m.ID })
+				if err != nil {
+					return err
+				}
+				return importJSONFiles(r, filepath.Join(dir, "discovery"), discovery.Bucket, func(m *discovery.Machine) string { return m.MAC })
+			},
+		},
+	}
+}
+
+// importJSONFiles puts every *.json file in dir into bucket, keyed by the
+// key of the record it holds.
+func importJSONFiles[T any](r store.Repository, dir, bucket string, key func(*T) string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		body, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		v := new(T)
+		if err := json.Unmarshal(body, v); err != nil {
+			return fmt.Errorf("error reading %s: %w", f, err)
+		}
+		k := key(v)
+		if k == "" {
+			return errors.New("no key in " + f)
+		}
+		if err := r.Put(bucket, k, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
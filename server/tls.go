@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DefaultTLSListenAddr is used when IPXE.TLSListenAddr is empty.
+const DefaultTLSListenAddr = "0.0.0.0:8443"
+
+func (c *IPXE) tlsEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != ""
+}
+
+func (c *IPXE) tlsListenAddr() string {
+	if c.TLSListenAddr == "" {
+		return DefaultTLSListenAddr
+	}
+	return c.TLSListenAddr
+}
+
+// tlsConfig returns the listener's TLS configuration. The certificate and
+// client CAs are looked up in h on every handshake so they can be
+// replaced on reload.
+func (c *IPXE) tlsConfig(h *reloadHandler) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return h.cert.Load(), nil
+		},
+	}
+	if c.TLSClientCAFile != "" {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		base := cfg.Clone()
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			client := base.Clone()
+			client.ClientCAs = h.clientCAs.Load()
+			return client, nil
+		}
+	}
+	return cfg
+}
+
+// loadClientCAs reads TLSClientCAFile, or returns nil when it is not set.
+func (c *IPXE) loadClientCAs() (*x509.CertPool, error) {
+	if c.TLSClientCAFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(c.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.TLSClientCAFile)
+	}
+	return pool, nil
+}
+
+func (c *IPXE) loadCertificate() (*tls.Certificate, error) {
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("both TLSCertFile and TLSKeyFile are required")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// urlResolver works out the base URL a client used to reach the server,
+// so that URLs handed back to it (e.g. in iPXE scripts) use the same
+// scheme and host.
+type urlResolver struct {
+	external *url.URL
+	trusted  []netip.Prefix
+}
+
+func (c *IPXE) urlResolver() (*urlResolver, error) {
+	u := &urlResolver{}
+	if c.ExternalURL != "" {
+		ext, err := url.Parse(c.ExternalURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ExternalURL: %w", err)
+		}
+		if ext.Scheme != "http" && ext.Scheme != "https" || ext.Host == "" {
+			return nil, fmt.Errorf("invalid ExternalURL %q: want http(s)://host[/path]", c.ExternalURL)
+		}
+		u.external = ext
+	}
+	for _, p := range c.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(p)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		u.trusted = append(u.trusted, prefix.Masked())
+	}
+	return u, nil
+}
+
+// base returns the base URL for r. ExternalURL wins when configured;
+// otherwise the scheme comes from the connection and the host from the
+// request, both overridden by X-Forwarded-* headers set by a trusted proxy.
+func (u *urlResolver) base(r *http.Request) *url.URL {
+	if u.external != nil {
+		ext := *u.external
+		return &ext
+	}
+	base := &url.URL{
+		Scheme: "http",
+		Host:   r.Host,
+	}
+	if r.TLS != nil {
+		base.Scheme = "https"
+	}
+	if !u.isTrusted(r.RemoteAddr) {
+		return base
+	}
+	if proto := lastValue(r.Header.Values("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		base.Scheme = proto
+	}
+	if host := lastValue(r.Header.Values("X-Forwarded-Host")); host != "" {
+		base.Host = host
+	}
+	return base
+}
+
+func (u *urlResolver) isTrusted(remoteAddr string) bool {
+	if len(u.trusted) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range u.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent r. Behind trusted
+// proxies it is the right-most X-Forwarded-For address that is not itself
+// a trusted proxy.
+func (u *urlResolver) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !u.isTrusted(r.RemoteAddr) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == "" {
+			continue
+		}
+		ip = hops[i]
+		if !u.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// lastValue returns the last element of a comma separated header, which is
+// the one appended by the trusted proxy. Earlier elements come from the
+// client or proxies in front of it and can be forged.
+func lastValue(vs []string) string {
+	if len(vs) == 0 {
+		return ""
+	}
+	v := vs[len(vs)-1]
+	if i := strings.LastIndex(v, ","); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
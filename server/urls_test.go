@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestURLResolverBase(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     IPXE
+		remote  string
+		tls     bool
+		headers map[string]string
+		want    string
+	}{
+		{
+			name: "plain",
+			want: "http://example.com",
+		},
+		{
+			name: "tls",
+			tls:  true,
+			want: "https://example.com",
+		},
+		{
+			name: "external",
+			cfg:  IPXE{ExternalURL: "https://pxe.example.net/boot"},
+			want: "https://pxe.example.net/boot",
+		},
+		{
+			name:    "untrusted proxy",
+			cfg:     IPXE{TrustedProxies: []string{"10.0.0.0/8"}},
+			remote:  "192.168.1.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"},
+			want:    "http://example.com",
+		},
+		{
+			name:    "trusted proxy",
+			cfg:     IPXE{TrustedProxies: []string{"10.0.0.0/8"}},
+			remote:  "10.1.2.3:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "pxe.example.net"},
+			want:    "https://pxe.example.net",
+		},
+		{
+			name:    "trusted proxy appends to forged values",
+			cfg:     IPXE{TrustedProxies: []string{"10.0.0.0/8"}},
+			remote:  "10.1.2.3:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "http, https", "X-Forwarded-Host": "evil.example.com, pxe.example.net"},
+			want:    "https://pxe.example.net",
+		},
+		{
+			name:    "trusted proxy address",
+			cfg:     IPXE{TrustedProxies: []string{"10.1.2.3"}},
+			remote:  "10.1.2.3:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https"},
+			want:    "https://example.com",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := tc.cfg.urlResolver()
+			if err != nil {
+				t.Fatalf("urlResolver() got err %s", err)
+			}
+			r := httptest.NewRequest("GET", "/configs/ipxe/boot", nil)
+			if tc.remote != "" {
+				r.RemoteAddr = tc.remote
+			}
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := u.base(r).String(); got != tc.want {
+				t.Errorf("base() got %q wanted %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestURLResolverInvalid(t *testing.T) {
+	for _, cfg := range []IPXE{
+		{ExternalURL: "pxe.example.net"},
+		{TrustedProxies: []string{"not-an-ip"}},
+	} {
+		if _, err := cfg.urlResolver(); err == nil {
+			t.Errorf("urlResolver(%+v) got nil wanted err", cfg)
+		}
+	}
+}
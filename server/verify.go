@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nveeser/corepxe/mirror"
+)
+
+// Verification states of a mirrored image.
+const (
+	verifyUnknown   = "unverified" // no checksum in the cached streams
+	verifyPending   = "verifying"
+	verifyOK        = "verified"
+	verifyMismatch  = "mismatch"
+	verifyReadError = "error"
+)
+
+// imageVerifier checks mirrored images against the checksums in the
+// stream metadata. Images are hashed in the background, once per size and
+// modification time.
+type imageVerifier struct {
+	mu      sync.Mutex
+	results map[string]*verifyResult
+}
+
+type verifyResult struct {
+	size    int64
+	modTime time.Time
+	sum     string
+	err     error
+	done    bool
+}
+
+// state returns the verification state of e, a file in the mirror rooted
+// at root, expected to have SHA-256 want. It starts hashing the file if
+// it has not been hashed yet.
+func (v *imageVerifier) state(root string, e mirror.Entry, want string) string {
+	if want == "" {
+		return verifyUnknown
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.results == nil {
+		v.results = make(map[string]*verifyResult)
+	}
+	r := v.results[e.Path]
+	if r == nil || r.size != e.Size || !r.modTime.Equal(e.ModTime) {
+		r = &verifyResult{size: e.Size, modTime: e.ModTime}
+		v.results[e.Path] = r
+		go v.hash(filepath.Join(root, filepath.FromSlash(e.Path)), r)
+	}
+	switch {
+	case !r.done:
+		return verifyPending
+	case r.err != nil:
+		return verifyReadError
+	case r.sum != want:
+		return verifyMismatch
+	}
+	return verifyOK
+}
+
+func (v *imageVerifier) hash(path string, r *verifyResult) {
+	sum, err := sha256File(path)
+	if err != nil {
+		slog.Warn("Error verifying image", "path", path, "err", err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	r.sum, r.err, r.done = sum, err, true
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
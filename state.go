@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/nveeser/corepxe/store"
+	"io"
+	"os"
+)
+
+var stateCmd = &command{
+	name: "state",
+	help: "back up and restore the state database",
+	subs: []*command{
+		stateExportCmd,
+		stateImportCmd,
+	},
+}
+
+var stateExportOut string
+
+var stateExportCmd = &command{
+	name: "export",
+	help: "write the state database as JSON; the server must be stopped (use /api/v1/state while it runs)",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&stateExportOut, "o", "", "output file, default standard output")
+	},
+	run: func(args []string) error {
+		if len(args) != 0 {
+			return usageError("state export [-o file]")
+		}
+		state, err := openState()
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		var w io.Writer = os.Stdout
+		if stateExportOut != "" {
+			f, err := os.Create(stateExportOut)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return store.Export(w, state)
+	},
+}
+
+var stateImportCmd = &command{
+	name: "import",
+	args: "<file>",
+	help: "replace the contents of the state database with an export; the server must be stopped",
+	run: func(args []string) error {
+		if len(args) != 1 {
+			return usageError("state import <file>")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		state, err := openState()
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		return store.Import(f, state)
+	},
+}
+
+func openState() (store.Repository, error) {
+	state, err := srv.State()
+	if err == nil && state == nil {
+		err = errors.New("no state directory")
+	}
+	return state, err
+}
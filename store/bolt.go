@@ -0,0 +1,197 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// metaBucket holds the schema version of a Bolt database.
+const metaBucket = "_meta"
+
+// Migration upgrades the records of a database to the next schema
+// version. Migrations run inside a transaction, in the order passed to
+// Open; the position of a migration in that list is the version it
+// produces, so migrations must only ever be appended.
+type Migration struct {
+	Name string
+	Run  func(r Repository) error
+}
+
+// Bolt is a Repository backed by a bbolt database file.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path and applies any migrations
+// it has not seen yet. Only one process can have a database open; Open
+// fails after a few seconds if another one does.
+func Open(path string, migrations ...Migration) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("state database %s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := &Bolt{db: db}
+	if err := b.migrate(migrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("state database %s: %w", path, err)
+	}
+	return b, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// Version returns the schema version of the database: the number of
+// migrations applied to it.
+func (b *Bolt) Version() (int, error) {
+	return version(b)
+}
+
+func version(r Repository) (int, error) {
+	data, err := r.Get(metaBucket, "version")
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+func (b *Bolt) migrate(migrations []Migration) error {
+	current, err := b.Version()
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this corepxe (%d)", current, len(migrations))
+	}
+	for v := current + 1; v <= len(migrations); v++ {
+		m := migrations[v-1]
+		slog.Info("Migrating state database", "version", v, "migration", m.Name)
+		err := b.Update(func(tx Repository) error {
+			if err := m.Run(tx); err != nil {
+				return err
+			}
+			return tx.Put(metaBucket, "version", []byte(strconv.Itoa(v)))
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", v, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) Get(bucket, key string) ([]byte, error) {
+	var out []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		out, err = (&boltTx{tx}).Get(bucket, key)
+		return err
+	})
+	return out, err
+}
+
+func (b *Bolt) Put(bucket, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).Put(bucket, key, value)
+	})
+}
+
+func (b *Bolt) Delete(bucket, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).Delete(bucket, key)
+	})
+}
+
+func (b *Bolt) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return (&boltTx{tx}).ForEach(bucket, fn)
+	})
+}
+
+// Buckets returns the names of the buckets holding records, without the
+// bucket holding the schema version.
+func (b *Bolt) Buckets() ([]string, error) {
+	var out []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		out, err = (&boltTx{tx}).Buckets()
+		return err
+	})
+	return out, err
+}
+
+func (b *Bolt) Update(fn func(r Repository) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+// boltTx is the Repository of a single transaction.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Get(bucket, key string) ([]byte, error) {
+	bk := t.tx.Bucket([]byte(bucket))
+	if bk == nil {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, ErrNotFound)
+	}
+	v := bk.Get([]byte(key))
+	if v == nil {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, ErrNotFound)
+	}
+	// Values are only valid for the life of the transaction.
+	return append([]byte(nil), v...), nil
+}
+
+func (t *boltTx) Put(bucket, key string, value []byte) error {
+	bk, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return bk.Put([]byte(key), value)
+}
+
+func (t *boltTx) Delete(bucket, key string) error {
+	bk := t.tx.Bucket([]byte(bucket))
+	if bk == nil || bk.Get([]byte(key)) == nil {
+		return fmt.Errorf("%s/%s: %w", bucket, key, ErrNotFound)
+	}
+	return bk.Delete([]byte(key))
+}
+
+func (t *boltTx) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	bk := t.tx.Bucket([]byte(bucket))
+	if bk == nil {
+		return nil
+	}
+	return bk.ForEach(func(k, v []byte) error {
+		return fn(string(k), append([]byte(nil), v...))
+	})
+}
+
+func (t *boltTx) Buckets() ([]string, error) {
+	var names []string
+	err := t.tx.ForEach(func(name []byte, bk *bolt.Bucket) error {
+		if k, _ := bk.Cursor().First(); string(name) != metaBucket && k != nil {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Update runs fn in the same transaction.
+func (t *boltTx) Update(fn func(r Repository) error) error {
+	return fn(t)
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Memory is a Repository that lives in memory. It is used when corepxe
+// runs without a state directory, and in tests.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *Memory) Get(bucket, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, ErrNotFound)
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (m *Memory) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	m.buckets[bucket][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *Memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.buckets[bucket][key]; !ok {
+		return fmt.Errorf("%s/%s: %w", bucket, key, ErrNotFound)
+	}
+	delete(m.buckets[bucket], key)
+	if len(m.buckets[bucket]) == 0 {
+		delete(m.buckets, bucket)
+	}
+	return nil
+}
+
+func (m *Memory) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	m.mu.Lock()
+	records := m.buckets[bucket]
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	m.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := m.Get(bucket, k)
+		if err != nil {
+			continue // deleted meanwhile
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Buckets() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for b := range m.buckets {
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Update runs fn against a copy of m, which replaces m if fn succeeds.
+// Other writers are blocked until fn returns.
+func (m *Memory) Update(fn func(r Repository) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := NewMemory()
+	for b, records := range m.buckets {
+		tx.buckets[b] = make(map[string][]byte, len(records))
+		for k, v := range records {
+			tx.buckets[b][k] = v
+		}
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	m.buckets = tx.buckets
+	return nil
+}
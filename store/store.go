@@ -0,0 +1,132 @@
+// Package store keeps corepxe's state: machine timelines, pending
+// discovered machines, spent one-time tokens and optionally the inventory.
+// Records are JSON values grouped into named buckets, held by a
+// Repository: an embedded bbolt database (Open) or memory (NewMemory).
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+// Repository holds records, byte values keyed by bucket and key.
+type Repository interface {
+	// Get returns the record at bucket/key, or ErrNotFound.
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	// Delete removes the record at bucket/key, or returns ErrNotFound.
+	Delete(bucket, key string) error
+	// ForEach calls fn for every record of bucket in key order. fn must
+	// not modify the repository.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	// Buckets returns the names of the buckets holding records.
+	Buckets() ([]string, error)
+	// Update calls fn with a Repository whose changes are applied
+	// atomically, if fn returns nil, or not at all.
+	Update(fn func(r Repository) error) error
+}
+
+// GetJSON decodes the record at bucket/key into v.
+func GetJSON(r Repository, bucket, key string, v any) error {
+	data, err := r.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error decoding %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// PutJSON stores v encoded as JSON at bucket/key.
+func PutJSON(r Repository, bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.Put(bucket, key, data)
+}
+
+// Keys returns the keys of bucket in order.
+func Keys(r Repository, bucket string) ([]string, error) {
+	var keys []string
+	err := r.ForEach(bucket, func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// Dump is the JSON form of a repository written by Export.
+type Dump struct {
+	Buckets map[string]map[string]json.RawMessage `json:"buckets"`
+}
+
+// Export writes every record of r to w as a JSON Dump.
+func Export(w io.Writer, r Repository) error {
+	dump := &Dump{Buckets: make(map[string]map[string]json.RawMessage)}
+	buckets, err := r.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		records := make(map[string]json.RawMessage)
+		err := r.ForEach(b, func(key string, value []byte) error {
+			if !json.Valid(value) {
+				return fmt.Errorf("record %s/%s is not JSON", b, key)
+			}
+			records[key] = append(json.RawMessage(nil), value...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		dump.Buckets[b] = records
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// Import replaces the contents of r with the Dump read from rd.
+func Import(rd io.Reader, r Repository) error {
+	dump := &Dump{}
+	if err := json.NewDecoder(rd).Decode(dump); err != nil {
+		return fmt.Errorf("error reading dump: %w", err)
+	}
+	return r.Update(func(tx Repository) error {
+		buckets, err := tx.Buckets()
+		if err != nil {
+			return err
+		}
+		for _, b := range buckets {
+			keys, err := Keys(tx, b)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := tx.Delete(b, k); err != nil {
+					return err
+				}
+			}
+		}
+		names := make([]string, 0, len(dump.Buckets))
+		for b := range dump.Buckets {
+			names = append(names, b)
+		}
+		sort.Strings(names)
+		for _, b := range names {
+			for k, v := range dump.Buckets[b] {
+				if err := tx.Put(b, k, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositories(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("Open() got err %s", err)
+	}
+	defer db.Close()
+	for name, r := range map[string]Repository{"bolt": db, "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := r.Get("hosts", "node1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(missing) got err %v wanted %s", err, ErrNotFound)
+			}
+			if err := PutJSON(r, "hosts", "node1", map[string]string{"os": "coreos"}); err != nil {
+				t.Fatalf("PutJSON() got err %s", err)
+			}
+			if err := PutJSON(r, "hosts", "node0", map[string]string{}); err != nil {
+				t.Fatalf("PutJSON() got err %s", err)
+			}
+			var v map[string]string
+			if err := GetJSON(r, "hosts", "node1", &v); err != nil || v["os"] != "coreos" {
+				t.Errorf("GetJSON() got %v, %v", v, err)
+			}
+			if keys, err := Keys(r, "hosts"); err != nil || len(keys) != 2 || keys[0] != "node0" {
+				t.Errorf("Keys() got %v, %v wanted sorted keys", keys, err)
+			}
+			err := r.Update(func(tx Repository) error {
+				if err := tx.Delete("hosts", "node0"); err != nil {
+					return err
+				}
+				return errors.New("abort")
+			})
+			if err == nil {
+				t.Errorf("Update() got nil err")
+			}
+			if _, err := r.Get("hosts", "node0"); err != nil {
+				t.Errorf("Get() after aborted Update got err %s", err)
+			}
+			if err := r.Delete("hosts", "node0"); err != nil {
+				t.Errorf("Delete() got err %s", err)
+			}
+			if err := r.Delete("hosts", "node0"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second Delete() got err %v wanted %s", err, ErrNotFound)
+			}
+
+			var buf bytes.Buffer
+			if err := Export(&buf, r); err != nil {
+				t.Fatalf("Export() got err %s", err)
+			}
+			r.Put("machines", "stale", []byte("{}"))
+			if err := Import(bytes.NewReader(buf.Bytes()), r); err != nil {
+				t.Fatalf("Import() got err %s", err)
+			}
+			if buckets, _ := r.Buckets(); len(buckets) != 1 || buckets[0] != "hosts" {
+				t.Errorf("Buckets() after Import got %v wanted [hosts]", buckets)
+			}
+			if err := GetJSON(r, "hosts", "node1", &v); err != nil || v["os"] != "coreos" {
+				t.Errorf("GetJSON() after Import got %v, %v", v, err)
+			}
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	var runs []string
+	migration := func(name string) Migration {
+		return Migration{Name: name, Run: func(r Repository) error {
+			runs = append(runs, name)
+			return r.Put("log", name, []byte("true"))
+		}}
+	}
+	db, err := Open(path, migration("one"))
+	if err != nil {
+		t.Fatalf("Open() got err %s", err)
+	}
+	db.Close()
+	db, err = Open(path, migration("one"), migration("two"))
+	if err != nil {
+		t.Fatalf("Open() got err %s", err)
+	}
+	if v, err := db.Version(); err != nil || v != 2 {
+		t.Errorf("Version() got %d, %v wanted 2", v, err)
+	}
+	db.Close()
+	if len(runs) != 2 || runs[0] != "one" || runs[1] != "two" {
+		t.Errorf("migrations ran %v wanted [one two]", runs)
+	}
+
+	if _, err := Open(path, migration("one")); err == nil {
+		t.Errorf("Open() of a newer database got nil err")
+	}
+}
@@ -0,0 +1,229 @@
+// Package token issues and verifies signed tokens that grant a single
+// host access to its rendered Ignition config.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nveeser/corepxe/store"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is used when Signer.TTL is zero.
+const DefaultTTL = 15 * time.Minute
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+	ErrUsed    = errors.New("token already used")
+	ErrBinding = errors.New("token not valid for this client")
+)
+
+// Claims are the contents of a token.
+type Claims struct {
+	Host    string `json:"h"`
+	Expires int64  `json:"e"`
+	Nonce   string `json:"n"`
+	IP      string `json:"ip,omitempty"`
+	MAC     string `json:"m,omitempty"`
+}
+
+// Signer issues and verifies tokens using an HMAC-SHA256 key.
+type Signer struct {
+	Key []byte
+	TTL time.Duration
+	// OneTime rejects a token the second time it is presented.
+	OneTime bool
+	// BindIP and BindMAC restrict a token to the IP address and MAC
+	// address of the client it was issued to.
+	BindIP  bool
+	BindMAC bool
+	// Store, when set, records spent one-time tokens so they stay spent
+	// across restarts. Otherwise they are kept in memory.
+	Store store.Repository
+
+	mu   sync.Mutex
+	used map[string]time.Time // nonce -> expiry
+	now  func() time.Time
+}
+
+// ReadKeyFile reads a signing key from path. The file must hold at least
+// 32 bytes; surrounding whitespace is ignored.
+func ReadKeyFile(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < 32 {
+		return nil, fmt.Errorf("key file %s: key must be at least 32 bytes", path)
+	}
+	return key, nil
+}
+
+func (s *Signer) time() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Sign returns a token for host. ip and mac are recorded when the Signer
+// binds tokens to them.
+func (s *Signer) Sign(host, ip, mac string) (string, error) {
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	c := &Claims{
+		Host:    host,
+		Expires: s.time().Add(ttl).Unix(),
+		Nonce:   hex.EncodeToString(nonce),
+	}
+	if s.BindIP {
+		c.IP = ip
+	}
+	if s.BindMAC {
+		c.MAC = normalizeMAC(mac)
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	p := enc.EncodeToString(payload)
+	return p + "." + enc.EncodeToString(s.mac(p)), nil
+}
+
+// Verify checks that tok was issued for host and, when bound, to a client
+// with the given ip and mac. A one-time token is consumed by a successful
+// Verify.
+func (s *Signer) Verify(tok, host, ip, mac string) (*Claims, error) {
+	p, sig, ok := strings.Cut(tok, ".")
+	if !ok {
+		return nil, ErrInvalid
+	}
+	enc := base64.RawURLEncoding
+	got, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.mac(p)) {
+		return nil, ErrInvalid
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	c := &Claims{}
+	if err := json.Unmarshal(payload, c); err != nil {
+		return nil, ErrInvalid
+	}
+	now := s.time()
+	switch {
+	case c.Host != host:
+		return nil, ErrBinding
+	case now.Unix() >= c.Expires:
+		return nil, ErrExpired
+	case c.IP != "" && c.IP != ip:
+		return nil, ErrBinding
+	case c.MAC != "" && c.MAC != normalizeMAC(mac):
+		return nil, ErrBinding
+	}
+	if s.OneTime {
+		if err := s.use(c, now); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Bucket is the store bucket holding spent one-time tokens, keyed by nonce
+// with their expiry as value.
+const Bucket = "tokens"
+
+func (s *Signer) use(c *Claims, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Store != nil {
+		return s.useStored(c, now)
+	}
+	if s.used == nil {
+		s.used = make(map[string]time.Time)
+	}
+	for n, exp := range s.used {
+		if now.Unix() >= exp.Unix() {
+			delete(s.used, n)
+		}
+	}
+	if _, ok := s.used[c.Nonce]; ok {
+		return ErrUsed
+	}
+	s.used[c.Nonce] = time.Unix(c.Expires, 0)
+	return nil
+}
+
+// useStored is use for a Signer with a Store. Expired nonces are pruned
+// in the same transaction.
+func (s *Signer) useStored(c *Claims, now time.Time) error {
+	return s.Store.Update(func(r store.Repository) error {
+		var expired []string
+		err := r.ForEach(Bucket, func(nonce string, value []byte) error {
+			if exp, err := strconv.ParseInt(string(value), 10, 64); err != nil || now.Unix() >= exp {
+				expired = append(expired, nonce)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, n := range expired {
+			if err := r.Delete(Bucket, n); err != nil {
+				return err
+			}
+		}
+		if _, err := r.Get(Bucket, c.Nonce); err == nil {
+			return ErrUsed
+		} else if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		return r.Put(Bucket, c.Nonce, []byte(strconv.FormatInt(c.Expires, 10)))
+	})
+}
+
+// Tag returns a signature of name for purpose that does not expire, for
+// URLs a rendered config calls back long after its token expired, such
+// as the phone home URL of a host.
+func (s *Signer) Tag(purpose, name string) string {
+	return base64.RawURLEncoding.EncodeToString(s.mac("tag\x00" + purpose + "\x00" + name))
+}
+
+// VerifyTag checks that tag was returned by Tag for purpose and name.
+func (s *Signer) VerifyTag(tag, purpose, name string) error {
+	got, err := base64.RawURLEncoding.DecodeString(tag)
+	if err != nil || !hmac.Equal(got, s.mac("tag\x00"+purpose+"\x00"+name)) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func (s *Signer) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.Key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+func normalizeMAC(mac string) string {
+	return strings.ReplaceAll(strings.ToLower(mac), "-", ":")
+}
@@ -0,0 +1,129 @@
+package token
+
+import (
+	"errors"
+	"github.com/nveeser/corepxe/store"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	newSigner := func() *Signer {
+		return &Signer{
+			Key:     []byte("0123456789abcdef0123456789abcdef"),
+			TTL:     time.Minute,
+			BindIP:  true,
+			BindMAC: true,
+			now:     func() time.Time { return now },
+		}
+	}
+	s := newSigner()
+	tok, err := s.Sign("node1", "10.0.0.1", "AA-BB-CC-DD-EE-FF")
+	if err != nil {
+		t.Fatalf("Sign() got err %s", err)
+	}
+
+	cases := []struct {
+		name  string
+		tok   string
+		host  string
+		ip    string
+		mac   string
+		after time.Duration
+		want  error
+	}{
+		{name: "ok", tok: tok, host: "node1", ip: "10.0.0.1", mac: "aa:bb:cc:dd:ee:ff"},
+		{name: "wrong host", tok: tok, host: "node2", ip: "10.0.0.1", mac: "aa:bb:cc:dd:ee:ff", want: ErrBinding},
+		{name: "wrong ip", tok: tok, host: "node1", ip: "10.0.0.2", mac: "aa:bb:cc:dd:ee:ff", want: ErrBinding},
+		{name: "wrong mac", tok: tok, host: "node1", ip: "10.0.0.1", mac: "aa:bb:cc:dd:ee:00", want: ErrBinding},
+		{name: "expired", tok: tok, host: "node1", ip: "10.0.0.1", mac: "aa:bb:cc:dd:ee:ff", after: time.Minute, want: ErrExpired},
+		{name: "tampered", tok: tok[1:], host: "node1", ip: "10.0.0.1", mac: "aa:bb:cc:dd:ee:ff", want: ErrInvalid},
+		{name: "garbage", tok: "garbage", host: "node1", want: ErrInvalid},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newSigner()
+			v.now = func() time.Time { return now.Add(tc.after) }
+			_, err := v.Verify(tc.tok, tc.host, tc.ip, tc.mac)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Verify() got err %v wanted %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestOneTime(t *testing.T) {
+	s := &Signer{
+		Key:     []byte("0123456789abcdef0123456789abcdef"),
+		OneTime: true,
+	}
+	tok, err := s.Sign("node1", "", "")
+	if err != nil {
+		t.Fatalf("Sign() got err %s", err)
+	}
+	if _, err := s.Verify(tok, "node1", "", ""); err != nil {
+		t.Errorf("first Verify() got err %s wanted nil", err)
+	}
+	if _, err := s.Verify(tok, "node1", "", ""); !errors.Is(err, ErrUsed) {
+		t.Errorf("second Verify() got err %v wanted %v", err, ErrUsed)
+	}
+}
+
+func TestOneTimeStore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	repo := store.NewMemory()
+	newSigner := func() *Signer {
+		return &Signer{
+			Key:     []byte("0123456789abcdef0123456789abcdef"),
+			OneTime: true,
+			Store:   repo,
+			now:     func() time.Time { return now },
+		}
+	}
+	tok, err := newSigner().Sign("node1", "", "")
+	if err != nil {
+		t.Fatalf("Sign() got err %s", err)
+	}
+	if _, err := newSigner().Verify(tok, "node1", "", ""); err != nil {
+		t.Errorf("first Verify() got err %s wanted nil", err)
+	}
+	// A restarted server still refuses the token.
+	if _, err := newSigner().Verify(tok, "node1", "", ""); !errors.Is(err, ErrUsed) {
+		t.Errorf("second Verify() got err %v wanted %v", err, ErrUsed)
+	}
+	// Spending a token once the first expired prunes it.
+	now = now.Add(time.Hour)
+	tok2, err := newSigner().Sign("node2", "", "")
+	if err != nil {
+		t.Fatalf("Sign() got err %s", err)
+	}
+	if _, err := newSigner().Verify(tok2, "node2", "", ""); err != nil {
+		t.Errorf("Verify() got err %s wanted nil", err)
+	}
+	if keys, _ := store.Keys(repo, Bucket); len(keys) != 1 {
+		t.Errorf("store got %d nonces wanted only the unexpired one", len(keys))
+	}
+}
+
+func TestTag(t *testing.T) {
+	s := &Signer{Key: []byte("0123456789abcdef0123456789abcdef")}
+	tag := s.Tag("phonehome", "node1")
+	if err := s.VerifyTag(tag, "phonehome", "node1"); err != nil {
+		t.Errorf("VerifyTag() got err %s", err)
+	}
+	for _, tc := range []struct{ tag, purpose, name string }{
+		{tag, "phonehome", "node2"},
+		{tag, "other", "node1"},
+		{"", "phonehome", "node1"},
+		{tag[1:], "phonehome", "node1"},
+	} {
+		if err := s.VerifyTag(tc.tag, tc.purpose, tc.name); !errors.Is(err, ErrInvalid) {
+			t.Errorf("VerifyTag(%q, %s, %s) got err %v wanted %s", tc.tag, tc.purpose, tc.name, err, ErrInvalid)
+		}
+	}
+	other := &Signer{Key: []byte("fedcba9876543210fedcba9876543210")}
+	if err := other.VerifyTag(tag, "phonehome", "node1"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("VerifyTag() with another key got err %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nveeser/corepxe/ignition"
+	"github.com/nveeser/corepxe/server"
+)
+
+var validateStrict bool
+
+var validateCmd = &command{
+	name: "validate",
+	help: "check that the iPXE templates parse and every host renders without errors; exits non-zero otherwise, e.g. for a pre-commit hook",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&validateStrict, "strict", false, "fail on Butane warnings too")
+	},
+	run: func(args []string) error {
+		if len(args) != 0 {
+			return usageError("validate")
+		}
+		failed := false
+		check := func(what string, err error) {
+			if err != nil {
+				failed = true
+				fmt.Printf("FAIL %s: %s\n", what, err)
+				return
+			}
+			fmt.Printf("ok   %s\n", what)
+		}
+		fails := func(f ignition.Finding) bool {
+			return f.Level == ignition.LevelError || validateStrict && f.Level == ignition.LevelWarning
+		}
+
+		root, err := srv.ConfigRoot()
+		if err != nil {
+			return err
+		}
+		_, err = server.NewIPXEHandler(root)
+		check("ipxe templates", err)
+
+		h, err := srv.Ignition()
+		if err != nil {
+			return err
+		}
+		osnames, err := h.OSNames()
+		if err != nil {
+			return err
+		}
+		for _, osname := range osnames {
+			hosts, err := h.Hosts(osname)
+			if err != nil {
+				check(osname, err)
+				continue
+			}
+			for _, host := range hosts {
+				findings, err := h.Validate(context.Background(), osname, host)
+				if err != nil {
+					check(osname+"/"+host, err)
+					continue
+				}
+				ok := true
+				for _, f := range findings {
+					ok = ok && !fails(f)
+				}
+				if ok {
+					check(osname+"/"+host, nil)
+				}
+				for _, f := range findings {
+					if fails(f) {
+						failed = true
+						fmt.Printf("FAIL %s\n", f)
+					} else {
+						fmt.Printf("     %s\n", f)
+					}
+				}
+			}
+		}
+		if failed {
+			return errors.New("validation failed")
+		}
+		return nil
+	},
+}